@@ -0,0 +1,267 @@
+// Package client embeds a picotunnel client in a Go program. A Client
+// keeps a tunnel to a picotunnel server open, reconnecting as needed, and
+// serves the streams the server opens for the tunnel's services.
+//
+// By default streams are forwarded to their service's target address over
+// the network, like the picotunnel-client command. Set Config.Handler to
+// serve them in-process instead, for example from an http.Handler:
+//
+//	c, err := client.New(client.Config{
+//		Server:  "tunnel.example.com:8443",
+//		Token:   os.Getenv("PICOTUNNEL_TOKEN"),
+//		Handler: client.HTTPHandler(mux),
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	err = c.Run(ctx)
+//
+// or from anything that accepts connections from a net.Listener:
+//
+//	listener := client.NewListener()
+//	go grpcServer.Serve(listener)
+//	c, err := client.New(client.Config{..., Handler: listener})
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	internalclient "github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/models"
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+// State is the connection state of a client
+type State string
+
+// Connection states
+const (
+	StateConnecting   State = internalclient.StateConnecting   // no connection has succeeded yet
+	StateConnected    State = internalclient.StateConnected    // a connection is up
+	StateReconnecting State = internalclient.StateReconnecting // the connection was lost and is being retried
+	StateStopped      State = internalclient.StateStopped      // the client is shutting down
+)
+
+// Config configures a Client
+type Config struct {
+	Server string // host:port (WebSocket over TLS) or a wss://, ws:// or tls:// URL
+	Token  string
+
+	// TLS to the server. Certificate files are read on every connection
+	// attempt.
+	CAFile    string   // PEM bundle to verify the server with, instead of the system roots
+	Pins      []string // SPKI pins ("sha256/BASE64"), one of which the server's chain must contain
+	CertFile  string   // client certificate for mutual TLS
+	KeyFile   string   // client certificate key
+	Insecure  bool     // skip verifying the server's certificate (pins are still checked)
+	Plaintext bool     // connect without TLS when Server has no scheme
+
+	// Proxy is an http://, https:// or socks5:// proxy URL to reach the
+	// server through. Empty uses HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	Proxy string
+
+	// Name prefixes the client's log lines (optional)
+	Name string
+
+	// Version is reported to the server in the handshake (default
+	// "library")
+	Version string
+
+	// DrainTimeout bounds how long in-flight streams may run after the
+	// client or server starts shutting down a connection (default 30s)
+	DrainTimeout time.Duration
+
+	// Handler serves the streams the server opens. Nil forwards each
+	// stream to its target address, as Forward does.
+	Handler StreamHandler
+
+	// Services are declared to the server on every connect, which creates
+	// them within the tunnel's limits and removes ones no longer declared.
+	// Nil leaves the tunnel's services to the server.
+	Services []Service
+
+	// OnStateChange is called whenever the connection state changes, with
+	// the most recent connection error while connecting or reconnecting.
+	// Calls are serialized and should return quickly.
+	OnStateChange func(state State, err error)
+}
+
+// Service declares a service for the tunnel, as in the client config file.
+// HTTP services need a Domain, TCP and UDP services a ListenPort, and all
+// of them a TargetAddr, which in-process handlers receive as Stream.Target.
+type Service struct {
+	Type       string // "http", "tcp" or "udp"
+	Domain     string
+	PathPrefix string
+	ListenPort int
+	TargetAddr string
+
+	// Rewrites the server applies to requests for HTTP services
+	HostHeader    string            // Host sent to the target instead of the public domain
+	SetHeaders    map[string]string // request headers added or replaced
+	RemoveHeaders []string          // request headers removed
+	RewritePrefix string            // replaces PathPrefix in the request path
+}
+
+// Status is a snapshot of a client's connection
+type Status struct {
+	State         State
+	ConnectedAt   time.Time // zero unless connected
+	Reconnects    int64
+	LastError     string
+	LastErrorAt   time.Time
+	RTT           time.Duration // round trip of the last ping
+	ActiveStreams int
+}
+
+// Client is an embedded tunnel client. It is safe for concurrent use.
+type Client struct {
+	config Config
+	inner  *internalclient.Client
+	mu     sync.Mutex
+}
+
+// New validates a configuration and returns a client ready to Run
+func New(config Config) (*Client, error) {
+	if config.Server == "" {
+		return nil, fmt.Errorf("server address is required")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("token is required")
+	}
+	if config.Proxy != "" {
+		if _, err := tunnel.ParseProxyURL(config.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	if err := serverTLS(config).Validate(); err != nil {
+		return nil, err
+	}
+	if config.Version == "" {
+		config.Version = "library"
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = 30 * time.Second
+	}
+
+	return &Client{config: config}, nil
+}
+
+// Run connects to the server and serves streams until ctx is canceled,
+// reconnecting with backoff whenever the connection drops. On cancellation
+// the server is asked to route new streams elsewhere, and in-flight streams
+// get up to DrainTimeout to finish. Run returns nil once the client has
+// stopped; a client may be run again after Run returns.
+func (c *Client) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if c.inner != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("client is already running")
+	}
+	inner := internalclient.NewClient(c.internalConfig())
+	c.inner = inner
+	c.mu.Unlock()
+
+	inner.StartBackground()
+	<-ctx.Done()
+	inner.Stop()
+
+	c.mu.Lock()
+	c.inner = nil
+	c.mu.Unlock()
+	return nil
+}
+
+// Status returns a snapshot of the client's connection. A client that is
+// not running reports StateStopped.
+func (c *Client) Status() Status {
+	c.mu.Lock()
+	inner := c.inner
+	c.mu.Unlock()
+
+	if inner == nil {
+		return Status{State: StateStopped}
+	}
+	return convertStatus(inner.Status())
+}
+
+// internalConfig translates the configuration for the internal client
+func (c *Client) internalConfig() internalclient.Config {
+	config := internalclient.Config{
+		Name:         c.config.Name,
+		ServerAddr:   c.config.Server,
+		Token:        c.config.Token,
+		Insecure:     c.config.Insecure,
+		Plaintext:    c.config.Plaintext,
+		TLS:          serverTLS(c.config),
+		Proxy:        c.config.Proxy,
+		Version:      c.config.Version,
+		DrainTimeout: c.config.DrainTimeout,
+	}
+
+	if c.config.Handler != nil {
+		config.Handler = streamAdapter{handler: c.config.Handler}
+	}
+
+	if c.config.Services != nil {
+		config.Services = make([]models.ServiceDeclaration, 0, len(c.config.Services))
+		for _, service := range c.config.Services {
+			config.Services = append(config.Services, models.ServiceDeclaration{
+				Type:       service.Type,
+				Domain:     service.Domain,
+				PathPrefix: service.PathPrefix,
+				ListenPort: service.ListenPort,
+				TargetAddr: service.TargetAddr,
+
+				HostHeader:    service.HostHeader,
+				SetHeaders:    service.SetHeaders,
+				RemoveHeaders: service.RemoveHeaders,
+				RewritePrefix: service.RewritePrefix,
+			})
+		}
+	}
+
+	if onStateChange := c.config.OnStateChange; onStateChange != nil {
+		config.OnStateChange = func(status internalclient.Status) {
+			var err error
+			retrying := status.State == internalclient.StateConnecting || status.State == internalclient.StateReconnecting
+			if retrying && status.LastError != "" {
+				err = fmt.Errorf("%s", status.LastError)
+			}
+			onStateChange(State(status.State), err)
+		}
+	}
+
+	return config
+}
+
+// serverTLS collects the server TLS options of a configuration
+func serverTLS(config Config) internalclient.ServerTLSConfig {
+	return internalclient.ServerTLSConfig{
+		CAFile:   config.CAFile,
+		Pins:     config.Pins,
+		CertFile: config.CertFile,
+		KeyFile:  config.KeyFile,
+	}
+}
+
+// convertStatus translates an internal status snapshot
+func convertStatus(status internalclient.Status) Status {
+	converted := Status{
+		State:         State(status.State),
+		Reconnects:    status.Reconnects,
+		LastError:     status.LastError,
+		RTT:           time.Duration(status.RTTMillis * float64(time.Millisecond)),
+		ActiveStreams: status.ActiveStreams,
+	}
+	if status.ConnectedAt != nil {
+		converted.ConnectedAt = *status.ConnectedAt
+	}
+	if status.LastErrorAt != nil {
+		converted.LastErrorAt = *status.LastErrorAt
+	}
+	return converted
+}
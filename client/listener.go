@@ -0,0 +1,77 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Listener is a net.Listener whose connections are tunnel streams. Use it
+// as Config.Handler (or in a Mux) and serve it with http.Serve, a gRPC
+// server or anything else that accepts from a net.Listener; streams reach
+// the server in-process, with no local TCP hop.
+type Listener struct {
+	streams   chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener creates a listener with no streams yet
+func NewListener() *Listener {
+	return &Listener{
+		streams: make(chan *Stream),
+		done:    make(chan struct{}),
+	}
+}
+
+// ServeStream implements StreamHandler. It hands the stream to Accept and
+// waits until whoever accepted it closes it.
+func (l *Listener) ServeStream(stream *Stream) error {
+	select {
+	case l.streams <- stream:
+	case <-l.done:
+		return stream.Reject("listener closed")
+	}
+
+	<-stream.closed
+	return nil
+}
+
+// Accept waits for the next stream
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops Accept. Streams already accepted are unaffected; new ones
+// are rejected.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns a placeholder address, as streams have no local address of
+// their own
+func (l *Listener) Addr() net.Addr {
+	return listenerAddr{}
+}
+
+// listenerAddr is the address reported by a Listener
+type listenerAddr struct{}
+
+func (listenerAddr) Network() string { return "picotunnel" }
+func (listenerAddr) String() string  { return "picotunnel" }
+
+// HTTPHandler returns a handler that serves HTTP streams with h, as if it
+// were behind a local HTTP server. Requests see the original client's
+// address in RemoteAddr.
+func HTTPHandler(h http.Handler) StreamHandler {
+	listener := NewListener()
+	server := &http.Server{Handler: h}
+	go server.Serve(listener)
+	return listener
+}
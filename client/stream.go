@@ -0,0 +1,230 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	internalclient "github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+// Stream is a connection the server opened through the tunnel, carrying
+// one HTTP request's connection, one TCP connection or one UDP peer's
+// datagrams. The server learns the stream was accepted on the first Read
+// or Write, or when the handler returns without error; call Reject first
+// to refuse it.
+type Stream struct {
+	net.Conn
+
+	Type       string // "http", "tcp" or "udp"
+	Target     string // the service's target address
+	ServiceID  string // the service the stream belongs to
+	Host       string // HTTP Host or TLS SNI the request arrived with
+	ClientAddr string // address of the original client, as host:port
+	RequestID  string // correlates the stream with the server's logs
+
+	header    tunnel.StreamHeader
+	respond   sync.Once
+	respErr   error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newStream wraps a stream accepted from the tunnel
+func newStream(conn net.Conn, header tunnel.StreamHeader) *Stream {
+	return &Stream{
+		Conn:       conn,
+		Type:       header.Type,
+		Target:     header.Target,
+		ServiceID:  header.ServiceID,
+		Host:       header.Host,
+		ClientAddr: header.RemoteAddr,
+		RequestID:  header.RequestID,
+		header:     header,
+		closed:     make(chan struct{}),
+	}
+}
+
+// Read accepts the stream if needed and reads from it
+func (s *Stream) Read(p []byte) (int, error) {
+	if err := s.accept(); err != nil {
+		return 0, err
+	}
+	return s.Conn.Read(p)
+}
+
+// Write accepts the stream if needed and writes to it
+func (s *Stream) Write(p []byte) (int, error) {
+	if err := s.accept(); err != nil {
+		return 0, err
+	}
+	return s.Conn.Write(p)
+}
+
+// Close closes the stream
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.Conn.Close()
+}
+
+// CloseWrite shuts down the sending side of the stream, so the original
+// client sees EOF while its replies keep flowing
+func (s *Stream) CloseWrite() error {
+	if err := s.accept(); err != nil {
+		return err
+	}
+	if cw, ok := s.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return net.ErrClosed
+}
+
+// RemoteAddr returns the original client's address when the server sent
+// one, so in-process servers see who connected
+func (s *Stream) RemoteAddr() net.Addr {
+	if addrPort, err := netip.ParseAddrPort(s.ClientAddr); err == nil {
+		return net.TCPAddrFromAddrPort(addrPort)
+	}
+	return s.Conn.RemoteAddr()
+}
+
+// ReadDatagram reads one datagram from a UDP stream into buf
+func (s *Stream) ReadDatagram(buf []byte) (int, error) {
+	if err := s.accept(); err != nil {
+		return 0, err
+	}
+	return tunnel.ReadDatagram(s.Conn, buf)
+}
+
+// WriteDatagram sends one datagram on a UDP stream
+func (s *Stream) WriteDatagram(p []byte) error {
+	if err := s.accept(); err != nil {
+		return err
+	}
+	return tunnel.WriteDatagram(s.Conn, p)
+}
+
+// Reject refuses the stream; the server answers the original client with
+// an error (a 502 for HTTP). It fails once the stream has been accepted.
+func (s *Stream) Reject(reason string) error {
+	rejected := false
+	s.respond.Do(func() {
+		rejected = true
+		s.respErr = s.header.Respond(s.Conn, tunnel.StreamDenied, reason)
+	})
+	if !rejected {
+		return fmt.Errorf("stream was already answered")
+	}
+	return s.respErr
+}
+
+// accept tells the server the stream is being served, once
+func (s *Stream) accept() error {
+	s.respond.Do(func() {
+		s.respErr = s.header.Respond(s.Conn, tunnel.StreamOK, "")
+	})
+	return s.respErr
+}
+
+// fail reports a handler error to the server if the stream was not yet
+// answered
+func (s *Stream) fail(err error) {
+	s.respond.Do(func() {
+		s.respErr = s.header.Respond(s.Conn, tunnel.StreamFailed, err.Error())
+	})
+}
+
+// StreamHandler serves streams opened through the tunnel. ServeStream owns
+// the stream until it returns, after which the stream is closed; an error
+// returned before the stream was accepted is reported to the server.
+type StreamHandler interface {
+	ServeStream(stream *Stream) error
+}
+
+// HandlerFunc adapts a function to a StreamHandler
+type HandlerFunc func(stream *Stream) error
+
+// ServeStream calls f(stream)
+func (f HandlerFunc) ServeStream(stream *Stream) error {
+	return f(stream)
+}
+
+// streamAdapter serves the internal client's streams with a StreamHandler
+type streamAdapter struct {
+	handler StreamHandler
+}
+
+// HandleStream implements tunnel.StreamHandler
+func (a streamAdapter) HandleStream(conn net.Conn, header tunnel.StreamHeader) error {
+	stream := newStream(conn, header)
+	defer stream.Close()
+
+	if err := a.handler.ServeStream(stream); err != nil {
+		stream.fail(err)
+		return err
+	}
+	return stream.accept()
+}
+
+// Forward returns a handler that dials each stream's target address and
+// relays the stream to it, as the picotunnel-client command does. Targets
+// may be host:port, tls://host:port or unix:///path.
+func Forward() StreamHandler {
+	return forwarder{internalclient.NewForwarder(internalclient.ForwarderConfig{})}
+}
+
+// forwarder hands streams to the internal forwarder, which answers the
+// server itself once it knows whether the target could be dialed
+type forwarder struct {
+	inner *internalclient.Forwarder
+}
+
+// ServeStream implements StreamHandler
+func (f forwarder) ServeStream(stream *Stream) error {
+	ok := false
+	stream.respond.Do(func() { ok = true })
+	if !ok {
+		return fmt.Errorf("stream was already answered")
+	}
+	return f.inner.HandleStream(stream.Conn, stream.header)
+}
+
+// Mux routes streams to handlers by their target address, so one tunnel
+// can serve several services in-process
+type Mux struct {
+	handlers map[string]StreamHandler
+	mu       sync.RWMutex
+
+	// NotFound serves streams whose target has no handler (nil rejects
+	// them)
+	NotFound StreamHandler
+}
+
+// NewMux creates an empty Mux
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[string]StreamHandler)}
+}
+
+// Handle registers the handler for streams to target
+func (m *Mux) Handle(target string, handler StreamHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[target] = handler
+}
+
+// ServeStream implements StreamHandler
+func (m *Mux) ServeStream(stream *Stream) error {
+	m.mu.RLock()
+	handler, exists := m.handlers[stream.Target]
+	m.mu.RUnlock()
+
+	if exists {
+		return handler.ServeStream(stream)
+	}
+	if m.NotFound != nil {
+		return m.NotFound.ServeStream(stream)
+	}
+	return stream.Reject(fmt.Sprintf("no handler for target %s", stream.Target))
+}
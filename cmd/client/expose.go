@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/client"
+)
+
+// runExpose creates an ephemeral tunnel exposing a local port, serves it
+// until shutdown and then deletes it. If the client dies without deleting
+// it, the server does so once the client has been gone for its grace
+// period.
+func runExpose(args []string) {
+	if len(args) != 2 {
+		log.Fatal("Usage: picotunnel-client [flags] http|tcp|udp PORT|HOST:PORT|static://NAME|pool://NAME")
+	}
+
+	serviceType := args[0]
+	if serviceType != "http" && serviceType != "tcp" && serviceType != "udp" {
+		log.Fatalf("Unknown command %q (expected http, tcp or udp)", serviceType)
+	}
+
+	// A bare port means a local service
+	target := args[1]
+	if port, err := strconv.Atoi(target); err == nil {
+		if port < 1 || port > 65535 {
+			log.Fatalf("Invalid port %d", port)
+		}
+		target = net.JoinHostPort("localhost", target)
+	}
+
+	if *serverAddr == "" {
+		log.Fatal("Server address is required (use --server or PICOTUNNEL_SERVER)")
+	}
+	if *apiURL == "" {
+		log.Fatal("API URL is required for ephemeral tunnels (use --api or PICOTUNNEL_API)")
+	}
+	if *apiToken == "" {
+		log.Fatal("API token is required for ephemeral tunnels (use --api-token or PICOTUNNEL_API_TOKEN)")
+	}
+
+	inspector, inspectServer := startInspector(*inspectAddr)
+	config := clientConfig("", inspector)
+	api, err := client.NewAPIClient(*apiURL, *apiToken, config.TLS, *insecure, *proxyURL)
+	if err != nil {
+		log.Fatalf("Invalid API options: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	exposure, err := api.Expose(ctx, serviceType, target)
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to create tunnel: %v", err)
+	}
+
+	unexpose := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := api.Unexpose(ctx, exposure.TunnelID); err != nil {
+			log.Printf("Failed to delete tunnel %s: %v (the server removes it after %ds)", exposure.TunnelID, err, exposure.GraceSeconds)
+			return
+		}
+		log.Printf("Deleted tunnel %s", exposure.TunnelID)
+	}
+
+	config.Token = exposure.Token
+	c := client.NewClient(config)
+
+	statusServer := startStatusServer(*statusAddr, func() []client.Status {
+		return []client.Status{c.Status()}
+	})
+
+	// Handle shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	if err := c.Start(); err != nil {
+		unexpose()
+		log.Fatalf("Failed to start client: %v", err)
+	}
+
+	fmt.Printf("Forwarding %s -> %s\n", exposure.URL, target)
+	log.Printf("Press Ctrl+C to stop and delete the tunnel.")
+
+	<-sigChan
+	log.Printf("Shutdown signal received")
+
+	if err := c.Stop(); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+	}
+	stopStatusServer(statusServer)
+	stopStatusServer(inspectServer)
+	unexpose()
+
+	log.Printf("Client stopped")
+}
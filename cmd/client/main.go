@@ -1,31 +1,151 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunnel"
 )
 
 var (
-	serverAddr = flag.String("server", getEnvOrDefault("PICOTUNNEL_SERVER", ""), "Server address (host:port)")
+	serverAddr = flag.String("server", getEnvOrDefault("PICOTUNNEL_SERVER", ""), "Server address (host:port, or wss://, ws://, tls:// URL)")
 	token      = flag.String("token", getEnvOrDefault("PICOTUNNEL_TOKEN", ""), "Authentication token")
-	insecure   = flag.Bool("insecure", getEnvOrDefault("PICOTUNNEL_INSECURE", "false") == "true", "Skip TLS verification (for development)")
+	insecure   = flag.Bool("insecure", getEnvOrDefault("PICOTUNNEL_INSECURE", "false") == "true", "Skip server certificate verification (pins are still checked)")
+	plaintext  = flag.Bool("plaintext", getEnvOrDefault("PICOTUNNEL_PLAINTEXT", "false") == "true", "Connect without TLS (ws:// for a bare host:port, for development)")
+	proxyURL   = flag.String("proxy", getEnvOrDefault("PICOTUNNEL_PROXY", ""), "Reach the server through this http://, https:// or socks5:// proxy (default: HTTPS_PROXY)")
 	version    = flag.Bool("version", false, "Show version")
+	configPath = flag.String("config", getEnvOrDefault("PICOTUNNEL_CONFIG", ""), "YAML config file defining several tunnels (replaces --server/--token)")
+	statusAddr = flag.String("status-addr", getEnvOrDefault("PICOTUNNEL_STATUS_ADDR", ""), "Serve /status, /healthz and /readyz on this address (e.g. 127.0.0.1:9090)")
+
+	// Ephemeral tunnels ("picotunnel-client http 3000")
+	apiURL   = flag.String("api", getEnvOrDefault("PICOTUNNEL_API", ""), "Server management URL for ephemeral tunnels (e.g. https://picotunnel.example.com)")
+	apiToken = flag.String("api-token", getEnvOrDefault("PICOTUNNEL_API_TOKEN", ""), "API token for ephemeral tunnels")
+
+	// HTTP request inspector
+	inspectAddr = flag.String("inspect-addr", getEnvOrDefault("PICOTUNNEL_INSPECT_ADDR", ""), "Record HTTP requests and serve the inspector UI on this address (e.g. 127.0.0.1:4040)")
+
+	// Directories served to static://NAME targets
+	serveDirs    stringList
+	serveListing = flag.Bool("serve-listing", getEnvOrDefault("PICOTUNNEL_SERVE_LISTING", "false") == "true", "List directories without an index.html in --serve-dir directories")
+	serveAuth    = flag.String("serve-auth", getEnvOrDefault("PICOTUNNEL_SERVE_AUTH", ""), "Require this USER:PASSWORD (basic auth) for --serve-dir directories")
+
+	// Backend pools for pool://NAME targets
+	poolBackends stringList
+	poolStrategy = flag.String("pool-strategy", getEnvOrDefault("PICOTUNNEL_POOL_STRATEGY", client.StrategyRoundRobin), "How --pool backends are picked: round-robin, least-conn or failover")
+	poolCheck    = flag.String("pool-check", getEnvOrDefault("PICOTUNNEL_POOL_CHECK", client.HealthCheckTCP), "Health check for --pool backends: tcp, none, or an HTTP path such as /healthz")
+
+	drainTimeout = flag.Duration("drain-timeout", getEnvDurationOrDefault("PICOTUNNEL_DRAIN_TIMEOUT", 30*time.Second), "How long shutdown waits for in-flight streams")
+	idleTimeout  = flag.Duration("idle-timeout", getEnvDurationOrDefault("PICOTUNNEL_IDLE_TIMEOUT", 0), "Close forwarded streams idle for this long (0 disables)")
+
+	// TLS options for the server connection
+	serverCA   = flag.String("ca", getEnvOrDefault("PICOTUNNEL_CA", ""), "CA bundle to verify the server with (default: system roots)")
+	serverPins stringList
+	clientCert = flag.String("cert", getEnvOrDefault("PICOTUNNEL_CERT", ""), "Client certificate to present to the server")
+	clientKey  = flag.String("key", getEnvOrDefault("PICOTUNNEL_KEY", ""), "Key for --cert")
+
+	// Target policy
+	allowRules  stringList
+	denyRules   stringList
+	defaultDeny = flag.Bool("default-deny", getEnvOrDefault("PICOTUNNEL_DEFAULT_DENY", "false") == "true", "Deny targets that match no --allow rule")
+
+	// TLS options for tls:// targets
+	upstreamCA         = flag.String("upstream-ca", getEnvOrDefault("PICOTUNNEL_UPSTREAM_CA", ""), "CA bundle to verify tls:// targets with (default: system roots)")
+	upstreamServerName = flag.String("upstream-server-name", getEnvOrDefault("PICOTUNNEL_UPSTREAM_SERVER_NAME", ""), "SNI and verified name for tls:// targets (default: target host)")
+	upstreamCert       = flag.String("upstream-cert", getEnvOrDefault("PICOTUNNEL_UPSTREAM_CERT", ""), "Client certificate to present to tls:// targets")
+	upstreamKey        = flag.String("upstream-key", getEnvOrDefault("PICOTUNNEL_UPSTREAM_KEY", ""), "Key for --upstream-cert")
+	upstreamInsecure   = flag.Bool("upstream-insecure", getEnvOrDefault("PICOTUNNEL_UPSTREAM_INSECURE", "false") == "true", "Skip certificate verification for tls:// targets")
 )
 
+func init() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(out, "       %s [flags] http|tcp|udp PORT|HOST:PORT|static://NAME|pool://NAME\n\n", os.Args[0])
+		fmt.Fprintf(out, "The second form creates an ephemeral tunnel exposing a local port until the client exits.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Var(&serverPins, "pin", "Require the server's certificate chain to contain this sha256/BASE64 SPKI pin (repeatable)")
+	flag.Var(&allowRules, "allow", "Allow targets matching HOST[:PORT] (glob, IP or CIDR; repeatable)")
+	flag.Var(&denyRules, "deny", "Deny targets matching HOST[:PORT] (glob, IP or CIDR; repeatable)")
+	flag.Var(&poolBackends, "pool", "Add backend ADDR to the pool for services targeting pool://NAME, given as NAME=ADDR (repeatable)")
+	flag.Var(&serveDirs, "serve-dir", "Serve directory PATH to services targeting static://NAME, given as NAME=PATH (repeatable)")
+}
+
+// profileFlags maps the flags that config file profiles set for
+// themselves to the environment variables that also set them
+var profileFlags = map[string]string{
+	"insecure":     "PICOTUNNEL_INSECURE",
+	"plaintext":    "PICOTUNNEL_PLAINTEXT",
+	"ca":           "PICOTUNNEL_CA",
+	"pin":          "PICOTUNNEL_PINS",
+	"cert":         "PICOTUNNEL_CERT",
+	"key":          "PICOTUNNEL_KEY",
+	"allow":        "PICOTUNNEL_ALLOW",
+	"deny":         "PICOTUNNEL_DENY",
+	"default-deny": "PICOTUNNEL_DEFAULT_DENY",
+
+	"upstream-ca":          "PICOTUNNEL_UPSTREAM_CA",
+	"upstream-server-name": "PICOTUNNEL_UPSTREAM_SERVER_NAME",
+	"upstream-cert":        "PICOTUNNEL_UPSTREAM_CERT",
+	"upstream-key":         "PICOTUNNEL_UPSTREAM_KEY",
+	"upstream-insecure":    "PICOTUNNEL_UPSTREAM_INSECURE",
+
+	"serve-dir":     "PICOTUNNEL_SERVE_DIRS",
+	"serve-listing": "PICOTUNNEL_SERVE_LISTING",
+	"serve-auth":    "PICOTUNNEL_SERVE_AUTH",
+
+	"pool":          "PICOTUNNEL_POOLS",
+	"pool-strategy": "PICOTUNNEL_POOL_STRATEGY",
+	"pool-check":    "PICOTUNNEL_POOL_CHECK",
+}
+
+// Version is set at build time via -ldflags "-X main.Version=..."
+var Version = "1.0.0"
+
 func main() {
 	flag.Parse()
 
 	if *version {
-		fmt.Println("picotunnel-client v1.0.0")
+		fmt.Printf("picotunnel-client v%s\n", Version)
 		os.Exit(0)
 	}
 
+	if *proxyURL != "" {
+		if _, err := tunnel.ParseProxyURL(*proxyURL); err != nil {
+			log.Fatalf("Invalid proxy: %v", err)
+		}
+	}
+
+	if args := flag.Args(); len(args) > 0 {
+		if *configPath != "" || *token != "" {
+			log.Fatal("Ephemeral tunnels cannot be combined with --config or --token")
+		}
+		runExpose(args)
+		return
+	}
+
+	if *configPath != "" {
+		if *serverAddr != "" || *token != "" {
+			log.Fatal("--config cannot be combined with --server or --token")
+		}
+		if names := profileFlagsSet(); len(names) > 0 {
+			log.Fatalf("--config cannot be combined with %s; set them for each tunnel in the config file", strings.Join(names, ", "))
+		}
+		runConfigFile(*configPath)
+		return
+	}
+
 	if *serverAddr == "" {
 		log.Fatal("Server address is required (use --server or PICOTUNNEL_SERVER)")
 	}
@@ -34,14 +154,12 @@ func main() {
 		log.Fatal("Token is required (use --token or PICOTUNNEL_TOKEN)")
 	}
 
-	// Create client
-	config := client.Config{
-		ServerAddr: *serverAddr,
-		Token:      *token,
-		Insecure:   *insecure,
-	}
+	inspector, inspectServer := startInspector(*inspectAddr)
+	c := client.NewClient(clientConfig(*token, inspector))
 
-	c := client.NewClient(config)
+	statusServer := startStatusServer(*statusAddr, func() []client.Status {
+		return []client.Status{c.Status()}
+	})
 
 	// Handle shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -62,13 +180,361 @@ func main() {
 	if err := c.Stop(); err != nil {
 		log.Printf("Error during shutdown: %v", err)
 	}
+	stopStatusServer(statusServer)
+	stopStatusServer(inspectServer)
 
 	log.Printf("Client stopped")
 }
 
+// clientConfig builds the configuration for a single tunnel from the
+// command line, exiting if it is invalid
+func clientConfig(token string, inspector *client.Inspector) client.Config {
+	// Flags replace the comma-separated environment lists
+	if len(serverPins) == 0 {
+		serverPins = getEnvList("PICOTUNNEL_PINS")
+	}
+	if len(allowRules) == 0 {
+		allowRules = getEnvList("PICOTUNNEL_ALLOW")
+	}
+	if len(denyRules) == 0 {
+		denyRules = getEnvList("PICOTUNNEL_DENY")
+	}
+	if len(serveDirs) == 0 {
+		serveDirs = getEnvList("PICOTUNNEL_SERVE_DIRS")
+	}
+	if len(poolBackends) == 0 {
+		poolBackends = getEnvList("PICOTUNNEL_POOLS")
+	}
+
+	policy, err := client.NewPolicy(allowRules, denyRules, *defaultDeny)
+	if err != nil {
+		log.Fatalf("Invalid target policy: %v", err)
+	}
+	if policy.IsRestricted() {
+		log.Printf("Target policy: allow %v, deny %v, default deny %v", []string(allowRules), []string(denyRules), *defaultDeny)
+	}
+
+	serverTLS := client.ServerTLSConfig{
+		CAFile:   *serverCA,
+		Pins:     serverPins,
+		CertFile: *clientCert,
+		KeyFile:  *clientKey,
+	}
+	if err := serverTLS.Validate(); err != nil {
+		log.Fatalf("Invalid server TLS options: %v", err)
+	}
+
+	upstreamTLS := client.UpstreamTLSConfig{
+		ServerName:         *upstreamServerName,
+		CAFile:             *upstreamCA,
+		CertFile:           *upstreamCert,
+		KeyFile:            *upstreamKey,
+		InsecureSkipVerify: *upstreamInsecure,
+	}
+	if err := upstreamTLS.Validate(); err != nil {
+		log.Fatalf("Invalid upstream TLS options: %v", err)
+	}
+
+	staticDirs, err := parseServeDirs(serveDirs, *serveListing, *serveAuth)
+	if err != nil {
+		log.Fatalf("Invalid --serve-dir options: %v", err)
+	}
+
+	pools, err := parsePools(poolBackends, *poolStrategy, *poolCheck)
+	if err != nil {
+		log.Fatalf("Invalid --pool options: %v", err)
+	}
+
+	return client.Config{
+		ServerAddr: *serverAddr,
+		Token:      token,
+		Insecure:   *insecure,
+		Plaintext:  *plaintext,
+		TLS:        serverTLS,
+		Proxy:      *proxyURL,
+		Version:    Version,
+
+		DrainTimeout: *drainTimeout,
+		IdleTimeout:  *idleTimeout,
+		Policy:       policy,
+		UpstreamTLS:  map[string]client.UpstreamTLSConfig{"*": upstreamTLS},
+		StaticDirs:   staticDirs,
+		Pools:        pools,
+		Inspector:    inspector,
+	}
+}
+
+// parseServeDirs turns NAME=PATH values into directories sharing the
+// listing and auth settings
+func parseServeDirs(values []string, listing bool, auth string) (map[string]client.StaticDir, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var username, password string
+	if auth != "" {
+		var found bool
+		username, password, found = strings.Cut(auth, ":")
+		if !found {
+			return nil, fmt.Errorf("--serve-auth must be USER:PASSWORD")
+		}
+	}
+
+	dirs := make(map[string]client.StaticDir, len(values))
+	for _, value := range values {
+		name, path, found := strings.Cut(value, "=")
+		if !found {
+			return nil, fmt.Errorf("%q is not NAME=PATH", value)
+		}
+		if err := client.ValidateStaticName(name); err != nil {
+			return nil, err
+		}
+		if _, exists := dirs[name]; exists {
+			return nil, fmt.Errorf("%q is served more than once", name)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", path)
+		}
+
+		dir := client.StaticDir{Path: path, Listing: listing, Username: username, Password: password}
+		if err := dir.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		dirs[name] = dir
+		log.Printf("Serving %s as static://%s", path, name)
+	}
+	return dirs, nil
+}
+
+// parsePools groups NAME=ADDR values into pools sharing the strategy and
+// health check. The check is tcp, none or the path for an HTTP check.
+func parsePools(values []string, strategy, check string) (map[string]client.PoolConfig, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	healthCheck := client.HealthCheckConfig{Type: check}
+	if strings.HasPrefix(check, "/") {
+		healthCheck = client.HealthCheckConfig{Type: client.HealthCheckHTTP, Path: check}
+	}
+
+	pools := make(map[string]client.PoolConfig)
+	var names []string
+	for _, value := range values {
+		name, addr, found := strings.Cut(value, "=")
+		if !found {
+			return nil, fmt.Errorf("%q is not NAME=ADDR", value)
+		}
+		if err := client.ValidatePoolName(name); err != nil {
+			return nil, err
+		}
+		pool, exists := pools[name]
+		if !exists {
+			names = append(names, name)
+			pool = client.PoolConfig{Strategy: strategy, HealthCheck: healthCheck}
+		}
+		pool.Backends = append(pool.Backends, addr)
+		pools[name] = pool
+	}
+
+	for _, name := range names {
+		if err := pools[name].Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("Balancing pool://%s across %s", name, strings.Join(pools[name].Backends, ", "))
+	}
+	return pools, nil
+}
+
+// runConfigFile runs every tunnel in a config file until shutdown,
+// reloading the file on SIGHUP
+func runConfigFile(path string) {
+	config, err := client.LoadConfigFile(path)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	inspector, inspectServer := startInspector(*inspectAddr)
+	manager := client.NewManager(client.ManagerConfig{
+		Version:      Version,
+		DrainTimeout: *drainTimeout,
+		IdleTimeout:  *idleTimeout,
+		Proxy:        *proxyURL,
+		Inspector:    inspector,
+	})
+	if err := manager.Apply(config); err != nil {
+		log.Fatalf("Failed to start tunnels: %v", err)
+	}
+
+	statusServer := startStatusServer(*statusAddr, manager.Status)
+
+	log.Printf("Started %d tunnels from %s. Press Ctrl+C to stop, send SIGHUP to reload.", len(config.Tunnels), path)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		// A broken file keeps the running tunnels as they are
+		log.Printf("Reloading %s", path)
+		config, err := client.LoadConfigFile(path)
+		if err != nil {
+			log.Printf("Reload failed: %v", err)
+			continue
+		}
+		if err := manager.Apply(config); err != nil {
+			log.Printf("Reload failed: %v", err)
+			continue
+		}
+		log.Printf("Reload complete")
+	}
+	log.Printf("Shutdown signal received")
+
+	manager.Stop()
+	stopStatusServer(statusServer)
+	stopStatusServer(inspectServer)
+	log.Printf("Client stopped")
+}
+
+// profileFlagsSet returns the profile flags given on the command line or
+// through the environment, which a config file would otherwise silently
+// override
+func profileFlagsSet() []string {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var names []string
+	for name, env := range profileFlags {
+		if value := os.Getenv(env); set[name] || (value != "" && value != "false") {
+			names = append(names, "--"+name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startStatusServer serves the status endpoint on addr, or does nothing if
+// addr is empty. The endpoint is meant for the local machine or a
+// container's probes; it reveals targets and errors, so keep it off public
+// interfaces.
+func startStatusServer(addr string, statuses func() []client.Status) *http.Server {
+	if addr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen for status requests on %s: %v", addr, err)
+	}
+	warnIfPublic("status", addr)
+
+	server := &http.Server{
+		Handler:           client.NewStatusHandler(Version, statuses),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Status server error: %v", err)
+		}
+	}()
+
+	log.Printf("Status endpoint listening on %s", listener.Addr())
+	return server
+}
+
+// startInspector records HTTP requests and serves the inspector UI on
+// addr, or does nothing if addr is empty. Recorded requests include their
+// headers and bodies, so keep it off public interfaces.
+func startInspector(addr string) (*client.Inspector, *http.Server) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen for inspector requests on %s: %v", addr, err)
+	}
+	warnIfPublic("inspector", addr)
+
+	inspector := client.NewInspector(client.DefaultInspectorCapacity, client.DefaultInspectorMaxBody)
+	server := &http.Server{
+		Handler:           inspector.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Inspector server error: %v", err)
+		}
+	}()
+
+	log.Printf("Inspecting HTTP requests at http://%s", listener.Addr())
+	return inspector, server
+}
+
+// warnIfPublic logs a warning when a local endpoint listens on an address
+// other machines can reach
+func warnIfPublic(name, addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Printf("Warning: %s endpoint on %s is reachable from other machines", name, addr)
+		}
+	}
+}
+
+// stopStatusServer shuts down a server started by startStatusServer or
+// startInspector
+func stopStatusServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Ignoring invalid duration %s=%q", key, value)
+	}
+	return defaultValue
+}
+
+// getEnvList splits a comma-separated environment variable
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -7,17 +7,19 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/jclement/picotunnel/internal/server"
 )
 
 var (
-	listenAddr  = flag.String("listen", getEnvOrDefault("PICOTUNNEL_LISTEN_ADDR", ":8080"), "Management UI listen address")
-	tunnelAddr  = flag.String("tunnel", getEnvOrDefault("PICOTUNNEL_TUNNEL_ADDR", ":8443"), "Tunnel connection listen address")
-	httpAddr    = flag.String("http", getEnvOrDefault("PICOTUNNEL_HTTP_ADDR", ":80"), "HTTP proxy listen address")
-	httpsAddr   = flag.String("https", getEnvOrDefault("PICOTUNNEL_HTTPS_ADDR", ":443"), "HTTPS proxy listen address")
-	dataDir     = flag.String("data", getEnvOrDefault("PICOTUNNEL_DATA_DIR", "/data"), "Data directory for database and certificates")
-	domain      = flag.String("domain", getEnvOrDefault("PICOTUNNEL_DOMAIN", ""), "Server domain for management UI")
+	listenAddr    = flag.String("listen", getEnvOrDefault("PICOTUNNEL_LISTEN_ADDR", ":8080"), "Management UI listen address")
+	tunnelAddr    = flag.String("tunnel", getEnvOrDefault("PICOTUNNEL_TUNNEL_ADDR", ":8443"), "Tunnel connection listen address")
+	tunnelTLSAddr = flag.String("tunnel-tls", getEnvOrDefault("PICOTUNNEL_TUNNEL_TLS_ADDR", ""), "Raw TLS tunnel transport listen address (disabled if empty)")
+	httpAddr      = flag.String("http", getEnvOrDefault("PICOTUNNEL_HTTP_ADDR", ":80"), "HTTP proxy listen address")
+	httpsAddr     = flag.String("https", getEnvOrDefault("PICOTUNNEL_HTTPS_ADDR", ":443"), "HTTPS proxy listen address")
+	dataDir       = flag.String("data", getEnvOrDefault("PICOTUNNEL_DATA_DIR", "/data"), "Data directory for database and certificates")
+	domain        = flag.String("domain", getEnvOrDefault("PICOTUNNEL_DOMAIN", ""), "Server domain for management UI")
 	
 	// OIDC configuration
 	oidcIssuer       = flag.String("oidc-issuer", getEnvOrDefault("PICOTUNNEL_OIDC_ISSUER", ""), "OIDC issuer URL")
@@ -28,15 +30,31 @@ var (
 	// ACME/Let's Encrypt configuration
 	acmeEnabled = flag.Bool("acme", getEnvOrDefault("PICOTUNNEL_ACME_ENABLED", "false") == "true", "Enable ACME/Let's Encrypt")
 	acmeEmail   = flag.String("acme-email", getEnvOrDefault("PICOTUNNEL_ACME_EMAIL", ""), "ACME/Let's Encrypt email")
+	tlsCert     = flag.String("tls-cert", getEnvOrDefault("PICOTUNNEL_TLS_CERT", ""), "TLS certificate file (when not using ACME)")
+	tlsKey      = flag.String("tls-key", getEnvOrDefault("PICOTUNNEL_TLS_KEY", ""), "TLS private key file (when not using ACME)")
 	
+	drainTimeout = flag.Duration("drain-timeout", getEnvDurationOrDefault("PICOTUNNEL_DRAIN_TIMEOUT", 30*time.Second), "How long shutdown waits for in-flight streams")
+	idleTimeout  = flag.Duration("idle-timeout", getEnvDurationOrDefault("PICOTUNNEL_IDLE_TIMEOUT", 0), "Close TCP service connections idle for this long (0 disables)")
+
+	// Ephemeral tunnels created by "picotunnel-client http|tcp|udp PORT"
+	apiToken        = flag.String("api-token", getEnvOrDefault("PICOTUNNEL_API_TOKEN", ""), "API token clients use to create ephemeral tunnels (disabled if empty)")
+	exposeDomain    = flag.String("expose-domain", getEnvOrDefault("PICOTUNNEL_EXPOSE_DOMAIN", ""), "Base domain for ephemeral HTTP tunnels (e.g. dev.example.com with wildcard DNS)")
+	exposePortRange = flag.String("expose-ports", getEnvOrDefault("PICOTUNNEL_EXPOSE_PORTS", ""), "Port range for ephemeral TCP/UDP tunnels (e.g. 30000-30099)")
+	exposeGrace     = flag.Duration("expose-grace", getEnvDurationOrDefault("PICOTUNNEL_EXPOSE_GRACE", 5*time.Minute), "Delete ephemeral tunnels whose client has been gone this long (0 keeps them)")
+
+	allowQueryToken = flag.Bool("allow-query-token", getEnvOrDefault("PICOTUNNEL_ALLOW_QUERY_TOKEN", "false") == "true", "Accept tunnel tokens in the WebSocket URL from older clients (deprecated)")
+
 	version = flag.Bool("version", false, "Show version")
 )
 
+// Version is set at build time via -ldflags "-X main.Version=..."
+var Version = "1.0.0"
+
 func main() {
 	flag.Parse()
 
 	if *version {
-		fmt.Println("picotunnel-server v1.0.0")
+		fmt.Printf("picotunnel-server v%s\n", Version)
 		os.Exit(0)
 	}
 
@@ -49,6 +67,14 @@ func main() {
 		log.Fatal("ACME email is required when ACME is enabled")
 	}
 
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("Both TLS certificate and key are required")
+	}
+
+	if *tunnelTLSAddr != "" && !*acmeEnabled && *tlsCert == "" {
+		log.Fatal("TLS tunnel listener requires ACME or --tls-cert/--tls-key")
+	}
+
 	if (*oidcIssuer != "" || *oidcClientID != "") && (*oidcIssuer == "" || *oidcClientID == "") {
 		log.Fatal("Both OIDC issuer and client ID are required for authentication")
 	}
@@ -56,17 +82,22 @@ func main() {
 	log.Printf("Starting PicoTunnel server with config:")
 	log.Printf("  Listen: %s", *listenAddr)
 	log.Printf("  Tunnel: %s", *tunnelAddr)
+	if *tunnelTLSAddr != "" {
+		log.Printf("  Tunnel (TLS): %s", *tunnelTLSAddr)
+	}
 	log.Printf("  HTTP: %s", *httpAddr)
 	log.Printf("  HTTPS: %s", *httpsAddr)
 	log.Printf("  Data: %s", *dataDir)
 	log.Printf("  Domain: %s", *domain)
 	log.Printf("  OIDC: %s", enabledStr(*oidcIssuer != ""))
 	log.Printf("  ACME: %s", enabledStr(*acmeEnabled))
+	log.Printf("  Ephemeral tunnels: %s", enabledStr(*apiToken != ""))
 
 	// Create server configuration
 	config := server.Config{
 		ListenAddr:       *listenAddr,
 		TunnelAddr:       *tunnelAddr,
+		TunnelTLSAddr:    *tunnelTLSAddr,
 		HTTPAddr:         *httpAddr,
 		HTTPSAddr:        *httpsAddr,
 		DataDir:          *dataDir,
@@ -77,6 +108,16 @@ func main() {
 		OIDCRedirectURL:  *oidcRedirectURL,
 		ACMEEnabled:      *acmeEnabled,
 		ACMEEmail:        *acmeEmail,
+		TLSCertFile:      *tlsCert,
+		TLSKeyFile:       *tlsKey,
+		Version:          Version,
+		DrainTimeout:     *drainTimeout,
+		IdleTimeout:      *idleTimeout,
+		AllowQueryToken:  *allowQueryToken,
+		APIToken:         *apiToken,
+		ExposeDomain:     *exposeDomain,
+		ExposePortRange:  *exposePortRange,
+		ExposeGrace:      *exposeGrace,
 	}
 
 	// Create server
@@ -115,6 +156,16 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Ignoring invalid duration %s=%q", key, value)
+	}
+	return defaultValue
+}
+
 func enabledStr(enabled bool) string {
 	if enabled {
 		return "enabled"
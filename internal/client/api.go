@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jclement/picotunnel/internal/models"
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+// APIClient calls a server's management API with an API token, to create
+// and delete ephemeral tunnels
+type APIClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewAPIClient creates a client for the API at baseURL (such as
+// https://picotunnel.example.com). It verifies the server and goes through
+// proxies the same way tunnel connections do.
+func NewAPIClient(baseURL, token string, tlsOpts ServerTLSConfig, insecure bool, proxy string) (*APIClient, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid API URL %q: expected http:// or https://", baseURL)
+	}
+
+	tlsConfig, err := tlsOpts.tlsConfig("", insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyFunc := tunnel.ProxyFromEnvironment
+	if proxy != "" {
+		proxyURL, err := tunnel.ParseProxyURL(proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxyFunc = tunnel.ProxyURL(proxyURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = func(r *http.Request) (*url.URL, error) {
+		return proxyFunc(r.URL)
+	}
+
+	return &APIClient{
+		baseURL: parsed.String(),
+		token:   token,
+		http:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// Expose creates an ephemeral tunnel with one service forwarding to
+// targetAddr
+func (a *APIClient) Expose(ctx context.Context, serviceType, targetAddr string) (*models.Exposure, error) {
+	body, err := json.Marshal(models.ExposeRequest{Type: serviceType, TargetAddr: targetAddr})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.do(ctx, http.MethodPost, "/api/expose", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var exposure models.Exposure
+	if err := json.NewDecoder(resp.Body).Decode(&exposure); err != nil {
+		return nil, fmt.Errorf("invalid response from server: %w", err)
+	}
+	return &exposure, nil
+}
+
+// Unexpose deletes an ephemeral tunnel
+func (a *APIClient) Unexpose(ctx context.Context, tunnelID string) error {
+	resp, err := a.do(ctx, http.MethodDelete, "/api/expose/"+url.PathEscape(tunnelID), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends an authenticated request, turning error responses into errors
+func (a *APIClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Message != "" {
+			return nil, fmt.Errorf("server returned %s: %s", resp.Status, apiErr.Message)
+		}
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return resp, nil
+}
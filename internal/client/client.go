@@ -3,57 +3,173 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/jclement/picotunnel/internal/models"
 	"github.com/jclement/picotunnel/internal/tunnel"
 )
 
 // Client represents a tunnel client
 type Client struct {
+	name       string
 	serverAddr string
 	token      string
 	insecure   bool
+	plaintext  bool
+	tls        ServerTLSConfig
+	proxy      string
+	version    string
 	conn       *tunnel.Connection
 	streamMgr  *tunnel.StreamManager
 	forwarder  *Forwarder
+	static     *StaticServer
+	handler    tunnel.StreamHandler
 	mu         sync.RWMutex
 	ctx        context.Context
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
+
+	drainTimeout time.Duration
+	stopping     bool
+	reconnect    chan struct{}
+	services     []models.ServiceDeclaration
+
+	// State change notifications, serialized by notifyMu
+	onStateChange func(Status)
+	lastState     string
+	notifyMu      sync.Mutex
+
+	// Status reporting, guarded by mu
+	startedAt   time.Time
+	connected   bool // a connection has succeeded at least once
+	reconnects  int64
+	lastError   string
+	lastErrorAt time.Time
 }
 
 // Config holds client configuration
 type Config struct {
+	Name       string // profile name prefixed to log lines (optional)
 	ServerAddr string
 	Token      string
-	Insecure   bool
+	Insecure   bool   // skip verifying the server's certificate (pins are still checked)
+	Plaintext  bool   // connect without TLS when ServerAddr has no scheme
+	Version    string // client build version reported in the handshake
+
+	// TLS holds the CA, pins and client certificate for TLS connections to
+	// the server
+	TLS ServerTLSConfig
+
+	// Proxy is an http://, https:// or socks5:// proxy URL to reach the
+	// server through. Empty uses HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	Proxy string
+
+	// DrainTimeout bounds how long in-flight streams may run after the
+	// client or server starts shutting down a connection
+	DrainTimeout time.Duration
+
+	// IdleTimeout closes forwarded streams with no traffic in either
+	// direction for this long (0 disables)
+	IdleTimeout time.Duration
+
+	// Policy restricts which targets the server may ask the client to
+	// dial (nil allows all)
+	Policy *Policy
+
+	// UpstreamTLS holds the options for tls:// targets, keyed by host:port
+	// ("*" for the default)
+	UpstreamTLS map[string]UpstreamTLSConfig
+
+	// Inspector records the HTTP requests forwarded to targets (nil
+	// disables inspection)
+	Inspector *Inspector
+
+	// StaticDirs are local directories served to services whose target is
+	// static://NAME, keyed by NAME (nil serves none)
+	StaticDirs map[string]StaticDir
+
+	// Pools are sets of local backends that services targeting pool://NAME
+	// are balanced across, keyed by NAME. Their health is checked by the
+	// client and reported to the server.
+	Pools map[string]PoolConfig
+
+	// Services are declared to the server on every connect, which creates
+	// them within the tunnel's limits and removes ones no longer declared.
+	// Nil leaves the tunnel's services to the server; an empty list removes
+	// every service the client declared before.
+	Services []models.ServiceDeclaration
+
+	// Handler serves every stream instead of the forwarder, for embedding
+	// clients that handle streams in-process (nil forwards to targets)
+	Handler tunnel.StreamHandler
+
+	// OnStateChange is called with a fresh status whenever the connection
+	// state changes. Calls are serialized and should return quickly.
+	OnStateChange func(Status)
 }
 
 // NewClient creates a new tunnel client
 func NewClient(config Config) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Client{
+
+	var static *StaticServer
+	if len(config.StaticDirs) > 0 {
+		static = NewStaticServer(config.StaticDirs)
+	}
+
+	c := &Client{
+		name:       config.Name,
 		serverAddr: config.ServerAddr,
 		token:      config.Token,
 		insecure:   config.Insecure,
+		plaintext:  config.Plaintext,
+		tls:        config.TLS,
+		proxy:      config.Proxy,
+		version:    config.Version,
 		ctx:        ctx,
 		cancel:     cancel,
-		forwarder:  NewForwarder(),
+		forwarder: NewForwarder(ForwarderConfig{
+			IdleTimeout: config.IdleTimeout,
+			Policy:      config.Policy,
+			UpstreamTLS: config.UpstreamTLS,
+			Inspector:   config.Inspector,
+			Pools:       config.Pools,
+		}),
+
+		static:        static,
+		handler:       config.Handler,
+		onStateChange: config.OnStateChange,
+
+		drainTimeout: config.DrainTimeout,
+		reconnect:    make(chan struct{}, 1),
+		services:     config.Services,
+		startedAt:    time.Now(),
 	}
+
+	for _, p := range c.forwarder.pools {
+		p.onChange = c.reportHealth
+	}
+	return c
 }
 
 // Start starts the client
 func (c *Client) Start() error {
-	log.Printf("Starting tunnel client, connecting to %s", c.serverAddr)
+	c.logf("Starting tunnel client, connecting to %s", c.serverAddr)
+	c.notifyState()
+	c.startHealthChecks()
 
 	// Start with initial connection
 	if err := c.connect(); err != nil {
+		c.setError(err)
 		return fmt.Errorf("initial connection failed: %w", err)
 	}
 
@@ -64,12 +180,41 @@ func (c *Client) Start() error {
 	return nil
 }
 
-// Stop stops the client
+// StartBackground starts the client without waiting for the first
+// connection to succeed; failures are retried by the reconnect loop
+func (c *Client) StartBackground() {
+	c.logf("Starting tunnel client, connecting to %s", c.serverAddr)
+	c.notifyState()
+	c.startHealthChecks()
+
+	c.wg.Add(1)
+	go func() {
+		if err := c.connect(); err != nil {
+			c.logf("Initial connection failed: %v", err)
+			c.setError(err)
+		}
+		c.reconnectLoop()
+	}()
+}
+
+// Stop stops the client. The server is asked to stop routing new streams
+// to this client, and streams already in flight are given up to the drain
+// timeout to finish.
 func (c *Client) Stop() error {
-	log.Printf("Stopping tunnel client")
-	
+	c.logf("Stopping tunnel client")
+
+	c.mu.Lock()
+	c.stopping = true
+	conn := c.conn
+	c.mu.Unlock()
+	c.notifyState()
+
+	if conn != nil && !conn.IsClosed() {
+		c.drain(conn)
+	}
+
 	c.cancel()
-	
+
 	c.mu.Lock()
 	if c.streamMgr != nil {
 		c.streamMgr.Stop()
@@ -85,49 +230,91 @@ func (c *Client) Stop() error {
 
 // connect establishes a connection to the server
 func (c *Client) connect() error {
-	serverURL := fmt.Sprintf("wss://%s/tunnel?token=%s", c.serverAddr, c.token)
-	if c.insecure {
-		serverURL = fmt.Sprintf("ws://%s/tunnel?token=%s", c.serverAddr, c.token)
+	target, err := parseServerURL(c.serverAddr, c.plaintext)
+	if err != nil {
+		return err
 	}
 
-	_, err := url.Parse(serverURL)
+	transport, err := tunnel.TransportForScheme(target.Scheme)
 	if err != nil {
-		return fmt.Errorf("invalid server URL: %w", err)
+		return err
 	}
 
-	dialer := websocket.DefaultDialer
-	dialer.HandshakeTimeout = tunnel.HandshakeTimeout
-	
-	if c.insecure {
-		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	opts := tunnel.DialOptions{
+		Token:     c.token,
+		UserAgent: "picotunnel-client/" + c.version,
+		Proxy:     tunnel.ProxyFromEnvironment,
+	}
+	if c.proxy != "" {
+		proxyURL, err := tunnel.ParseProxyURL(c.proxy)
+		if err != nil {
+			return err
+		}
+		opts.Proxy = tunnel.ProxyURL(proxyURL)
+	}
+	if target.Scheme == "wss" || target.Scheme == "tls" {
+		opts.TLSConfig, err = c.tls.tlsConfig(target.Hostname(), c.insecure)
+		if err != nil {
+			return err
+		}
 	}
 
-	header := http.Header{}
-	header.Set("User-Agent", "picotunnel-client/1.0")
-
-	log.Printf("Connecting to %s", serverURL)
-	ws, _, err := dialer.Dial(serverURL, header)
+	c.logf("Connecting to %s", target)
+	ctx, cancel := context.WithTimeout(c.ctx, tunnel.HandshakeTimeout)
+	nc, err := transport.Dial(ctx, target, opts)
+	cancel()
 	if err != nil {
-		return fmt.Errorf("WebSocket dial failed: %w", err)
+		var recordErr tls.RecordHeaderError
+		if errors.As(err, &recordErr) {
+			return fmt.Errorf("%w (the server does not speak TLS; use --plaintext or a ws:// URL)", err)
+		}
+		return err
 	}
 
-	log.Printf("WebSocket connected, establishing tunnel")
+	c.logf("Transport connected, establishing tunnel")
 
 	// Create tunnel connection
-	conn, err := tunnel.NewConnection(ws, c.token, false)
+	conn, err := tunnel.NewConnection(nc, c.token, false)
 	if err != nil {
-		ws.Close()
+		nc.Close()
 		return fmt.Errorf("failed to create tunnel connection: %w", err)
 	}
 
 	// Create stream manager
+	var handler tunnel.StreamHandler = c.forwarder
+	if c.handler != nil {
+		handler = c.handler
+	}
 	streamMgr := tunnel.NewStreamManager(conn)
-	streamMgr.RegisterHandler("http", c.forwarder)
-	streamMgr.RegisterHandler("tcp", c.forwarder)
+	streamMgr.RegisterHandler("http", handler)
+	streamMgr.RegisterHandler("tcp", handler)
+	streamMgr.RegisterHandler("udp", handler)
+	if c.static != nil {
+		streamMgr.RegisterHandler("static", c.static)
+	}
+
+	// Introduce ourselves before any streams flow
+	welcome, err := conn.ClientHandshake(c.hello(streamMgr.HandlerTypes()))
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("tunnel handshake failed: %w", err)
+	}
+	c.logf("Handshake complete (server %s, protocol v%d)", welcome.ServerVersion, welcome.ProtocolVersion)
+	c.logServiceResults(welcome)
 
 	c.mu.Lock()
+	if c.stopping {
+		c.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("client is stopping")
+	}
+	oldConn, oldStreamMgr := c.conn, c.streamMgr
 	c.conn = conn
 	c.streamMgr = streamMgr
+	if c.connected {
+		c.reconnects++
+	}
+	c.connected = true
 	c.mu.Unlock()
 
 	// Start stream manager
@@ -138,14 +325,137 @@ func (c *Client) connect() error {
 
 	// Start control message handler
 	c.wg.Add(1)
-	go c.handleControlMessages()
+	go c.handleControlMessages(conn)
+
+	// The server only hears about changes, so give it the full picture
+	c.reportHealth()
+
+	// Measure the round-trip time now rather than at the first periodic
+	// ping
+	if err := conn.Ping(); err != nil {
+		c.logf("Failed to send ping: %v", err)
+	}
 
-	log.Printf("Tunnel established successfully")
+	// A connection the server is draining keeps serving its in-flight
+	// streams until they finish
+	if oldConn != nil && !oldConn.IsClosed() {
+		c.wg.Add(1)
+		go c.retire(oldConn, oldStreamMgr)
+	}
+
+	c.logf("Tunnel established successfully")
+	c.notifyState()
 	return nil
 }
 
+// parseServerURL interprets the --server value. Bare host:port addresses
+// mean WebSocket over TLS (or plain WebSocket with plaintext set);
+// otherwise the URL scheme selects the transport.
+func parseServerURL(addr string, plaintext bool) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		scheme := "wss"
+		if plaintext {
+			scheme = "ws"
+		}
+		addr = scheme + "://" + addr
+	}
+
+	target, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q: missing host", addr)
+	}
+	if plaintext && (target.Scheme == "wss" || target.Scheme == "tls") {
+		return nil, fmt.Errorf("plaintext cannot be used with a %s:// server URL", target.Scheme)
+	}
+
+	return target, nil
+}
+
+// hello builds the handshake message advertising this client
+func (c *Client) hello(streamTypes []string) models.Hello {
+	// Only clients that manage their services advertise the feature, so
+	// the server leaves everyone else's services alone
+	features := tunnel.SupportedFeatures
+	if c.services == nil {
+		features = slices.DeleteFunc(slices.Clone(features), func(feature string) bool {
+			return feature == tunnel.FeatureServices
+		})
+	}
+
+	hostname, _ := os.Hostname()
+	return models.Hello{
+		ProtocolVersion: tunnel.ProtocolVersion,
+		Token:           c.token,
+		ClientVersion:   c.version,
+		Hostname:        hostname,
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		StreamTypes:     streamTypes,
+		Features:        features,
+		Services:        c.services,
+	}
+}
+
+// logServiceResults reports what the server did with declared services
+func (c *Client) logServiceResults(welcome *models.Welcome) {
+	if c.services == nil {
+		return
+	}
+	if !slices.Contains(welcome.Features, tunnel.FeatureServices) {
+		c.logf("Server does not support client-declared services; ignoring %d declared services", len(c.services))
+		return
+	}
+
+	for _, result := range welcome.Services {
+		decl := result.Declaration
+		name := decl.Domain
+		if name == "" {
+			name = fmt.Sprintf(":%d", decl.ListenPort)
+		}
+		if result.Status == "rejected" {
+			c.logf("Service %s %s -> %s rejected: %s", decl.Type, name, decl.TargetAddr, result.Reason)
+		} else {
+			c.logf("Service %s %s -> %s %s (%s)", decl.Type, name, decl.TargetAddr, result.Status, result.ServiceID)
+		}
+	}
+}
+
+// drain tells the server this connection is going away and waits for its
+// in-flight streams to finish
+func (c *Client) drain(conn *tunnel.Connection) {
+	c.logf("Draining connection (timeout %v)", c.drainTimeout)
+	if err := conn.Drain("client shutting down"); err != nil {
+		c.logf("Failed to drain connection: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.drainTimeout)
+	defer cancel()
+	if !conn.WaitIdle(ctx) {
+		c.logf("Drain timed out with %d streams still active", conn.NumStreams())
+	}
+}
+
+// retire closes a replaced connection once its streams have finished
+func (c *Client) retire(conn *tunnel.Connection, streamMgr *tunnel.StreamManager) {
+	defer c.wg.Done()
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.drainTimeout)
+	defer cancel()
+	if !conn.WaitIdle(ctx) {
+		c.logf("Closing drained connection with %d streams still active", conn.NumStreams())
+	}
+
+	if streamMgr != nil {
+		streamMgr.Stop()
+	}
+	conn.Close()
+}
+
 // handleControlMessages handles control messages from the server
-func (c *Client) handleControlMessages() {
+func (c *Client) handleControlMessages(conn *tunnel.Connection) {
 	defer c.wg.Done()
 
 	for {
@@ -155,37 +465,117 @@ func (c *Client) handleControlMessages() {
 		default:
 		}
 
-		c.mu.RLock()
-		conn := c.conn
-		c.mu.RUnlock()
-
-		if conn == nil || conn.IsClosed() {
+		if conn.IsClosed() {
 			return
 		}
 
 		msg, err := conn.ReadMessage()
 		if err != nil {
 			if c.ctx.Err() == nil {
-				log.Printf("Error reading control message: %v", err)
+				c.logf("Error reading control message: %v", err)
+				c.setError(err)
 			}
+			// A broken control stream means the session is unusable
+			conn.Close()
+			c.notifyState()
+			c.triggerReconnect()
 			return
 		}
 
 		switch msg.Type {
 		case "ping":
 			if err := conn.Pong(); err != nil {
-				log.Printf("Failed to send pong: %v", err)
+				c.logf("Failed to send pong: %v", err)
 				return
 			}
 			conn.UpdateLastPing()
 		case "pong":
-			conn.UpdateLastPing()
+			conn.PongReceived()
+		case "drain":
+			// Reconnect now and let the old connection finish its streams
+			c.logf("Server is draining (%s), reconnecting", msg.Reason)
+			conn.SetDraining()
+			c.triggerReconnect()
 		default:
-			log.Printf("Unknown control message type: %s", msg.Type)
+			c.logf("Unknown control message type: %s", msg.Type)
 		}
 	}
 }
 
+// startHealthChecks starts checking the backends of every pool until the
+// client stops
+func (c *Client) startHealthChecks() {
+	for _, p := range c.forwarder.pools {
+		c.wg.Add(1)
+		go func(p *pool) {
+			defer c.wg.Done()
+			p.runChecks(c.ctx, c.forwarder)
+		}(p)
+	}
+}
+
+// reportHealth sends the health of the client's pools to the server
+func (c *Client) reportHealth() {
+	if len(c.forwarder.pools) == 0 {
+		return
+	}
+
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if conn == nil || conn.IsClosed() {
+		return
+	}
+
+	if err := conn.SendHealth(c.forwarder.PoolHealth()); err != nil {
+		c.logf("Failed to report pool health: %v", err)
+	}
+}
+
+// setError records the most recent connection error for status reports
+func (c *Client) setError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastError = err.Error()
+	c.lastErrorAt = time.Now()
+}
+
+// notifyState calls the OnStateChange callback if the connection state
+// differs from the one last reported
+func (c *Client) notifyState() {
+	if c.onStateChange == nil {
+		return
+	}
+
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+
+	status := c.Status()
+	if status.State == c.lastState {
+		return
+	}
+	c.lastState = status.State
+	c.onStateChange(status)
+}
+
+// logf logs a message, prefixed with the profile name when there is one
+func (c *Client) logf(format string, args ...any) {
+	if c.name != "" {
+		format = "[" + c.name + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// triggerReconnect wakes the reconnect loop without waiting for its next
+// periodic check
+func (c *Client) triggerReconnect() {
+	select {
+	case c.reconnect <- struct{}{}:
+	default:
+	}
+}
+
 // reconnectLoop handles automatic reconnection with exponential backoff
 func (c *Client) reconnectLoop() {
 	defer c.wg.Done()
@@ -203,11 +593,20 @@ func (c *Client) reconnectLoop() {
 		// Check if connection is alive
 		c.mu.RLock()
 		conn := c.conn
-		needReconnect := conn == nil || conn.IsClosed()
+		stopping := c.stopping
+		needReconnect := conn == nil || conn.IsClosed() || conn.IsDraining()
 		c.mu.RUnlock()
 
+		if stopping {
+			return
+		}
+
 		if needReconnect {
-			log.Printf("Connection lost, reconnecting in %v", backoff)
+			if conn != nil && !conn.IsClosed() {
+				c.logf("Connection draining, reconnecting in %v", backoff)
+			} else {
+				c.logf("Connection lost, reconnecting in %v", backoff)
+			}
 			
 			select {
 			case <-c.ctx.Done():
@@ -216,7 +615,8 @@ func (c *Client) reconnectLoop() {
 			}
 
 			if err := c.connect(); err != nil {
-				log.Printf("Reconnection failed: %v", err)
+				c.logf("Reconnection failed: %v", err)
+				c.setError(err)
 				backoff *= 2
 				if backoff > maxBackoff {
 					backoff = maxBackoff
@@ -228,7 +628,8 @@ func (c *Client) reconnectLoop() {
 		} else {
 			// Check connection health
 			if time.Since(conn.LastPing()) > tunnel.PingInterval*3 {
-				log.Printf("Connection appears stale, forcing reconnect")
+				c.logf("Connection appears stale, forcing reconnect")
+				c.setError(fmt.Errorf("connection stale, no ping since %s", conn.LastPing().Format(time.RFC3339)))
 				c.mu.Lock()
 				if c.streamMgr != nil {
 					c.streamMgr.Stop()
@@ -239,6 +640,7 @@ func (c *Client) reconnectLoop() {
 				c.conn = nil
 				c.streamMgr = nil
 				c.mu.Unlock()
+				c.notifyState()
 				continue
 			}
 		}
@@ -247,6 +649,7 @@ func (c *Client) reconnectLoop() {
 		select {
 		case <-c.ctx.Done():
 			return
+		case <-c.reconnect:
 		case <-time.After(time.Second * 10):
 		}
 	}
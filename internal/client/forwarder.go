@@ -1,46 +1,315 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jclement/picotunnel/internal/tunnel"
 )
 
+// unixTargetScheme marks a service target that is a Unix domain socket,
+// such as "unix:///var/run/docker.sock"
+const unixTargetScheme = "unix://"
+
 // Forwarder handles forwarding streams to local services
 type Forwarder struct {
-	// Add any configuration here if needed
+	idleTimeout time.Duration
+	policy      *Policy
+	stats       forwarderStats
+	inspector   *Inspector
+	pools       map[string]*pool
+
+	upstreamTLSConfigs map[string]UpstreamTLSConfig
+}
+
+// ForwarderConfig holds forwarder configuration
+type ForwarderConfig struct {
+	// IdleTimeout closes streams with no traffic in either direction for
+	// this long (0 disables)
+	IdleTimeout time.Duration
+
+	// Policy restricts which targets may be dialed (nil allows all)
+	Policy *Policy
+
+	// UpstreamTLS holds the options for tls:// targets, keyed by host:port
+	// ("*" for the default)
+	UpstreamTLS map[string]UpstreamTLSConfig
+
+	// Inspector records the HTTP exchanges of http streams (nil copies
+	// them without parsing)
+	Inspector *Inspector
+
+	// Pools are sets of backends balanced across for pool://NAME targets,
+	// keyed by NAME
+	Pools map[string]PoolConfig
 }
 
 // NewForwarder creates a new forwarder
-func NewForwarder() *Forwarder {
-	return &Forwarder{}
+func NewForwarder(config ForwarderConfig) *Forwarder {
+	pools := make(map[string]*pool, len(config.Pools))
+	for name, poolConfig := range config.Pools {
+		pools[name] = newPool(name, poolConfig)
+	}
+
+	return &Forwarder{
+		idleTimeout: config.IdleTimeout,
+		policy:      config.Policy,
+		inspector:   config.Inspector,
+		pools:       pools,
+
+		upstreamTLSConfigs: config.UpstreamTLS,
+	}
 }
 
 // HandleStream implements tunnel.StreamHandler
 func (f *Forwarder) HandleStream(stream net.Conn, header tunnel.StreamHeader) error {
 	defer stream.Close()
 
-	log.Printf("Handling %s stream to %s", header.Type, header.Target)
+	logPrefix := streamLogPrefix(header)
+	log.Printf("%sHandling %s stream to %s", logPrefix, header.Type, header.Target)
 
-	// Connect to local target
-	targetConn, err := net.DialTimeout("tcp", header.Target, time.Second*10)
+	if header.Type == "udp" {
+		network, addr, useTLS := splitTarget(header.Target)
+		if err := f.checkTarget(network, addr); err != nil {
+			log.Printf("%sDenied %s stream: %v", logPrefix, header.Type, err)
+			header.Respond(stream, tunnel.StreamDenied, err.Error())
+			return err
+		}
+		if network != "tcp" || useTLS {
+			err := fmt.Errorf("UDP targets must be a plain host:port")
+			header.Respond(stream, tunnel.StreamFailed, err.Error())
+			return err
+		}
+		return f.handleUDP(stream, header, logPrefix)
+	}
+
+	// Connect to local target, or to one of a pool's backends
+	targetConn, target, err := f.dialTarget(header.Target)
 	if err != nil {
-		log.Printf("Failed to connect to target %s: %v", header.Target, err)
-		return fmt.Errorf("failed to connect to target %s: %w", header.Target, err)
+		status, message := tunnel.StreamFailed, err.Error()
+		var streamErr *tunnel.StreamError
+		if errors.As(err, &streamErr) {
+			status, message = streamErr.Status, streamErr.Message
+		}
+		if status == tunnel.StreamDenied {
+			log.Printf("%sDenied %s stream: %s", logPrefix, header.Type, message)
+		} else {
+			log.Printf("%sFailed to connect to target %s: %s", logPrefix, header.Target, message)
+		}
+		header.Respond(stream, status, message)
+		return fmt.Errorf("failed to connect to target %s: %s", header.Target, message)
 	}
 	defer targetConn.Close()
 
-	log.Printf("Connected to target %s, starting proxy", header.Target)
+	counters := f.stats.streamStarted(target)
+	defer counters.active.Add(-1)
+	targetConn = &countingConn{Conn: targetConn, counters: counters}
+
+	if err := header.Respond(stream, tunnel.StreamOK, ""); err != nil {
+		return err
+	}
+
+	log.Printf("%sConnected to target %s, starting proxy", logPrefix, target)
+
+	if header.Type == "http" && f.inspector != nil {
+		if err := f.inspectHTTP(stream, targetConn, header); err != nil {
+			log.Printf("%sProxy error for %s: %v", logPrefix, header.Target, err)
+			return err
+		}
+		log.Printf("%sStream to %s completed", logPrefix, header.Target)
+		return nil
+	}
 
 	// Start bidirectional copy
-	if err := tunnel.CopyBidirectional(stream, targetConn); err != nil {
-		log.Printf("Proxy error for %s: %v", header.Target, err)
+	result, err := tunnel.CopyBidirectional(stream, targetConn, f.idleTimeout)
+	if err != nil {
+		log.Printf("%sProxy error for %s: %v", logPrefix, header.Target, err)
 		return err
 	}
 
-	log.Printf("Stream to %s completed", header.Target)
+	log.Printf("%sStream to %s completed (%d bytes sent, %d bytes received)", logPrefix, header.Target, result.AToB, result.BToA)
 	return nil
-}
\ No newline at end of file
+}
+
+// Targets returns stream and byte counts for each target forwarded to
+func (f *Forwarder) Targets() []TargetStatus {
+	return f.stats.snapshot()
+}
+
+// checkTarget applies the target policy to a split target address
+func (f *Forwarder) checkTarget(network, addr string) error {
+	if network == "unix" {
+		return f.policy.CheckSocket(addr)
+	}
+	return f.policy.Check(addr)
+}
+
+// checkServiceTarget applies the target policy to a service target. A
+// pool:// target only needs the pool to exist, as each backend is checked
+// when dialed.
+func (f *Forwarder) checkServiceTarget(target string) error {
+	if name, ok := strings.CutPrefix(target, poolTargetScheme); ok {
+		if f.pools[name] == nil {
+			return fmt.Errorf("no pool named %q", name)
+		}
+		return nil
+	}
+	network, addr, _ := splitTarget(target)
+	return f.checkTarget(network, addr)
+}
+
+// dialTarget connects to a service target after applying the target
+// policy. A pool:// target connects to one of the pool's backends. It
+// returns the address dialed; failures are *tunnel.StreamError values
+// carrying the status to report.
+func (f *Forwarder) dialTarget(target string) (net.Conn, string, error) {
+	if name, ok := strings.CutPrefix(target, poolTargetScheme); ok {
+		return f.dialPool(name)
+	}
+
+	network, addr, useTLS := splitTarget(target)
+	if err := f.checkTarget(network, addr); err != nil {
+		return nil, "", &tunnel.StreamError{Status: tunnel.StreamDenied, Message: err.Error()}
+	}
+	conn, err := f.dial(network, addr, useTLS)
+	if err != nil {
+		return nil, "", &tunnel.StreamError{Status: dialStatus(err), Message: err.Error()}
+	}
+	return conn, target, nil
+}
+
+// dialStatus classifies a dial error into a stream status, reporting
+// addresses refused by the policy while dialing as denied
+func dialStatus(err error) tunnel.StreamStatus {
+	var denied *deniedError
+	if errors.As(err, &denied) {
+		return tunnel.StreamDenied
+	}
+	return tunnel.DialStatus(err)
+}
+
+// dial connects to a split target address
+func (f *Forwarder) dial(network, addr string, useTLS bool) (net.Conn, error) {
+	return f.dialTimeout(network, addr, useTLS, tunnel.DialTimeout)
+}
+
+// dialTimeout connects to a split target address, giving up after timeout
+func (f *Forwarder) dialTimeout(network, addr string, useTLS bool, timeout time.Duration) (net.Conn, error) {
+	if useTLS {
+		return f.dialTLS(addr, timeout)
+	}
+	return f.dialer(network, addr, timeout).Dial(network, addr)
+}
+
+// dialer returns a dialer for a target that enforces the policy on the
+// address each connection attempt actually uses, not just on the lookup
+// made by checkTarget
+func (f *Forwarder) dialer(network, addr string, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if network != "unix" {
+		dialer.Control = f.policy.dialControl(addr)
+	}
+	return dialer
+}
+
+// handleUDP relays framed datagrams between a stream and a local UDP
+// target until either side closes or the stream goes idle
+func (f *Forwarder) handleUDP(stream net.Conn, header tunnel.StreamHeader, logPrefix string) error {
+	targetConn, err := f.dialer("udp", header.Target, tunnel.DialTimeout).Dial("udp", header.Target)
+	if err != nil {
+		log.Printf("%sFailed to connect to UDP target %s: %v", logPrefix, header.Target, err)
+		header.Respond(stream, dialStatus(err), err.Error())
+		return fmt.Errorf("failed to connect to UDP target %s: %w", header.Target, err)
+	}
+	defer targetConn.Close()
+
+	counters := f.stats.streamStarted(header.Target)
+	defer counters.active.Add(-1)
+	targetConn = &countingConn{Conn: targetConn, counters: counters}
+
+	if err := header.Respond(stream, tunnel.StreamOK, ""); err != nil {
+		return err
+	}
+
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	// Datagrams from the server go to the target
+	go func() {
+		defer targetConn.Close()
+
+		buf := make([]byte, tunnel.MaxDatagramSize)
+		for {
+			n, err := tunnel.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			lastActivity.Store(time.Now().UnixNano())
+			if _, err := targetConn.Write(buf[:n]); err != nil {
+				log.Printf("%sUDP write to %s failed: %v", logPrefix, header.Target, err)
+				return
+			}
+		}
+	}()
+
+	// Replies from the target go back over the stream
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		targetConn.SetReadDeadline(time.Now().Add(tunnel.UDPIdleTimeout))
+		n, err := targetConn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				idle := time.Since(time.Unix(0, lastActivity.Load()))
+				if idle < tunnel.UDPIdleTimeout {
+					continue
+				}
+				log.Printf("%sUDP stream to %s idle, closing", logPrefix, header.Target)
+				return nil
+			}
+			// Closed by the stream side finishing
+			break
+		}
+
+		lastActivity.Store(time.Now().UnixNano())
+		if err := tunnel.WriteDatagram(stream, buf[:n]); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("%sUDP stream to %s completed", logPrefix, header.Target)
+	return nil
+}
+
+// splitTarget separates a target's scheme from its address, returning the
+// network to dial and whether the connection is wrapped in TLS
+func splitTarget(target string) (network, addr string, useTLS bool) {
+	if rest, ok := strings.CutPrefix(target, unixTargetScheme); ok {
+		return "unix", rest, false
+	}
+	if rest, ok := strings.CutPrefix(target, tlsTargetScheme); ok {
+		return "tcp", rest, true
+	}
+	return "tcp", target, false
+}
+
+// streamLogPrefix formats the request metadata carried by a stream header
+// so client log lines can be matched with the server's
+func streamLogPrefix(header tunnel.StreamHeader) string {
+	if header.RequestID == "" {
+		return ""
+	}
+
+	prefix := "[" + header.RequestID
+	if header.RemoteAddr != "" {
+		prefix += " from " + header.RemoteAddr
+	}
+	if header.Host != "" {
+		prefix += " host " + header.Host
+	}
+	return prefix + "] "
+}
@@ -0,0 +1,467 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+// Inspector defaults
+const (
+	DefaultInspectorCapacity = 100       // exchanges kept
+	DefaultInspectorMaxBody  = 64 * 1024 // bytes of each body kept
+)
+
+// replayTimeout bounds a replayed request, including reading its response
+const replayTimeout = 60 * time.Second
+
+//go:embed inspector.html
+var inspectorPage []byte
+
+// Inspector records the HTTP exchanges forwarded to targets, mainly for
+// debugging webhooks. The most recent ones are kept in memory, with bodies
+// truncated, and served through a local web UI and JSON API that can also
+// replay a request against its target.
+type Inspector struct {
+	capacity int
+	maxBody  int
+	entries  []*InspectedRequest // oldest first
+	nextID   int64
+	mu       sync.Mutex
+}
+
+// InspectedRequest is one recorded request and its response
+type InspectedRequest struct {
+	ID             string    `json:"id"`
+	ReplayOf       string    `json:"replay_of,omitempty"` // the exchange this one replayed
+	Target         string    `json:"target"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"` // original client
+	RequestID      string    `json:"request_id,omitempty"`  // correlates with the server's logs
+	StartedAt      time.Time `json:"started_at"`
+	DurationMillis float64   `json:"duration_ms"`
+	Error          string    `json:"error,omitempty"`
+
+	Method           string      `json:"method"`
+	URL              string      `json:"url"`
+	Host             string      `json:"host"`
+	Proto            string      `json:"proto"`
+	RequestHeaders   http.Header `json:"request_headers"`
+	RequestBody      []byte      `json:"request_body"`
+	RequestSize      int64       `json:"request_size"`
+	RequestTruncated bool        `json:"request_truncated"`
+
+	Status            int         `json:"status"`
+	ResponseHeaders   http.Header `json:"response_headers"`
+	ResponseBody      []byte      `json:"response_body"`
+	ResponseSize      int64       `json:"response_size"`
+	ResponseTruncated bool        `json:"response_truncated"`
+
+	forwarder *Forwarder // replays go through the forwarder that handled the request
+}
+
+// NewInspector creates an inspector keeping up to capacity exchanges, with
+// up to maxBody bytes of each body
+func NewInspector(capacity, maxBody int) *Inspector {
+	if capacity <= 0 {
+		capacity = DefaultInspectorCapacity
+	}
+	if maxBody < 0 {
+		maxBody = DefaultInspectorMaxBody
+	}
+	return &Inspector{capacity: capacity, maxBody: maxBody}
+}
+
+// Requests returns the recorded exchanges, newest first
+func (i *Inspector) Requests() []InspectedRequest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	requests := make([]InspectedRequest, 0, len(i.entries))
+	for n := len(i.entries) - 1; n >= 0; n-- {
+		requests = append(requests, *i.entries[n])
+	}
+	return requests
+}
+
+// Request returns a recorded exchange by ID
+func (i *Inspector) Request(id string) (InspectedRequest, bool) {
+	entry := i.find(id)
+	if entry == nil {
+		return InspectedRequest{}, false
+	}
+	return *entry, true
+}
+
+// Clear forgets every recorded exchange
+func (i *Inspector) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.entries = nil
+}
+
+// Replay sends a recorded request to its target again, straight from the
+// client, and records the outcome as a new exchange. Requests whose body
+// was truncated cannot be replayed.
+func (i *Inspector) Replay(ctx context.Context, id string) (InspectedRequest, error) {
+	original := i.find(id)
+	if original == nil {
+		return InspectedRequest{}, fmt.Errorf("request %s not found", id)
+	}
+	if original.RequestTruncated {
+		return InspectedRequest{}, fmt.Errorf("request %s cannot be replayed: its body was truncated", id)
+	}
+
+	f := original.forwarder
+	if err := f.checkServiceTarget(original.Target); err != nil {
+		return InspectedRequest{}, err
+	}
+
+	reqURL, err := url.ParseRequestURI(original.URL)
+	if err != nil {
+		return InspectedRequest{}, fmt.Errorf("request %s has an invalid URL: %w", id, err)
+	}
+	reqURL.Scheme = "http"
+	reqURL.Host = original.Host
+
+	ctx, cancel := context.WithTimeout(ctx, replayTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, original.Method, reqURL.String(), bytes.NewReader(original.RequestBody))
+	if err != nil {
+		return InspectedRequest{}, err
+	}
+	req.Host = original.Host
+	req.Header = original.RequestHeaders.Clone()
+	keepUserAgent(req.Header)
+
+	// Whatever the URL says, the request goes to the target
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			conn, _, err := f.dialTarget(original.Target)
+			return conn, err
+		},
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+	}
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	entry := &InspectedRequest{
+		ReplayOf:         original.ID,
+		Target:           original.Target,
+		StartedAt:        time.Now(),
+		Method:           original.Method,
+		URL:              original.URL,
+		Host:             original.Host,
+		Proto:            "HTTP/1.1",
+		RequestHeaders:   original.RequestHeaders.Clone(),
+		RequestBody:      original.RequestBody,
+		RequestSize:      int64(len(original.RequestBody)),
+		RequestTruncated: false,
+		forwarder:        f,
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Status = resp.StatusCode
+		entry.ResponseHeaders = resp.Header.Clone()
+		capture := &bodyCapture{ReadCloser: resp.Body, limit: i.maxBody}
+		if _, err := io.Copy(io.Discard, capture); err != nil {
+			entry.Error = err.Error()
+		}
+		resp.Body.Close()
+		capture.fill(&entry.ResponseBody, &entry.ResponseSize, &entry.ResponseTruncated)
+	}
+	entry.DurationMillis = float64(time.Since(entry.StartedAt).Microseconds()) / 1000
+
+	i.record(entry)
+	return *entry, nil
+}
+
+// Handler serves the inspector's web UI and JSON API:
+//
+//	GET    /                          web UI
+//	GET    /api/requests              recorded exchanges, newest first
+//	DELETE /api/requests              forget every exchange
+//	GET    /api/requests/{id}         one exchange
+//	POST   /api/requests/{id}/replay  send a request to its target again
+func (i *Inspector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(inspectorPage)
+	})
+	mux.HandleFunc("GET /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		writeStatusJSON(w, http.StatusOK, i.Requests())
+	})
+	mux.HandleFunc("DELETE /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			writeStatusJSON(w, http.StatusForbidden, map[string]string{"error": "cross-origin request refused"})
+			return
+		}
+		i.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/requests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := i.Request(r.PathValue("id"))
+		if !ok {
+			writeStatusJSON(w, http.StatusNotFound, map[string]string{"error": "request not found"})
+			return
+		}
+		writeStatusJSON(w, http.StatusOK, entry)
+	})
+	mux.HandleFunc("POST /api/requests/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			writeStatusJSON(w, http.StatusForbidden, map[string]string{"error": "cross-origin request refused"})
+			return
+		}
+		if _, ok := i.Request(r.PathValue("id")); !ok {
+			writeStatusJSON(w, http.StatusNotFound, map[string]string{"error": "request not found"})
+			return
+		}
+		entry, err := i.Replay(r.Context(), r.PathValue("id"))
+		if err != nil {
+			writeStatusJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeStatusJSON(w, http.StatusOK, entry)
+	})
+	return localOnly(mux)
+}
+
+// inspectorHeader marks requests to the inspector API from scripts and
+// tools. Pages on other origins cannot send it without a CORS preflight,
+// which the inspector never approves.
+const inspectorHeader = "X-Picotunnel-Inspector"
+
+// sameOrigin reports whether a request that changes the inspector's state
+// comes from the inspector's own page, or from a tool that set
+// inspectorHeader, rather than from another site the user has open
+func sameOrigin(r *http.Request) bool {
+	if r.Header.Get(inspectorHeader) != "" {
+		return true
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || r.Header.Get("Origin") == "" {
+		return false
+	}
+	return origin.Scheme == "http" && strings.EqualFold(origin.Host, r.Host)
+}
+
+// find returns the live entry with an ID
+func (i *Inspector) find(id string) *InspectedRequest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, entry := range i.entries {
+		if entry.ID == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// record adds a finished exchange, dropping the oldest once full
+func (i *Inspector) record(entry *InspectedRequest) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.nextID++
+	entry.ID = strconv.FormatInt(i.nextID, 10)
+	i.entries = append(i.entries, entry)
+	if over := len(i.entries) - i.capacity; over > 0 {
+		i.entries = append(i.entries[:0:0], i.entries[over:]...)
+	}
+}
+
+// inspectHTTP forwards an HTTP stream one request at a time, recording
+// each exchange. A connection upgraded to another protocol, such as a
+// WebSocket, is copied as-is from then on, as is a stream that starts with
+// a TLS handshake rather than a request.
+func (f *Forwarder) inspectHTTP(stream, targetConn net.Conn, header tunnel.StreamHeader) error {
+	clientReader := bufio.NewReader(stream)
+	targetReader := bufio.NewReader(targetConn)
+
+	if first, err := clientReader.Peek(1); err == nil && first[0] == 0x16 {
+		return f.copyRest(stream, clientReader, targetConn, targetReader)
+	}
+
+	for {
+		if f.idleTimeout > 0 {
+			stream.SetReadDeadline(time.Now().Add(f.idleTimeout))
+		}
+		req, err := http.ReadRequest(clientReader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stream.SetReadDeadline(time.Time{})
+
+		entry, resp, err := f.inspector.exchange(stream, targetConn, targetReader, req, header)
+		entry.forwarder = f
+		f.inspector.record(entry)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return f.copyRest(stream, clientReader, targetConn, targetReader)
+		}
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+// exchange forwards one request to the target and its response back to
+// the client, recording both
+func (i *Inspector) exchange(client, target net.Conn, targetReader *bufio.Reader, req *http.Request, header tunnel.StreamHeader) (*InspectedRequest, *http.Response, error) {
+	entry := &InspectedRequest{
+		Target:         header.Target,
+		RemoteAddr:     header.RemoteAddr,
+		RequestID:      header.RequestID,
+		StartedAt:      time.Now(),
+		Method:         req.Method,
+		URL:            req.RequestURI,
+		Host:           req.Host,
+		Proto:          req.Proto,
+		RequestHeaders: req.Header.Clone(),
+	}
+	finish := func(err error) error {
+		entry.DurationMillis = float64(time.Since(entry.StartedAt).Microseconds()) / 1000
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		return err
+	}
+
+	// The body is relayed after the request headers, so answer the
+	// client's 100-continue ourselves
+	if req.Header.Get("Expect") == "100-continue" {
+		req.Header.Del("Expect")
+		if _, err := io.WriteString(client, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return entry, nil, finish(err)
+		}
+	}
+
+	keepUserAgent(req.Header)
+	requestBody := i.capture(&req.Body)
+	err := req.Write(target)
+	requestBody.fill(&entry.RequestBody, &entry.RequestSize, &entry.RequestTruncated)
+	if err != nil {
+		return entry, nil, finish(fmt.Errorf("failed to send request to target: %w", err))
+	}
+
+	// Informational responses other than 101 precede the real one
+	var resp *http.Response
+	for {
+		resp, err = http.ReadResponse(targetReader, req)
+		if err != nil {
+			return entry, nil, finish(fmt.Errorf("failed to read response from target: %w", err))
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		if err := resp.Write(client); err != nil {
+			return entry, nil, finish(err)
+		}
+	}
+
+	entry.Status = resp.StatusCode
+	entry.ResponseHeaders = resp.Header.Clone()
+	responseBody := i.capture(&resp.Body)
+	err = resp.Write(client)
+	responseBody.fill(&entry.ResponseBody, &entry.ResponseSize, &entry.ResponseTruncated)
+	if err != nil {
+		return entry, nil, finish(fmt.Errorf("failed to send response to client: %w", err))
+	}
+
+	return entry, resp, finish(nil)
+}
+
+// capture wraps a body so the first maxBody bytes are kept as it is read
+func (i *Inspector) capture(body *io.ReadCloser) *bodyCapture {
+	capture := &bodyCapture{limit: i.maxBody}
+	if *body != nil && *body != http.NoBody {
+		capture.ReadCloser = *body
+		*body = capture
+	}
+	return capture
+}
+
+// copyRest sends whatever the readers buffered past the last exchange and
+// copies the connections from then on
+func (f *Forwarder) copyRest(stream net.Conn, clientReader *bufio.Reader, targetConn net.Conn, targetReader *bufio.Reader) error {
+	if err := flushBuffered(targetConn, clientReader); err != nil {
+		return err
+	}
+	if err := flushBuffered(stream, targetReader); err != nil {
+		return err
+	}
+	_, err := tunnel.CopyBidirectional(stream, targetConn, f.idleTimeout)
+	return err
+}
+
+// flushBuffered writes the bytes buffered in r to w
+func flushBuffered(w io.Writer, r *bufio.Reader) error {
+	if r.Buffered() == 0 {
+		return nil
+	}
+	buffered, _ := r.Peek(r.Buffered())
+	_, err := w.Write(buffered)
+	return err
+}
+
+// keepUserAgent stops Request.Write from adding Go's User-Agent to
+// requests that had none
+func keepUserAgent(h http.Header) {
+	if _, ok := h["User-Agent"]; !ok {
+		h["User-Agent"] = []string{""}
+	}
+}
+
+// bodyCapture keeps the start of a body as it is read and counts its
+// full size
+type bodyCapture struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int
+	size  int64
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.size += int64(n)
+	if room := c.limit - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+// fill stores what was captured in an entry's fields
+func (c *bodyCapture) fill(body *[]byte, size *int64, truncated *bool) {
+	*body = c.buf.Bytes()
+	*size = c.size
+	*truncated = c.size > int64(c.buf.Len())
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInspectorRefusesForeignHosts(t *testing.T) {
+	handler := NewInspector(0, 0).Handler()
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"127.0.0.1:4040", http.StatusOK},
+		{"localhost:4040", http.StatusOK},
+		{"[::1]:4040", http.StatusOK},
+		{"10.0.0.5:4040", http.StatusOK},
+		{"rebind.attacker.example:4040", http.StatusForbidden},
+		{"localhost.attacker.example", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/requests", nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("GET with Host %q = %d, want %d", test.host, rec.Code, test.want)
+		}
+	}
+}
+
+func TestInspectorRefusesCrossOriginChanges(t *testing.T) {
+	handler := NewInspector(0, 0).Handler()
+
+	tests := []struct {
+		name    string
+		origin  string
+		header  bool
+		allowed bool
+	}{
+		{"same origin", "http://127.0.0.1:4040", false, true},
+		{"inspector header", "", true, true},
+		{"other site", "https://evil.example", false, false},
+		{"other local port", "http://127.0.0.1:3000", false, false},
+		{"no origin", "", false, false},
+	}
+	for _, test := range tests {
+		for _, method := range []string{http.MethodDelete, http.MethodPost} {
+			path := "/api/requests"
+			if method == http.MethodPost {
+				path = "/api/requests/missing/replay"
+			}
+			req := httptest.NewRequest(method, path, nil)
+			req.Host = "127.0.0.1:4040"
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			if test.header {
+				req.Header.Set(inspectorHeader, "1")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if refused := rec.Code == http.StatusForbidden; refused == test.allowed {
+				t.Errorf("%s %s (%s) = %d, want allowed %v", method, path, test.name, rec.Code, test.allowed)
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manager runs the tunnel profiles of a configuration file, each with its
+// own client and reconnect loop. Applying a new configuration restarts
+// only the profiles whose settings changed.
+type Manager struct {
+	version      string
+	drainTimeout time.Duration
+	idleTimeout  time.Duration
+	proxy        string
+	inspector    *Inspector
+	profiles     map[string]*managedProfile
+	mu           sync.Mutex
+}
+
+// ManagerConfig holds the process-wide defaults for managed profiles
+type ManagerConfig struct {
+	Version      string
+	DrainTimeout time.Duration
+	IdleTimeout  time.Duration
+	Proxy        string
+	Inspector    *Inspector // shared by every profile (nil disables inspection)
+}
+
+// managedProfile is a running profile and the settings it was started with
+type managedProfile struct {
+	settings ProfileConfig
+	token    string
+	client   *Client
+}
+
+// NewManager creates a manager with no running profiles
+func NewManager(config ManagerConfig) *Manager {
+	return &Manager{
+		version:      config.Version,
+		drainTimeout: config.DrainTimeout,
+		idleTimeout:  config.IdleTimeout,
+		proxy:        config.Proxy,
+		inspector:    config.Inspector,
+		profiles:     make(map[string]*managedProfile),
+	}
+}
+
+// Apply brings the running profiles in line with a configuration. New and
+// changed profiles are started first, then removed and replaced ones are
+// drained, so the server can route a changed profile's new streams to the
+// new connection while the old one finishes. If any profile cannot be
+// prepared, nothing is changed.
+func (m *Manager) Apply(config *FileConfig) error {
+	retired, err := m.swapProfiles(config)
+	if err != nil {
+		return err
+	}
+
+	// Drain outside the lock, so status probes keep answering during a
+	// reload
+	stopClients(retired)
+	return nil
+}
+
+// swapProfiles starts the new and changed profiles of a configuration and
+// makes it the running one, returning the clients it replaced or removed
+func (m *Manager) swapProfiles(config *FileConfig) ([]*Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Prepare everything up front so a bad token file or policy leaves
+	// the running profiles alone
+	next := make(map[string]*managedProfile, len(config.Tunnels))
+	for _, name := range config.Names() {
+		settings := config.Tunnels[name]
+		token, err := settings.resolveToken()
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+
+		if current, exists := m.profiles[name]; exists && current.token == token && reflect.DeepEqual(current.settings, settings) {
+			next[name] = current
+			continue
+		}
+
+		clientConfig, err := m.clientConfig(name, settings, token)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+		next[name] = &managedProfile{
+			settings: settings,
+			token:    token,
+			client:   NewClient(clientConfig),
+		}
+	}
+
+	var retired []*Client
+	for name, profile := range next {
+		current, exists := m.profiles[name]
+		if exists && current == profile {
+			continue
+		}
+		if exists {
+			log.Printf("Tunnel %q changed, restarting", name)
+			retired = append(retired, current.client)
+		} else {
+			log.Printf("Starting tunnel %q", name)
+		}
+		profile.client.StartBackground()
+	}
+	for name, current := range m.profiles {
+		if _, exists := next[name]; !exists {
+			log.Printf("Tunnel %q removed, stopping", name)
+			retired = append(retired, current.client)
+		}
+	}
+
+	m.profiles = next
+	return retired, nil
+}
+
+// Stop stops every running profile
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	clients := make([]*Client, 0, len(m.profiles))
+	for _, profile := range m.profiles {
+		clients = append(clients, profile.client)
+	}
+	m.profiles = make(map[string]*managedProfile)
+	m.mu.Unlock()
+
+	stopClients(clients)
+}
+
+// Status returns a snapshot of every running profile, sorted by name
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.profiles))
+	for name := range m.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	clients := make([]*Client, 0, len(names))
+	for _, name := range names {
+		clients = append(clients, m.profiles[name].client)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(clients))
+	for _, c := range clients {
+		statuses = append(statuses, c.Status())
+	}
+	return statuses
+}
+
+// clientConfig builds the client configuration for a profile
+func (m *Manager) clientConfig(name string, settings ProfileConfig, token string) (Config, error) {
+	policy, err := NewPolicy(settings.Allow, settings.Deny, settings.DefaultDeny)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config := Config{
+		Name:         name,
+		ServerAddr:   settings.Server,
+		Token:        token,
+		Insecure:     settings.Insecure,
+		Plaintext:    settings.Plaintext,
+		TLS:          settings.TLS,
+		Proxy:        m.proxy,
+		Version:      m.version,
+		DrainTimeout: m.drainTimeout,
+		IdleTimeout:  m.idleTimeout,
+		Policy:       policy,
+		UpstreamTLS:  settings.UpstreamTLS,
+		Services:     settings.Services,
+		StaticDirs:   settings.Static,
+		Pools:        settings.Pools,
+		Inspector:    m.inspector,
+	}
+	if settings.DrainTimeout != 0 {
+		config.DrainTimeout = settings.DrainTimeout
+	}
+	if settings.IdleTimeout != 0 {
+		config.IdleTimeout = settings.IdleTimeout
+	}
+	if settings.Proxy != "" {
+		config.Proxy = settings.Proxy
+	}
+	return config, nil
+}
+
+// stopClients stops clients concurrently, so their drains overlap
+func stopClients(clients []*Client) {
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.Stop()
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// resolveTimeout bounds DNS lookups made to match hostnames against CIDR
+// rules
+const resolveTimeout = 5 * time.Second
+
+// Policy restricts which targets the forwarder may dial, so a compromised
+// server or a mistyped service cannot reach arbitrary hosts on the
+// client's network.
+//
+// Rules have the form HOST[:PORT]. HOST is a glob matched against the
+// target host (such as "*.internal" or "localhost"), a CIDR block (such as
+// "10.0.0.0/8"), or a bracketed IPv6 address or block. PORT is a number,
+// a range such as "8000-8999", or "*"; leaving it out matches any port.
+// Rules starting with "/" are globs matched against the path of unix://
+// targets (such as "/run/*.sock"); other rules never match a socket.
+//
+// Deny rules are checked first. A target matching an allow rule is then
+// permitted. Anything else is denied when allow rules exist or default
+// deny is set, and permitted otherwise.
+type Policy struct {
+	allow       []policyRule
+	deny        []policyRule
+	defaultDeny bool
+}
+
+// policyRule is a single parsed allow or deny pattern
+type policyRule struct {
+	raw      string
+	hostGlob string
+	pathGlob string
+	network  *net.IPNet
+	portLow  int
+	portHigh int
+}
+
+// NewPolicy parses allow and deny rules into a policy
+func NewPolicy(allow, deny []string, defaultDeny bool) (*Policy, error) {
+	p := &Policy{defaultDeny: defaultDeny}
+
+	for _, raw := range allow {
+		rule, err := parsePolicyRule(raw)
+		if err != nil {
+			return nil, err
+		}
+		p.allow = append(p.allow, rule)
+	}
+
+	for _, raw := range deny {
+		rule, err := parsePolicyRule(raw)
+		if err != nil {
+			return nil, err
+		}
+		p.deny = append(p.deny, rule)
+	}
+
+	return p, nil
+}
+
+// Check returns an error describing why a target may not be dialed, or nil
+// if it is permitted. Hostnames are resolved when CIDR rules need to be
+// matched; a hostname is denied if any of its addresses matches a deny
+// rule, and only matches an allow rule if all of its addresses do. A nil
+// policy permits everything.
+func (p *Policy) Check(target string) error {
+	if p == nil {
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid target port %q", portStr)
+	}
+
+	var ips []net.IP
+	if p.hasNetworkRule(p.allow) || p.hasNetworkRule(p.deny) {
+		ips, err = resolveHost(host)
+		if err != nil {
+			// Without addresses, CIDR allow rules simply do not match;
+			// CIDR deny rules cannot be ruled out, so fail closed
+			if p.hasNetworkRule(p.deny) {
+				return fmt.Errorf("cannot check target %s against policy: %w", target, err)
+			}
+			ips = nil
+		}
+	}
+
+	return p.check(target, host, port, ips)
+}
+
+// CheckDialed applies the policy to the address a dial to target is about
+// to connect to, given as ip:port. Check resolves hostnames separately
+// from the dial, so a short-lived or rebinding DNS answer could pass its
+// CIDR rules and then connect to an address they deny; the forwarder runs
+// this on every connection attempt to close that gap.
+func (p *Policy) CheckDialed(target, address string) error {
+	if p == nil || !(p.hasNetworkRule(p.allow) || p.hasNetworkRule(p.deny)) {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	ipStr, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	ip := net.ParseIP(ipStr)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+
+	if err := p.check(target, host, port, []net.IP{ip}); err != nil {
+		return fmt.Errorf("%w (connecting to %s)", err, address)
+	}
+	return nil
+}
+
+// dialControl returns a net.Dialer Control hook running CheckDialed for
+// target, or nil when the policy has no CIDR rules
+func (p *Policy) dialControl(target string) func(network, address string, c syscall.RawConn) error {
+	if p == nil || !(p.hasNetworkRule(p.allow) || p.hasNetworkRule(p.deny)) {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := p.CheckDialed(target, address); err != nil {
+			return &deniedError{err: err}
+		}
+		return nil
+	}
+}
+
+// deniedError is a policy denial raised by a dial, so it can be told apart
+// from the target failing to connect
+type deniedError struct {
+	err error
+}
+
+func (e *deniedError) Error() string { return e.err.Error() }
+func (e *deniedError) Unwrap() error { return e.err }
+
+// check matches a target's host, port and addresses against the rules
+func (p *Policy) check(target, host string, port int, ips []net.IP) error {
+	for _, rule := range p.deny {
+		if rule.matches(host, port, ips, false) {
+			return fmt.Errorf("target %s matches deny rule %q", target, rule.raw)
+		}
+	}
+
+	for _, rule := range p.allow {
+		if rule.matches(host, port, ips, true) {
+			return nil
+		}
+	}
+
+	if len(p.allow) > 0 || p.defaultDeny {
+		return fmt.Errorf("target %s is not allowed by policy", target)
+	}
+	return nil
+}
+
+// CheckSocket is Check for a Unix socket target, matching the path against
+// the policy's path rules
+func (p *Policy) CheckSocket(socketPath string) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, rule := range p.deny {
+		if rule.matchesPath(socketPath) {
+			return fmt.Errorf("socket %s matches deny rule %q", socketPath, rule.raw)
+		}
+	}
+
+	for _, rule := range p.allow {
+		if rule.matchesPath(socketPath) {
+			return nil
+		}
+	}
+
+	if len(p.allow) > 0 || p.defaultDeny {
+		return fmt.Errorf("socket %s is not allowed by policy", socketPath)
+	}
+	return nil
+}
+
+// IsRestricted reports whether the policy can deny any target
+func (p *Policy) IsRestricted() bool {
+	return p != nil && (p.defaultDeny || len(p.allow) > 0 || len(p.deny) > 0)
+}
+
+// hasNetworkRule reports whether any of the rules matches on IP blocks
+func (p *Policy) hasNetworkRule(rules []policyRule) bool {
+	for _, rule := range rules {
+		if rule.network != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether a target matches the rule. ips are the target's
+// addresses; allRequired selects whether every address must be inside a
+// CIDR rule (for allow rules) or just one (for deny rules).
+func (r policyRule) matches(host string, port int, ips []net.IP, allRequired bool) bool {
+	if r.pathGlob != "" || port < r.portLow || port > r.portHigh {
+		return false
+	}
+
+	if r.network == nil {
+		matched, _ := path.Match(r.hostGlob, strings.ToLower(host))
+		return matched
+	}
+
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		inside := r.network.Contains(ip)
+		if allRequired && !inside {
+			return false
+		}
+		if !allRequired && inside {
+			return true
+		}
+	}
+	return allRequired
+}
+
+// matchesPath reports whether a socket path matches the rule
+func (r policyRule) matchesPath(socketPath string) bool {
+	if r.pathGlob == "" {
+		return false
+	}
+	matched, _ := path.Match(r.pathGlob, path.Clean(socketPath))
+	return matched
+}
+
+// parsePolicyRule parses a HOST[:PORT] rule
+func parsePolicyRule(raw string) (policyRule, error) {
+	rule := policyRule{raw: raw, portLow: 0, portHigh: 65535}
+
+	spec := strings.TrimSpace(raw)
+	if spec == "" {
+		return rule, fmt.Errorf("empty policy rule")
+	}
+
+	if strings.HasPrefix(spec, "/") {
+		if _, err := path.Match(spec, ""); err != nil {
+			return rule, fmt.Errorf("invalid path pattern in policy rule %q: %w", raw, err)
+		}
+		rule.pathGlob = path.Clean(spec)
+		return rule, nil
+	}
+
+	host, port := spec, ""
+	switch {
+	case strings.HasPrefix(spec, "["):
+		end := strings.Index(spec, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("invalid policy rule %q: missing ]", raw)
+		}
+		host = spec[1:end]
+		rest := spec[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return rule, fmt.Errorf("invalid policy rule %q", raw)
+			}
+			port = rest[1:]
+		}
+	case strings.Count(spec, ":") == 1:
+		host, port = spec[:strings.Index(spec, ":")], spec[strings.Index(spec, ":")+1:]
+	}
+
+	if port != "" && port != "*" {
+		low, high, found := strings.Cut(port, "-")
+		if !found {
+			high = low
+		}
+		var err1, err2 error
+		rule.portLow, err1 = strconv.Atoi(low)
+		rule.portHigh, err2 = strconv.Atoi(high)
+		if err1 != nil || err2 != nil || rule.portLow < 0 || rule.portHigh > 65535 || rule.portLow > rule.portHigh {
+			return rule, fmt.Errorf("invalid port %q in policy rule %q", port, raw)
+		}
+	}
+
+	if strings.Contains(host, "/") {
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, fmt.Errorf("invalid CIDR in policy rule %q: %w", raw, err)
+		}
+		rule.network = network
+		return rule, nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		// A bare address is a single-address block, so it also matches
+		// hostnames that resolve to it
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return rule, nil
+	}
+
+	if _, err := path.Match(host, ""); err != nil {
+		return rule, fmt.Errorf("invalid host pattern in policy rule %q: %w", raw, err)
+	}
+	rule.hostGlob = strings.ToLower(host)
+	return rule, nil
+}
+
+// resolveHost returns the addresses for a target host
+func resolveHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
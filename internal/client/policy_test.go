@@ -0,0 +1,58 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+func TestPolicyCheckDialed(t *testing.T) {
+	policy, err := NewPolicy([]string{"10.0.0.0/8", "*.internal:443"}, []string{"169.254.0.0/16"}, false)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+
+	tests := []struct {
+		target, address string
+		allowed         bool
+	}{
+		{"app.lan:80", "10.1.2.3:80", true},
+		{"app.lan:80", "169.254.169.254:80", false},
+		{"app.lan:80", "192.168.1.10:80", false},
+		{"api.internal:443", "192.168.1.10:443", true},
+		{"api.internal:443", "169.254.169.254:443", false},
+	}
+	for _, test := range tests {
+		err := policy.CheckDialed(test.target, test.address)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("CheckDialed(%q, %q) = %v, want allowed %v", test.target, test.address, err, test.allowed)
+		}
+	}
+}
+
+func TestForwarderDialEnforcesPolicyOnConnectedAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// app.lan passed Check by resolving into the allowed block, then
+	// rebound to loopback by the time it is dialed
+	policy, err := NewPolicy([]string{"10.0.0.0/8"}, nil, false)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	f := NewForwarder(ForwarderConfig{Policy: policy})
+
+	_, err = f.dialer("tcp", "app.lan:"+port, time.Second).Dial("tcp", l.Addr().String())
+	if err == nil {
+		t.Fatalf("dial to %s succeeded despite the policy", l.Addr())
+	}
+	if status := dialStatus(err); status != tunnel.StreamDenied {
+		t.Fatalf("dialStatus = %v, want denied (%v)", status, err)
+	}
+}
@@ -0,0 +1,391 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/models"
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+// poolTargetScheme marks a service target that is a pool of backends
+// defined on the client, such as "pool://web"
+const poolTargetScheme = "pool://"
+
+// Strategies for picking a pool's backend
+const (
+	StrategyRoundRobin = "round-robin" // rotate between healthy backends
+	StrategyLeastConn  = "least-conn"  // the healthy backend with the fewest open streams
+	StrategyFailover   = "failover"    // the first healthy backend, in the order listed
+)
+
+// Health check types
+const (
+	HealthCheckTCP  = "tcp"  // the backend accepts a connection
+	HealthCheckHTTP = "http" // the backend answers a GET with a 2xx or 3xx
+	HealthCheckNone = "none" // backends are only marked down when a dial fails
+)
+
+// Defaults for health checks
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// PoolConfig is a set of local backends that streams for pool://NAME
+// targets are balanced across
+type PoolConfig struct {
+	Backends    []string          `yaml:"backends"`           // host:port, tls://host:port or unix:///path
+	Strategy    string            `yaml:"strategy,omitempty"` // round-robin (default), least-conn or failover
+	HealthCheck HealthCheckConfig `yaml:"health_check,omitempty"`
+}
+
+// HealthCheckConfig configures the checks a client runs against each of a
+// pool's backends
+type HealthCheckConfig struct {
+	Type     string        `yaml:"type,omitempty"`     // tcp (default), http or none
+	Path     string        `yaml:"path,omitempty"`     // request path for http checks (default /)
+	Interval time.Duration `yaml:"interval,omitempty"` // default 10s
+	Timeout  time.Duration `yaml:"timeout,omitempty"`  // default 2s
+}
+
+// Validate checks a pool's settings without touching the network
+func (p PoolConfig) Validate() error {
+	if len(p.Backends) == 0 {
+		return fmt.Errorf("backends are required")
+	}
+	for _, backend := range p.Backends {
+		if err := validateBackend(backend); err != nil {
+			return err
+		}
+	}
+
+	switch p.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConn, StrategyFailover:
+	default:
+		return fmt.Errorf("strategy must be %s, %s or %s", StrategyRoundRobin, StrategyLeastConn, StrategyFailover)
+	}
+
+	switch p.HealthCheck.Type {
+	case "", HealthCheckTCP, HealthCheckHTTP, HealthCheckNone:
+	default:
+		return fmt.Errorf("health check type must be %s, %s or %s", HealthCheckTCP, HealthCheckHTTP, HealthCheckNone)
+	}
+	if p.HealthCheck.Path != "" && !strings.HasPrefix(p.HealthCheck.Path, "/") {
+		return fmt.Errorf("health check path must start with /")
+	}
+	if p.HealthCheck.Interval < 0 || p.HealthCheck.Timeout < 0 {
+		return fmt.Errorf("health check interval and timeout cannot be negative")
+	}
+	return nil
+}
+
+// ValidatePoolName checks the NAME of a pool://NAME target
+func ValidatePoolName(name string) error {
+	if name == "" {
+		return fmt.Errorf("pool name is required")
+	}
+	if !tunnel.ValidTargetName(name) {
+		return fmt.Errorf("pool name %q may only contain letters, digits, '-', '_' and '.'", name)
+	}
+	return nil
+}
+
+// validateBackend checks that a backend is a target the forwarder can dial
+func validateBackend(backend string) error {
+	network, addr, _ := splitTarget(backend)
+	if network == "unix" {
+		if !strings.HasPrefix(addr, "/") {
+			return fmt.Errorf("backend %q needs an absolute socket path", backend)
+		}
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return fmt.Errorf("backend %q is not a host:port, tls://host:port or unix:///path", backend)
+	}
+	return nil
+}
+
+// pool balances streams across backends, skipping the unhealthy ones
+type pool struct {
+	name     string
+	strategy string
+	check    HealthCheckConfig
+	backends []*backend
+	next     atomic.Uint64 // round-robin position
+
+	// onChange is called after a backend's health changes
+	onChange func()
+}
+
+// backend is one target in a pool. Backends start out healthy.
+type backend struct {
+	target string
+	active atomic.Int64 // open streams
+
+	mu        sync.Mutex
+	healthy   bool
+	since     time.Time
+	lastError string
+}
+
+// newPool creates a pool from validated settings, filling in defaults
+func newPool(name string, config PoolConfig) *pool {
+	p := &pool{name: name, strategy: config.Strategy, check: config.HealthCheck}
+	if p.strategy == "" {
+		p.strategy = StrategyRoundRobin
+	}
+	if p.check.Type == "" {
+		p.check.Type = HealthCheckTCP
+	}
+	if p.check.Path == "" {
+		p.check.Path = "/"
+	}
+	if p.check.Interval == 0 {
+		p.check.Interval = DefaultHealthCheckInterval
+	}
+	if p.check.Timeout == 0 {
+		p.check.Timeout = DefaultHealthCheckTimeout
+	}
+
+	now := time.Now()
+	for _, target := range config.Backends {
+		p.backends = append(p.backends, &backend{target: target, healthy: true, since: now})
+	}
+	return p
+}
+
+// candidates returns the backends in the order a new stream should try
+// them: the healthy ones as the strategy orders them, then the unhealthy
+// ones as a last resort
+func (p *pool) candidates() []*backend {
+	var healthy, unhealthy []*backend
+	for _, b := range p.backends {
+		if b.isHealthy() {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if len(healthy) > 1 {
+			start := int((p.next.Add(1) - 1) % uint64(len(healthy)))
+			healthy = append(slices.Clone(healthy[start:]), healthy[:start]...)
+		}
+	case StrategyLeastConn:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].active.Load() < healthy[j].active.Load()
+		})
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// setHealth records the outcome of a check or dial, logging and reporting
+// backends whose health changed
+func (p *pool) setHealth(b *backend, err error) {
+	b.mu.Lock()
+	changed := b.healthy != (err == nil)
+	b.healthy = err == nil
+	b.lastError = ""
+	if err != nil {
+		b.lastError = err.Error()
+	}
+	if changed {
+		b.since = time.Now()
+	}
+	b.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if err != nil {
+		log.Printf("Pool %s: backend %s is unhealthy: %v", p.name, b.target, err)
+	} else {
+		log.Printf("Pool %s: backend %s is healthy", p.name, b.target)
+	}
+	if p.onChange != nil {
+		p.onChange()
+	}
+}
+
+// health returns a snapshot of the pool's backends
+func (p *pool) health() models.PoolHealth {
+	health := models.PoolHealth{Name: p.name, Strategy: p.strategy}
+	for _, b := range p.backends {
+		b.mu.Lock()
+		health.Backends = append(health.Backends, models.BackendHealth{
+			Target:    b.target,
+			Healthy:   b.healthy,
+			Since:     b.since,
+			LastError: b.lastError,
+		})
+		b.mu.Unlock()
+	}
+	return health
+}
+
+// runChecks checks every backend once per interval until ctx is done
+func (p *pool) runChecks(ctx context.Context, f *Forwarder) {
+	if p.check.Type == HealthCheckNone {
+		return
+	}
+
+	ticker := time.NewTicker(p.check.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				p.setHealth(b, p.checkBackend(f, b))
+			}(b)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackend runs one health check against a backend
+func (p *pool) checkBackend(f *Forwarder, b *backend) error {
+	network, addr, useTLS := splitTarget(b.target)
+	if err := f.checkTarget(network, addr); err != nil {
+		return err
+	}
+
+	conn, err := f.dialTimeout(network, addr, useTLS, p.check.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if p.check.Type != HealthCheckHTTP {
+		return nil
+	}
+
+	host := addr
+	if network == "unix" {
+		host = "localhost"
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+p.check.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "picotunnel-health-check")
+	req.Close = true
+
+	conn.SetDeadline(time.Now().Add(p.check.Timeout))
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// dialPool connects to a backend of the named pool, trying backends in
+// the order the pool's strategy picks. A backend that fails to connect is
+// marked unhealthy and the next one is tried. On failure the error is a
+// *tunnel.StreamError describing the last attempt.
+func (f *Forwarder) dialPool(name string) (net.Conn, string, error) {
+	p := f.pools[name]
+	if p == nil {
+		return nil, "", &tunnel.StreamError{Status: tunnel.StreamDialRefused, Message: fmt.Sprintf("no pool named %q", name)}
+	}
+
+	status, message := tunnel.StreamDenied, ""
+	for _, b := range p.candidates() {
+		network, addr, useTLS := splitTarget(b.target)
+		if err := f.checkTarget(network, addr); err != nil {
+			message = err.Error()
+			continue
+		}
+
+		conn, err := f.dial(network, addr, useTLS)
+		if err != nil {
+			status, message = dialStatus(err), err.Error()
+			if status != tunnel.StreamDenied {
+				p.setHealth(b, err)
+			}
+			continue
+		}
+		if p.check.Type == HealthCheckNone {
+			// Without checks, a working dial is what brings a backend back
+			p.setHealth(b, nil)
+		}
+
+		b.active.Add(1)
+		return &poolConn{Conn: conn, backend: b}, b.target, nil
+	}
+	return nil, "", &tunnel.StreamError{Status: status, Message: fmt.Sprintf("no backend of pool %q is reachable: %s", name, message)}
+}
+
+// PoolHealth returns the health of every pool, sorted by name
+func (f *Forwarder) PoolHealth() []models.PoolHealth {
+	names := make([]string, 0, len(f.pools))
+	for name := range f.pools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	health := make([]models.PoolHealth, 0, len(names))
+	for _, name := range names {
+		health = append(health, f.pools[name].health())
+	}
+	return health
+}
+
+// poolConn is a connection to a pool backend, counted as one of its open
+// streams until closed
+type poolConn struct {
+	net.Conn
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.closeOnce.Do(func() { c.backend.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the backend connection when it supports it, so
+// pooled targets shut down like direct ones
+func (c *poolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return net.ErrClosed
+}
+
+// isHealthy returns whether the backend passed its last check
+func (b *backend) isHealthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/models"
+	"github.com/jclement/picotunnel/internal/tunnel"
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is a client configuration file defining several named tunnel
+// profiles that run side by side in one process:
+//
+//	tunnels:
+//	  home:
+//	    server: tunnel.example.com:8443
+//	    token_file: /etc/picotunnel/home.token
+//	    allow: ["localhost:*"]
+//	  lab:
+//	    server: tls://lab.example.com:8444
+//	    token: abc123
+//	    ca_file: /etc/picotunnel/lab-ca.pem
+//	    services:
+//	      - type: http
+//	        domain: app.lab.example.com
+//	        target_addr: tls://localhost:3443
+//	    upstream_tls:
+//	      "localhost:3443":
+//	        ca_file: /etc/ssl/lab-ca.pem
+//	    static:
+//	      docs:
+//	        path: /srv/docs
+//	        listing: true
+//	    pools:
+//	      web:
+//	        backends: ["localhost:3000", "localhost:3001"]
+//	        strategy: least-conn
+//	        health_check:
+//	          type: http
+//	          path: /healthz
+type FileConfig struct {
+	Tunnels map[string]ProfileConfig `yaml:"tunnels"`
+}
+
+// ProfileConfig holds the settings for one tunnel profile
+type ProfileConfig struct {
+	Server    string `yaml:"server"`
+	Token     string `yaml:"token,omitempty"`
+	TokenFile string `yaml:"token_file,omitempty"`
+	Insecure  bool   `yaml:"insecure,omitempty"`  // skip verifying the server's certificate
+	Plaintext bool   `yaml:"plaintext,omitempty"` // connect without TLS
+	Proxy     string `yaml:"proxy,omitempty"`     // overrides --proxy for this profile
+
+	// TLS options for the server connection: ca_file, pins, cert_file and
+	// key_file
+	TLS ServerTLSConfig `yaml:",inline"`
+
+	// Target policy, as for the --allow, --deny and --default-deny flags
+	Allow       []string `yaml:"allow,omitempty"`
+	Deny        []string `yaml:"deny,omitempty"`
+	DefaultDeny bool     `yaml:"default_deny,omitempty"`
+
+	// Timeouts override the process-wide values when set
+	DrainTimeout time.Duration `yaml:"drain_timeout,omitempty"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout,omitempty"`
+
+	// UpstreamTLS holds the options for tls:// targets, keyed by host:port
+	// ("*" for the default)
+	UpstreamTLS map[string]UpstreamTLSConfig `yaml:"upstream_tls,omitempty"`
+
+	// Services are declared to the server on connect. Leaving the key out
+	// keeps services under the server's control; an empty list removes
+	// the ones declared before.
+	Services []models.ServiceDeclaration `yaml:"services"`
+
+	// Static holds directories served to static://NAME targets, keyed by
+	// NAME
+	Static map[string]StaticDir `yaml:"static,omitempty"`
+
+	// Pools holds the backends that pool://NAME targets are balanced
+	// across, keyed by NAME
+	Pools map[string]PoolConfig `yaml:"pools,omitempty"`
+}
+
+// LoadConfigFile reads and validates a client configuration file
+func LoadConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config FileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if len(config.Tunnels) == 0 {
+		return nil, fmt.Errorf("config file %s defines no tunnels", path)
+	}
+	for _, name := range config.Names() {
+		if err := config.Tunnels[name].validate(); err != nil {
+			return nil, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+	}
+
+	return &config, nil
+}
+
+// Names returns the profile names in sorted order
+func (f *FileConfig) Names() []string {
+	names := make([]string, 0, len(f.Tunnels))
+	for name := range f.Tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks the settings that can be checked without touching the
+// filesystem
+func (p ProfileConfig) validate() error {
+	if p.Server == "" {
+		return fmt.Errorf("server is required")
+	}
+	if p.Token == "" && p.TokenFile == "" {
+		return fmt.Errorf("token or token_file is required")
+	}
+	if p.Token != "" && p.TokenFile != "" {
+		return fmt.Errorf("token and token_file are mutually exclusive")
+	}
+	if p.Proxy != "" {
+		if _, err := tunnel.ParseProxyURL(p.Proxy); err != nil {
+			return err
+		}
+	}
+	if err := p.TLS.Validate(); err != nil {
+		return err
+	}
+	if _, err := NewPolicy(p.Allow, p.Deny, p.DefaultDeny); err != nil {
+		return err
+	}
+	for target, options := range p.UpstreamTLS {
+		if err := options.Validate(); err != nil {
+			return fmt.Errorf("upstream_tls %q: %w", target, err)
+		}
+	}
+	for _, service := range p.Services {
+		if service.Type == "" || service.TargetAddr == "" {
+			return fmt.Errorf("services need a type and target_addr")
+		}
+	}
+	for name, dir := range p.Static {
+		if err := ValidateStaticName(name); err != nil {
+			return err
+		}
+		if err := dir.Validate(); err != nil {
+			return fmt.Errorf("static %q: %w", name, err)
+		}
+	}
+	for name, pool := range p.Pools {
+		if err := ValidatePoolName(name); err != nil {
+			return err
+		}
+		if err := pool.Validate(); err != nil {
+			return fmt.Errorf("pool %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveToken returns the profile's token, reading it from token_file if
+// needed. The file is read on every call so a reload picks up a rotated
+// token.
+func (p ProfileConfig) resolveToken() (string, error) {
+	if p.TokenFile == "" {
+		return p.Token, nil
+	}
+
+	data, err := os.ReadFile(p.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", p.TokenFile)
+	}
+	return token, nil
+}
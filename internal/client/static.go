@@ -0,0 +1,202 @@
+package client
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+// staticTargetScheme marks a service target that is a directory served by
+// the client itself, such as "static://site"
+const staticTargetScheme = "static://"
+
+// StaticDir is a local directory the client serves over HTTP to services
+// whose target is static://NAME
+type StaticDir struct {
+	Path    string `yaml:"path"`
+	Listing bool   `yaml:"listing,omitempty"` // list directories that have no index.html
+
+	// Basic auth credentials required for every request (both or neither)
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// Validate checks a directory's settings without touching the filesystem
+func (d StaticDir) Validate() error {
+	if d.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if (d.Username == "") != (d.Password == "") {
+		return fmt.Errorf("username and password must be set together")
+	}
+	return nil
+}
+
+// ValidateStaticName checks the NAME of a static://NAME target
+func ValidateStaticName(name string) error {
+	if name == "" {
+		return fmt.Errorf("static directory name is required")
+	}
+	if !tunnel.ValidTargetName(name) {
+		return fmt.Errorf("static directory name %q may only contain letters, digits, '-', '_' and '.'", name)
+	}
+	return nil
+}
+
+// StaticServer serves static:// streams from local directories. Each
+// stream opens its directory afresh, so a directory that is rebuilt or
+// replaced is picked up without a restart. Files are served with range
+// requests and conditional GETs; symlinks leading out of the directory
+// are refused.
+type StaticServer struct {
+	dirs map[string]StaticDir
+}
+
+// NewStaticServer creates a server for directories keyed by name
+func NewStaticServer(dirs map[string]StaticDir) *StaticServer {
+	return &StaticServer{dirs: dirs}
+}
+
+// HandleStream implements tunnel.StreamHandler
+func (s *StaticServer) HandleStream(stream net.Conn, header tunnel.StreamHeader) error {
+	defer stream.Close()
+
+	logPrefix := streamLogPrefix(header)
+	name := strings.TrimPrefix(header.Target, staticTargetScheme)
+
+	dir, ok := s.dirs[name]
+	if !ok {
+		err := fmt.Errorf("no directory is served as %q", name)
+		log.Printf("%sRejected static stream: %v", logPrefix, err)
+		header.Respond(stream, tunnel.StreamDialRefused, err.Error())
+		return err
+	}
+
+	root, err := os.OpenRoot(dir.Path)
+	if err != nil {
+		log.Printf("%sFailed to open %s: %v", logPrefix, dir.Path, err)
+		header.Respond(stream, tunnel.StreamFailed, fmt.Sprintf("failed to open directory for %q", name))
+		return err
+	}
+	defer root.Close()
+
+	if err := header.Respond(stream, tunnel.StreamOK, ""); err != nil {
+		return err
+	}
+
+	log.Printf("%sServing %s from %s", logPrefix, header.Target, dir.Path)
+
+	conn := &staticConn{Conn: stream, remoteAddr: staticAddr(header.RemoteAddr), closed: make(chan struct{})}
+	server := &http.Server{
+		Handler:           dir.handler(root),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ErrorLog:          log.New(log.Writer(), logPrefix, log.Flags()),
+	}
+	server.Serve(&staticListener{conn: conn})
+
+	log.Printf("%sStream to %s completed", logPrefix, header.Target)
+	return nil
+}
+
+// handler serves the files under root, enforcing the directory's listing
+// and auth settings
+func (d StaticDir) handler(root *os.Root) http.Handler {
+	handler := http.FileServerFS(staticFS{FS: root.FS(), listing: d.Listing})
+
+	if d.Username == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(d.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(d.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="picotunnel", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// staticFS opens files under a directory for the file server. Directories
+// without an index.html are hidden unless listing is on, and paths that
+// escape the directory answer 404 like missing files rather than 500.
+type staticFS struct {
+	fs.FS
+	listing bool
+}
+
+func (f staticFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	if f.listing {
+		return file, nil
+	}
+	if info, err := file.Stat(); err == nil && info.IsDir() {
+		if _, err := fs.Stat(f.FS, path.Join(name, "index.html")); err != nil {
+			file.Close()
+			return nil, fs.ErrNotExist
+		}
+	}
+	return file, nil
+}
+
+// staticListener hands its one connection to an http.Server, then blocks
+// until that connection is closed so Serve returns once it is done
+type staticListener struct {
+	conn *staticConn
+	once sync.Once
+}
+
+func (l *staticListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.conn.closed
+	return nil, net.ErrClosed
+}
+
+func (l *staticListener) Close() error   { return nil }
+func (l *staticListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// staticConn is a stream that reports the original client's address and
+// signals when it is closed
+type staticConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func (c *staticConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *staticConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// staticAddr is the remote address carried in a stream header
+type staticAddr string
+
+func (staticAddr) Network() string  { return "tcp" }
+func (a staticAddr) String() string { return string(a) }
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// TargetStatus describes the streams forwarded to one target
+type TargetStatus struct {
+	Target          string `json:"target"`
+	ActiveStreams   int64  `json:"active_streams"`
+	TotalStreams    int64  `json:"total_streams"`
+	BytesToTarget   int64  `json:"bytes_to_target"`
+	BytesFromTarget int64  `json:"bytes_from_target"`
+}
+
+// forwarderStats counts streams and bytes per target. Counters live as
+// long as the forwarder, so they survive reconnects.
+type forwarderStats struct {
+	targets map[string]*targetCounters
+	mu      sync.Mutex
+}
+
+// targetCounters are the live counters behind a TargetStatus
+type targetCounters struct {
+	active     atomic.Int64
+	total      atomic.Int64
+	toTarget   atomic.Int64
+	fromTarget atomic.Int64
+}
+
+// streamStarted counts a new stream to a target and returns its counters
+func (s *forwarderStats) streamStarted(target string) *targetCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.targets == nil {
+		s.targets = make(map[string]*targetCounters)
+	}
+	counters, exists := s.targets[target]
+	if !exists {
+		counters = &targetCounters{}
+		s.targets[target] = counters
+	}
+
+	counters.active.Add(1)
+	counters.total.Add(1)
+	return counters
+}
+
+// snapshot returns the current counters, sorted by target
+func (s *forwarderStats) snapshot() []TargetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]TargetStatus, 0, len(s.targets))
+	for target, counters := range s.targets {
+		statuses = append(statuses, TargetStatus{
+			Target:          target,
+			ActiveStreams:   counters.active.Load(),
+			TotalStreams:    counters.total.Load(),
+			BytesToTarget:   counters.toTarget.Load(),
+			BytesFromTarget: counters.fromTarget.Load(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Target < statuses[j].Target
+	})
+	return statuses
+}
+
+// countingConn counts the bytes written to and read from a target
+// connection as they flow, so long-lived streams show up before they end
+type countingConn struct {
+	net.Conn
+	counters *targetCounters
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counters.fromTarget.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counters.toTarget.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the target connection when it supports it, so
+// wrapping does not change how copies shut down
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return net.ErrClosed
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+// Connection states reported in Status
+const (
+	StateConnecting   = "connecting"   // no connection has succeeded yet
+	StateConnected    = "connected"    // a connection is up
+	StateReconnecting = "reconnecting" // the connection was lost and is being retried
+	StateStopped      = "stopped"      // the client is shutting down
+)
+
+// Status is a snapshot of a client's connection and traffic
+type Status struct {
+	Name        string     `json:"name,omitempty"`
+	State       string     `json:"state"`
+	Server      string     `json:"server"`
+	StartedAt   time.Time  `json:"started_at"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	Reconnects  int64      `json:"reconnects"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	LastPing    *time.Time `json:"last_ping,omitempty"`
+	RTTMillis   float64    `json:"rtt_ms"`
+
+	ActiveStreams int            `json:"active_streams"`
+	Targets       []TargetStatus `json:"targets"`
+
+	Pools []models.PoolHealth `json:"pools,omitempty"`
+}
+
+// Ready reports whether the client can currently forward streams
+func (s Status) Ready() bool {
+	return s.State == StateConnected
+}
+
+// Status returns a snapshot of the client's state
+func (c *Client) Status() Status {
+	c.mu.RLock()
+	status := Status{
+		Name:       c.name,
+		Server:     c.serverAddr,
+		StartedAt:  c.startedAt,
+		Reconnects: c.reconnects,
+		LastError:  c.lastError,
+		Targets:    c.forwarder.Targets(),
+		Pools:      c.forwarder.PoolHealth(),
+	}
+	if !c.lastErrorAt.IsZero() {
+		lastErrorAt := c.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	conn, stopping, connected := c.conn, c.stopping, c.connected
+	c.mu.RUnlock()
+
+	switch {
+	case stopping:
+		status.State = StateStopped
+	case conn != nil && !conn.IsClosed():
+		status.State = StateConnected
+		connectedAt, lastPing := conn.ConnectedAt(), conn.LastPing()
+		status.ConnectedAt = &connectedAt
+		status.LastPing = &lastPing
+		status.RTTMillis = float64(conn.RTT().Microseconds()) / 1000
+		status.ActiveStreams = conn.NumStreams()
+	case connected:
+		status.State = StateReconnecting
+	default:
+		status.State = StateConnecting
+	}
+
+	return status
+}
+
+// StatusResponse is the body served by the status endpoint
+type StatusResponse struct {
+	Version string   `json:"version"`
+	Ready   bool     `json:"ready"`
+	Tunnels []Status `json:"tunnels"`
+}
+
+// NewStatusHandler serves the local status endpoint for one or more
+// clients:
+//
+//	GET /status   JSON snapshot of every tunnel
+//	GET /healthz  liveness: 200 while the process is running its tunnels
+//	GET /readyz   readiness: 200 once every tunnel is connected, else 503
+func NewStatusHandler(version string, statuses func() []Status) http.Handler {
+	response := func() StatusResponse {
+		tunnels := statuses()
+		ready := len(tunnels) > 0
+		for _, status := range tunnels {
+			ready = ready && status.Ready()
+		}
+		return StatusResponse{Version: version, Ready: ready, Tunnels: tunnels}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeStatusJSON(w, http.StatusOK, response())
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		for _, status := range statuses() {
+			if status.State != StateStopped {
+				writeStatusJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+				return
+			}
+		}
+		writeStatusJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "stopped"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		resp := response()
+		code := http.StatusOK
+		if !resp.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeStatusJSON(w, code, resp)
+	})
+	return localOnly(mux)
+}
+
+// localOnly refuses requests whose Host header is not localhost or an IP
+// address. Binding to loopback keeps other machines out, but a web page
+// the user visits can point a DNS name it controls at 127.0.0.1 (DNS
+// rebinding) and read the endpoint as its own origin; such requests carry
+// that name in Host. IP addresses stay allowed so probes can use a pod IP.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if !strings.EqualFold(host, "localhost") && net.ParseIP(host) == nil {
+			writeStatusJSON(w, http.StatusForbidden, map[string]string{"error": "host not allowed"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeStatusJSON writes a JSON response with the given status code
+func writeStatusJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
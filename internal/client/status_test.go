@@ -0,0 +1,26 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusHandlerRefusesForeignHosts(t *testing.T) {
+	handler := NewStatusHandler("test", func() []Status { return nil })
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Host = "rebind.attacker.example:9090"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("GET /healthz with a foreign Host = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	req.Host = "10.0.0.5:9090"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code == http.StatusForbidden {
+		t.Fatalf("GET /healthz by pod IP was refused")
+	}
+}
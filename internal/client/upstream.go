@@ -0,0 +1,90 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsTargetScheme marks a service target whose upstream speaks TLS, such
+// as "tls://app.internal:8443". The forwarder terminates the tunnel stream
+// in plaintext and dials the target over TLS.
+const tlsTargetScheme = "tls://"
+
+// UpstreamTLSConfig holds the options for dialing a tls:// target. Options
+// are keyed by the target's host:port; the key "*" applies to tls://
+// targets with no entry of their own.
+type UpstreamTLSConfig struct {
+	ServerName         string `yaml:"server_name,omitempty"`          // SNI and verified name, instead of the target host
+	CAFile             string `yaml:"ca_file,omitempty"`              // PEM bundle to verify the target with, instead of the system roots
+	CertFile           string `yaml:"cert_file,omitempty"`            // client certificate for mutual TLS
+	KeyFile            string `yaml:"key_file,omitempty"`             // client certificate key
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"` // do not verify the target's certificate
+}
+
+// upstreamTLS returns the options configured for a TLS target
+func (f *Forwarder) upstreamTLS(addr string) UpstreamTLSConfig {
+	if options, exists := f.upstreamTLSConfigs[addr]; exists {
+		return options
+	}
+	return f.upstreamTLSConfigs["*"]
+}
+
+// dialTLS connects to a target and completes the TLS handshake. The
+// certificate files are read on every dial, so rotated files are picked up
+// without a restart.
+func (f *Forwarder) dialTLS(addr string, timeout time.Duration) (net.Conn, error) {
+	config, err := f.upstreamTLS(addr).tlsConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.DialWithDialer(f.dialer("tcp", addr, timeout), "tcp", addr, config)
+}
+
+// tlsConfig builds the TLS configuration for dialing addr
+func (u UpstreamTLSConfig) tlsConfig(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS target %q: %w", addr, err)
+	}
+
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+	if u.ServerName != "" {
+		config.ServerName = u.ServerName
+	}
+
+	if u.CAFile != "" {
+		pem, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA %s", u.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if u.CertFile != "" || u.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Validate checks that the options' files can be loaded
+func (u UpstreamTLSConfig) Validate() error {
+	_, err := u.tlsConfig("localhost:0")
+	return err
+}
@@ -12,20 +12,87 @@ type Tunnel struct {
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 	Connected bool      `json:"connected" db:"-"` // Runtime status, not stored
+
+	// Limits on services declared by the tunnel's clients
+	ClientServices bool     `json:"client_services" db:"client_services"` // clients may declare services
+	MaxServices    int      `json:"max_services" db:"max_services"`       // 0 for no limit
+	DomainSuffixes []string `json:"domain_suffixes" db:"domain_suffixes"` // domains HTTP services may use
+	PortRange      string   `json:"port_range" db:"port_range"`           // ports TCP/UDP services may listen on, e.g. "20000-20099"
+
+	// Ephemeral tunnels are created ad hoc by a client exposing a local
+	// port, and deleted once that client has been gone for a while
+	Ephemeral bool `json:"ephemeral" db:"ephemeral"`
 }
 
 // Service represents a service within a tunnel
 type Service struct {
 	ID          string    `json:"id" db:"id"`
 	TunnelID    string    `json:"tunnel_id" db:"tunnel_id"`
-	Type        string    `json:"type" db:"type"` // "http" or "tcp"
+	Type        string    `json:"type" db:"type"` // "http", "tcp" or "udp"
 	Domain      string    `json:"domain" db:"domain"`
 	PathPrefix  string    `json:"path_prefix" db:"path_prefix"`
 	TLSMode     string    `json:"tls_mode" db:"tls_mode"`     // "terminate" or "passthrough"
-	ListenAddr  string    `json:"listen_addr" db:"listen_addr"` // for TCP services
+	ListenAddr  string    `json:"listen_addr" db:"listen_addr"` // for TCP and UDP services
 	TargetAddr  string    `json:"target_addr" db:"target_addr"`
 	Enabled     bool      `json:"enabled" db:"enabled"`
+	Source      string    `json:"source" db:"source"` // "api", or "client" when declared by the tunnel client
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+
+	// Rewrites applied to HTTP requests before they reach the target
+	HostHeader    string            `json:"host_header" db:"host_header"`       // Host sent to the target; the public domain if empty
+	SetHeaders    map[string]string `json:"set_headers" db:"set_headers"`       // request headers added or replaced
+	RemoveHeaders []string          `json:"remove_headers" db:"remove_headers"` // request headers removed
+	RewritePrefix string            `json:"rewrite_prefix" db:"rewrite_prefix"` // replaces PathPrefix in the request path
+
+	TargetFailures int64 `json:"target_failures" db:"-"` // Runtime counter, not stored
+}
+
+// ConnectionInfo describes a live client connection to a tunnel
+type ConnectionInfo struct {
+	ID            string    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	LastPing      time.Time `json:"last_ping"`
+	ActiveStreams int       `json:"active_streams"`
+	Draining      bool      `json:"draining"`
+	Hostname      string    `json:"hostname"`
+	ClientVersion string    `json:"client_version"`
+	OS            string    `json:"os"`
+	Arch          string    `json:"arch"`
+
+	Pools []PoolHealth `json:"pools,omitempty"` // backend pools, as last reported by the client
+}
+
+// PoolHealth is the state of a client-side pool of backends, reported by
+// the client whenever a backend's health changes
+type PoolHealth struct {
+	Name     string          `json:"name"`
+	Strategy string          `json:"strategy"`
+	Backends []BackendHealth `json:"backends"`
+}
+
+// BackendHealth is the state of one backend in a pool
+type BackendHealth struct {
+	Target    string    `json:"target"`
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since"`                // when the backend became healthy or unhealthy
+	LastError string    `json:"last_error,omitempty"` // why the backend is unhealthy
+}
+
+// ExposeRequest asks the server for an ephemeral tunnel with one service,
+// as sent by "picotunnel-client http 3000"
+type ExposeRequest struct {
+	Type       string `json:"type"`        // "http", "tcp" or "udp"
+	TargetAddr string `json:"target_addr"` // address the client forwards to
+}
+
+// Exposure describes the ephemeral tunnel created for an ExposeRequest
+type Exposure struct {
+	TunnelID     string   `json:"tunnel_id"`
+	Token        string   `json:"token"`
+	Service      *Service `json:"service"`
+	URL          string   `json:"url"`           // where the service can be reached, e.g. http://3f9a1c2e.dev.example.com
+	GraceSeconds int      `json:"grace_seconds"` // how long the tunnel outlives its client before it is deleted
 }
 
 // Check represents an uptime check result
@@ -40,8 +107,60 @@ type Check struct {
 
 // TunnelMessage represents the message format for tunnel protocol
 type TunnelMessage struct {
-	Type   string `json:"type"`   // "stream", "ping", "pong"
-	Target string `json:"target"` // target address for stream connections
+	Type    string   `json:"type"`              // "hello", "welcome", "reject", "ping", "pong", "drain" or "health"
+	Target  string   `json:"target"`            // target address for stream connections
+	Reason  string   `json:"reason,omitempty"`  // rejection reason
+	Hello   *Hello   `json:"hello,omitempty"`   // client handshake
+	Welcome *Welcome `json:"welcome,omitempty"` // server handshake reply
+
+	Health []PoolHealth `json:"health,omitempty"` // client pool health
+}
+
+// Hello is the first control message sent by a client after connecting
+type Hello struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Token           string   `json:"token,omitempty"` // authenticates transports without an HTTP upgrade
+	ClientVersion   string   `json:"client_version"`
+	Hostname        string   `json:"hostname"`
+	OS              string   `json:"os"`
+	Arch            string   `json:"arch"`
+	StreamTypes     []string `json:"stream_types"`       // handler types registered by the client
+	Features        []string `json:"features,omitempty"` // optional protocol features the client supports
+
+	Services []ServiceDeclaration `json:"services,omitempty"` // services the client asks the server to expose
+}
+
+// ServiceDeclaration is a service a client declares in its hello. The
+// server creates or updates it within the limits set on the tunnel.
+type ServiceDeclaration struct {
+	Type       string `json:"type" yaml:"type"`                                   // "http", "tcp" or "udp"
+	Domain     string `json:"domain,omitempty" yaml:"domain,omitempty"`           // for HTTP
+	PathPrefix string `json:"path_prefix,omitempty" yaml:"path_prefix,omitempty"` // for HTTP
+	ListenPort int    `json:"listen_port,omitempty" yaml:"listen_port,omitempty"` // for TCP and UDP
+	TargetAddr string `json:"target_addr" yaml:"target_addr"`
+
+	// Rewrites for HTTP services; see Service
+	HostHeader    string            `json:"host_header,omitempty" yaml:"host_header,omitempty"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty" yaml:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty" yaml:"remove_headers,omitempty"`
+	RewritePrefix string            `json:"rewrite_prefix,omitempty" yaml:"rewrite_prefix,omitempty"`
+}
+
+// ServiceResult reports what the server did with a declared service
+type ServiceResult struct {
+	Declaration ServiceDeclaration `json:"declaration"`
+	ServiceID   string             `json:"service_id,omitempty"`
+	Status      string             `json:"status"`           // "created", "updated", "unchanged" or "rejected"
+	Reason      string             `json:"reason,omitempty"` // why the service was rejected
+}
+
+// Welcome is the server's reply to an accepted Hello
+type Welcome struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	ServerVersion   string   `json:"server_version"`
+	Features        []string `json:"features,omitempty"` // features enabled for this connection
+
+	Services []ServiceResult `json:"services,omitempty"` // outcome of the client's declared services
 }
 
 // UptimeStats represents uptime statistics
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jclement/picotunnel/internal/models"
@@ -17,6 +18,7 @@ type APIHandler struct {
 	store         *Store
 	tunnelManager *TunnelManager
 	proxyManager  *ProxyManager
+	expose        ExposeConfig
 }
 
 // NewAPIHandler creates a new API handler
@@ -47,12 +49,17 @@ func (api *APIHandler) RegisterRoutes(mux *http.ServeMux) {
 	// Stats routes
 	mux.HandleFunc("GET /api/tunnels/{id}/checks", api.getChecks)
 	mux.HandleFunc("GET /api/tunnels/{id}/stats", api.getStats)
+
+	// Ephemeral tunnel routes, for clients holding the API token
+	mux.HandleFunc("POST /api/expose", api.requireAPIToken(api.createExposure))
+	mux.HandleFunc("DELETE /api/expose/{id}", api.requireAPIToken(api.deleteExposure))
 }
 
 // TunnelResponse represents a tunnel with runtime status
 type TunnelResponse struct {
 	*models.Tunnel
-	Connected bool `json:"connected"`
+	Connected   bool                    `json:"connected"`
+	Connections []models.ConnectionInfo `json:"connections"`
 }
 
 // listTunnels handles GET /api/tunnels
@@ -67,8 +74,9 @@ func (api *APIHandler) listTunnels(w http.ResponseWriter, r *http.Request) {
 	var response []*TunnelResponse
 	for _, tunnel := range tunnels {
 		tr := &TunnelResponse{
-			Tunnel:    tunnel,
-			Connected: api.tunnelManager.IsConnected(tunnel.ID),
+			Tunnel:      tunnel,
+			Connected:   api.tunnelManager.IsConnected(tunnel.ID),
+			Connections: api.tunnelManager.Connections(tunnel.ID),
 		}
 		response = append(response, tr)
 	}
@@ -108,11 +116,12 @@ func (api *APIHandler) createTunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tunnel := &models.Tunnel{
-		ID:        id,
-		Name:      req.Name,
-		Token:     token,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:             id,
+		Name:           req.Name,
+		Token:          token,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		DomainSuffixes: []string{},
 	}
 
 	if err := api.store.CreateTunnel(tunnel); err != nil {
@@ -121,8 +130,9 @@ func (api *APIHandler) createTunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := &TunnelResponse{
-		Tunnel:    tunnel,
-		Connected: false,
+		Tunnel:      tunnel,
+		Connected:   false,
+		Connections: []models.ConnectionInfo{},
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -140,8 +150,9 @@ func (api *APIHandler) getTunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := &TunnelResponse{
-		Tunnel:    tunnel,
-		Connected: api.tunnelManager.IsConnected(tunnel.ID),
+		Tunnel:      tunnel,
+		Connected:   api.tunnelManager.IsConnected(tunnel.ID),
+		Connections: api.tunnelManager.Connections(tunnel.ID),
 	}
 
 	api.sendJSON(w, response)
@@ -150,6 +161,12 @@ func (api *APIHandler) getTunnel(w http.ResponseWriter, r *http.Request) {
 // UpdateTunnelRequest represents a request to update a tunnel
 type UpdateTunnelRequest struct {
 	Name string `json:"name"`
+
+	// Limits on client-declared services; omitted fields are unchanged
+	ClientServices *bool     `json:"client_services"`
+	MaxServices    *int      `json:"max_services"`
+	DomainSuffixes *[]string `json:"domain_suffixes"`
+	PortRange      *string   `json:"port_range"`
 }
 
 // updateTunnel handles PATCH /api/tunnels/{id}
@@ -172,6 +189,38 @@ func (api *APIHandler) updateTunnel(w http.ResponseWriter, r *http.Request) {
 		tunnel.Name = req.Name
 		tunnel.UpdatedAt = time.Now()
 	}
+	if req.ClientServices != nil {
+		tunnel.ClientServices = *req.ClientServices
+	}
+	if req.MaxServices != nil {
+		if *req.MaxServices < 0 {
+			api.sendError(w, http.StatusBadRequest, "Max services cannot be negative", nil)
+			return
+		}
+		tunnel.MaxServices = *req.MaxServices
+	}
+	if req.DomainSuffixes != nil {
+		suffixes := []string{}
+		for _, suffix := range *req.DomainSuffixes {
+			if suffix = strings.TrimSpace(suffix); suffix != "" {
+				if strings.Contains(suffix, ",") {
+					api.sendError(w, http.StatusBadRequest, "Domain suffixes cannot contain commas", nil)
+					return
+				}
+				suffixes = append(suffixes, suffix)
+			}
+		}
+		tunnel.DomainSuffixes = suffixes
+	}
+	if req.PortRange != nil {
+		if *req.PortRange != "" {
+			if _, _, err := parsePortRange(*req.PortRange); err != nil {
+				api.sendError(w, http.StatusBadRequest, "Invalid port range", err)
+				return
+			}
+		}
+		tunnel.PortRange = *req.PortRange
+	}
 
 	if err := api.store.UpdateTunnel(tunnel); err != nil {
 		api.sendError(w, http.StatusInternalServerError, "Failed to update tunnel", err)
@@ -179,8 +228,9 @@ func (api *APIHandler) updateTunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := &TunnelResponse{
-		Tunnel:    tunnel,
-		Connected: api.tunnelManager.IsConnected(tunnel.ID),
+		Tunnel:      tunnel,
+		Connected:   api.tunnelManager.IsConnected(tunnel.ID),
+		Connections: api.tunnelManager.Connections(tunnel.ID),
 	}
 
 	api.sendJSON(w, response)
@@ -190,21 +240,8 @@ func (api *APIHandler) updateTunnel(w http.ResponseWriter, r *http.Request) {
 func (api *APIHandler) deleteTunnel(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	// Delete all services first (to stop TCP listeners)
-	services, err := api.store.ListServices(id)
-	if err != nil {
-		api.sendError(w, http.StatusInternalServerError, "Failed to list services", err)
-		return
-	}
-
-	for _, service := range services {
-		if err := api.proxyManager.RemoveTCPService(service); err != nil {
-			// Log error but continue
-			fmt.Printf("Failed to remove TCP service %s: %v", service.ID, err)
-		}
-	}
-
-	if err := api.store.DeleteTunnel(id); err != nil {
+	// Services go first, to stop their TCP and UDP listeners
+	if err := api.proxyManager.RemoveTunnel(id); err != nil {
 		api.sendError(w, http.StatusInternalServerError, "Failed to delete tunnel", err)
 		return
 	}
@@ -233,12 +270,16 @@ func (api *APIHandler) regenerateToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Clients that authenticated with the old token must not stay connected
+	api.tunnelManager.CloseConnections(id)
+
 	tunnel.Token = newToken
 	tunnel.UpdatedAt = time.Now()
 
 	response := &TunnelResponse{
-		Tunnel:    tunnel,
-		Connected: api.tunnelManager.IsConnected(tunnel.ID),
+		Tunnel:      tunnel,
+		Connected:   api.tunnelManager.IsConnected(tunnel.ID),
+		Connections: api.tunnelManager.Connections(tunnel.ID),
 	}
 
 	api.sendJSON(w, response)
@@ -254,18 +295,28 @@ func (api *APIHandler) listServices(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, service := range services {
+		service.TargetFailures = api.proxyManager.TargetFailures(service.ID)
+	}
+
 	api.sendJSON(w, services)
 }
 
 // CreateServiceRequest represents a request to create a service
 type CreateServiceRequest struct {
-	Type        string `json:"type"`        // "http" or "tcp"
+	Type        string `json:"type"`        // "http", "tcp" or "udp"
 	Domain      string `json:"domain"`      // for HTTP
 	PathPrefix  string `json:"path_prefix"` // for HTTP
 	TLSMode     string `json:"tls_mode"`    // for HTTP
-	ListenAddr  string `json:"listen_addr"` // for TCP
+	ListenAddr  string `json:"listen_addr"` // for TCP and UDP
 	TargetAddr  string `json:"target_addr"`
 	Enabled     bool   `json:"enabled"`
+
+	// Rewrites for HTTP services
+	HostHeader    string            `json:"host_header"`
+	SetHeaders    map[string]string `json:"set_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+	RewritePrefix string            `json:"rewrite_prefix"`
 }
 
 // createService handles POST /api/tunnels/{id}/services
@@ -285,8 +336,8 @@ func (api *APIHandler) createService(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if req.Type != "http" && req.Type != "tcp" {
-		api.sendError(w, http.StatusBadRequest, "Type must be 'http' or 'tcp'", nil)
+	if req.Type != "http" && req.Type != "tcp" && req.Type != "udp" {
+		api.sendError(w, http.StatusBadRequest, "Type must be 'http', 'tcp' or 'udp'", nil)
 		return
 	}
 
@@ -295,6 +346,11 @@ func (api *APIHandler) createService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateTargetAddr(req.Type, req.TargetAddr); err != nil {
+		api.sendError(w, http.StatusBadRequest, "Invalid target address", err)
+		return
+	}
+
 	if req.Type == "http" && req.Domain == "" {
 		api.sendError(w, http.StatusBadRequest, "Domain is required for HTTP services", nil)
 		return
@@ -305,6 +361,11 @@ func (api *APIHandler) createService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Type == "udp" && req.ListenAddr == "" {
+		api.sendError(w, http.StatusBadRequest, "Listen address is required for UDP services", nil)
+		return
+	}
+
 	// Set defaults
 	if req.PathPrefix == "" {
 		req.PathPrefix = "/"
@@ -329,7 +390,18 @@ func (api *APIHandler) createService(w http.ResponseWriter, r *http.Request) {
 		ListenAddr:  req.ListenAddr,
 		TargetAddr:  req.TargetAddr,
 		Enabled:     req.Enabled,
+		Source:      "api",
 		CreatedAt:   time.Now(),
+
+		HostHeader:    req.HostHeader,
+		SetHeaders:    req.SetHeaders,
+		RemoveHeaders: req.RemoveHeaders,
+		RewritePrefix: req.RewritePrefix,
+	}
+
+	if err := validateRewrites(service); err != nil {
+		api.sendError(w, http.StatusBadRequest, "Invalid rewrite options", err)
+		return
 	}
 
 	if err := api.store.CreateService(service); err != nil {
@@ -337,10 +409,10 @@ func (api *APIHandler) createService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Start TCP listener if needed
-	if err := api.proxyManager.AddTCPService(service); err != nil {
+	// Start TCP/UDP listener if needed
+	if err := api.proxyManager.AddService(service); err != nil {
 		// Log error but don't fail the request
-		fmt.Printf("Failed to add TCP service %s: %v", service.ID, err)
+		fmt.Printf("Failed to add %s service %s: %v", service.Type, service.ID, err)
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -355,6 +427,12 @@ type UpdateServiceRequest struct {
 	ListenAddr *string `json:"listen_addr"`
 	TargetAddr *string `json:"target_addr"`
 	Enabled    *bool   `json:"enabled"`
+
+	// Rewrites for HTTP services
+	HostHeader    *string            `json:"host_header"`
+	SetHeaders    *map[string]string `json:"set_headers"`
+	RemoveHeaders *[]string          `json:"remove_headers"`
+	RewritePrefix *string            `json:"rewrite_prefix"`
 }
 
 // updateService handles PATCH /api/services/{id}
@@ -373,9 +451,9 @@ func (api *APIHandler) updateService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Remove old TCP listener if needed
+	// Remove old TCP/UDP listener if needed
 	oldListenAddr := service.ListenAddr
-	needsTCPRestart := false
+	needsListenerRestart := false
 
 	// Update fields
 	if req.Domain != nil {
@@ -389,14 +467,34 @@ func (api *APIHandler) updateService(w http.ResponseWriter, r *http.Request) {
 	}
 	if req.ListenAddr != nil {
 		service.ListenAddr = *req.ListenAddr
-		needsTCPRestart = service.Type == "tcp"
+		needsListenerRestart = service.Type == "tcp" || service.Type == "udp"
 	}
 	if req.TargetAddr != nil {
+		if err := validateTargetAddr(service.Type, *req.TargetAddr); err != nil {
+			api.sendError(w, http.StatusBadRequest, "Invalid target address", err)
+			return
+		}
 		service.TargetAddr = *req.TargetAddr
 	}
 	if req.Enabled != nil {
 		service.Enabled = *req.Enabled
-		needsTCPRestart = service.Type == "tcp"
+		needsListenerRestart = service.Type == "tcp" || service.Type == "udp"
+	}
+	if req.HostHeader != nil {
+		service.HostHeader = *req.HostHeader
+	}
+	if req.SetHeaders != nil {
+		service.SetHeaders = *req.SetHeaders
+	}
+	if req.RemoveHeaders != nil {
+		service.RemoveHeaders = *req.RemoveHeaders
+	}
+	if req.RewritePrefix != nil {
+		service.RewritePrefix = *req.RewritePrefix
+	}
+	if err := validateRewrites(service); err != nil {
+		api.sendError(w, http.StatusBadRequest, "Invalid rewrite options", err)
+		return
 	}
 
 	if err := api.store.UpdateService(service); err != nil {
@@ -404,18 +502,18 @@ func (api *APIHandler) updateService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Handle TCP listener changes
-	if needsTCPRestart {
+	// Handle TCP/UDP listener changes
+	if needsListenerRestart {
 		// Remove old listener
 		if oldListenAddr != "" {
 			oldService := *service
 			oldService.ListenAddr = oldListenAddr
-			api.proxyManager.RemoveTCPService(&oldService)
+			api.proxyManager.RemoveService(&oldService)
 		}
 
 		// Add new listener
-		if err := api.proxyManager.AddTCPService(service); err != nil {
-			fmt.Printf("Failed to add TCP service %s: %v", service.ID, err)
+		if err := api.proxyManager.AddService(service); err != nil {
+			fmt.Printf("Failed to add %s service %s: %v", service.Type, service.ID, err)
 		}
 	}
 
@@ -432,9 +530,9 @@ func (api *APIHandler) deleteService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Remove TCP listener
-	if err := api.proxyManager.RemoveTCPService(service); err != nil {
-		fmt.Printf("Failed to remove TCP service %s: %v", service.ID, err)
+	// Remove TCP/UDP listener
+	if err := api.proxyManager.RemoveService(service); err != nil {
+		fmt.Printf("Failed to remove %s service %s: %v", service.Type, service.ID, err)
 	}
 
 	if err := api.store.DeleteService(id); err != nil {
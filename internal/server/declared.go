@@ -0,0 +1,325 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+// SyncDeclaredServices makes a tunnel's client-declared services match the
+// declarations in a client's hello: new services are created, changed ones
+// updated and ones no longer declared removed. Services created through the
+// API are never touched. Each declaration is checked against the limits set
+// on the tunnel, and the outcome is reported back to the client.
+//
+// When several clients serve a tunnel, the most recent hello wins.
+func (pm *ProxyManager) SyncDeclaredServices(tunnelObj *models.Tunnel, declared []models.ServiceDeclaration) []models.ServiceResult {
+	pm.syncMu.Lock()
+	defer pm.syncMu.Unlock()
+
+	results := make([]models.ServiceResult, 0, len(declared))
+
+	all, err := pm.store.ListAllServices()
+	if err != nil {
+		log.Printf("Failed to list services to sync tunnel %s: %v", tunnelObj.Name, err)
+		for _, decl := range declared {
+			results = append(results, rejectDeclaration(decl, "server error"))
+		}
+		return results
+	}
+
+	var owned, others []*models.Service
+	for _, service := range all {
+		if service.TunnelID == tunnelObj.ID && service.Source == "client" {
+			owned = append(owned, service)
+		} else {
+			others = append(others, service)
+		}
+	}
+
+	kept := make(map[string]bool)    // owned service IDs still declared
+	claimed := make(map[string]bool) // declaration keys seen so far
+	for _, decl := range declared {
+		service, err := declaredService(tunnelObj, decl)
+		if err == nil && tunnelObj.MaxServices > 0 && len(claimed) >= tunnelObj.MaxServices {
+			err = fmt.Errorf("tunnel allows at most %d client-declared services", tunnelObj.MaxServices)
+		}
+		if err == nil && claimed[serviceKey(service)] {
+			err = fmt.Errorf("declared more than once")
+		}
+		if err == nil {
+			err = checkServiceConflict(others, service)
+		}
+		if err != nil {
+			log.Printf("Rejected service declared by tunnel %s (%s %s): %v", tunnelObj.Name, decl.Type, declarationName(decl), err)
+			results = append(results, rejectDeclaration(decl, err.Error()))
+			continue
+		}
+		claimed[serviceKey(service)] = true
+
+		var existing *models.Service
+		for _, candidate := range owned {
+			if serviceKey(candidate) == serviceKey(service) {
+				existing = candidate
+				break
+			}
+		}
+
+		result := models.ServiceResult{Declaration: decl}
+		if existing == nil {
+			err = pm.createDeclaredService(service)
+			result.Status = "created"
+		} else if existing.TargetAddr == service.TargetAddr && existing.PathPrefix == service.PathPrefix && sameRewrites(existing, service) {
+			service = existing
+			result.Status = "unchanged"
+		} else {
+			err = pm.updateDeclaredService(existing, service)
+			service = existing
+			result.Status = "updated"
+		}
+		if err != nil {
+			log.Printf("Failed to apply service declared by tunnel %s (%s %s): %v", tunnelObj.Name, decl.Type, declarationName(decl), err)
+			results = append(results, rejectDeclaration(decl, err.Error()))
+			if existing != nil {
+				kept[existing.ID] = true
+			}
+			continue
+		}
+
+		kept[service.ID] = true
+		result.ServiceID = service.ID
+		results = append(results, result)
+	}
+
+	for _, service := range owned {
+		if kept[service.ID] {
+			continue
+		}
+		log.Printf("Removing service %s (%s %s) no longer declared by tunnel %s", service.ID, service.Type, serviceName(service), tunnelObj.Name)
+		if err := pm.RemoveService(service); err != nil {
+			log.Printf("Failed to remove %s service %s: %v", service.Type, service.ID, err)
+		}
+		if err := pm.store.DeleteService(service.ID); err != nil {
+			log.Printf("Failed to delete service %s: %v", service.ID, err)
+		}
+	}
+
+	return results
+}
+
+// createDeclaredService stores a new client-declared service and starts
+// its listener. A service whose listener cannot start is not kept.
+func (pm *ProxyManager) createDeclaredService(service *models.Service) error {
+	id, err := generateRandomID()
+	if err != nil {
+		return fmt.Errorf("failed to generate ID: %w", err)
+	}
+	service.ID = id
+	service.CreatedAt = time.Now()
+
+	if err := pm.store.CreateService(service); err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+
+	if err := pm.AddService(service); err != nil {
+		pm.store.DeleteService(service.ID)
+		return err
+	}
+
+	log.Printf("Created %s service %s (%s) declared by its client", service.Type, service.ID, serviceName(service))
+	return nil
+}
+
+// updateDeclaredService applies a changed declaration to an existing
+// service. Whether the service is enabled stays under the admin's control.
+func (pm *ProxyManager) updateDeclaredService(existing, declared *models.Service) error {
+	existing.TargetAddr = declared.TargetAddr
+	existing.PathPrefix = declared.PathPrefix
+	existing.HostHeader = declared.HostHeader
+	existing.SetHeaders = declared.SetHeaders
+	existing.RemoveHeaders = declared.RemoveHeaders
+	existing.RewritePrefix = declared.RewritePrefix
+
+	if err := pm.store.UpdateService(existing); err != nil {
+		return fmt.Errorf("failed to update service: %w", err)
+	}
+
+	// Listeners hold on to the service they were started for
+	if existing.Type == "tcp" || existing.Type == "udp" {
+		pm.RemoveService(existing)
+		if err := pm.AddService(existing); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Updated %s service %s (%s) declared by its client", existing.Type, existing.ID, serviceName(existing))
+	return nil
+}
+
+// declaredService validates a declaration against the tunnel's limits and
+// returns the service it describes
+func declaredService(tunnelObj *models.Tunnel, decl models.ServiceDeclaration) (*models.Service, error) {
+	if !tunnelObj.ClientServices {
+		return nil, fmt.Errorf("client-declared services are disabled for this tunnel")
+	}
+
+	service := &models.Service{
+		TunnelID:   tunnelObj.ID,
+		Type:       strings.ToLower(decl.Type),
+		PathPrefix: "/",
+		TLSMode:    "terminate",
+		TargetAddr: decl.TargetAddr,
+		Enabled:    true,
+		Source:     "client",
+
+		HostHeader:    decl.HostHeader,
+		SetHeaders:    decl.SetHeaders,
+		RemoveHeaders: decl.RemoveHeaders,
+		RewritePrefix: decl.RewritePrefix,
+	}
+
+	if service.TargetAddr == "" {
+		return nil, fmt.Errorf("target address is required")
+	}
+	if err := validateTargetAddr(service.Type, service.TargetAddr); err != nil {
+		return nil, fmt.Errorf("invalid target address: %w", err)
+	}
+
+	switch service.Type {
+	case "http":
+		service.Domain = strings.ToLower(strings.TrimSuffix(decl.Domain, "."))
+		if service.Domain == "" {
+			return nil, fmt.Errorf("domain is required for HTTP services")
+		}
+		if !domainAllowed(service.Domain, tunnelObj.DomainSuffixes) {
+			if len(tunnelObj.DomainSuffixes) == 0 {
+				return nil, fmt.Errorf("tunnel does not allow client-declared HTTP services")
+			}
+			return nil, fmt.Errorf("domain %s is not under %s", service.Domain, strings.Join(tunnelObj.DomainSuffixes, ", "))
+		}
+		if decl.PathPrefix != "" {
+			if !strings.HasPrefix(decl.PathPrefix, "/") {
+				return nil, fmt.Errorf("path prefix must start with /")
+			}
+			service.PathPrefix = decl.PathPrefix
+		}
+	case "tcp", "udp":
+		if tunnelObj.PortRange == "" {
+			return nil, fmt.Errorf("tunnel does not allow client-declared TCP/UDP services")
+		}
+		low, high, err := parsePortRange(tunnelObj.PortRange)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel has an invalid port range: %w", err)
+		}
+		if decl.ListenPort < low || decl.ListenPort > high {
+			return nil, fmt.Errorf("listen port %d is outside %s", decl.ListenPort, tunnelObj.PortRange)
+		}
+		service.ListenAddr = ":" + strconv.Itoa(decl.ListenPort)
+	default:
+		return nil, fmt.Errorf("type must be 'http', 'tcp' or 'udp'")
+	}
+
+	if err := validateRewrites(service); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// checkServiceConflict reports whether a service would take a domain or
+// port that another service already uses
+func checkServiceConflict(others []*models.Service, service *models.Service) error {
+	for _, other := range others {
+		if other.Type != service.Type {
+			continue
+		}
+		switch service.Type {
+		case "http":
+			if strings.EqualFold(other.Domain, service.Domain) {
+				return fmt.Errorf("domain %s is already in use", service.Domain)
+			}
+		case "tcp", "udp":
+			if listenPort(other.ListenAddr) == listenPort(service.ListenAddr) {
+				return fmt.Errorf("%s port %s is already in use", service.Type, listenPort(service.ListenAddr))
+			}
+		}
+	}
+	return nil
+}
+
+// domainAllowed reports whether a domain equals or falls under one of the
+// suffixes ("example.com", ".example.com" and "*.example.com" are the same)
+func domainAllowed(domain string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(suffix, "*"), "."))
+		if suffix == "" {
+			continue
+		}
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRange parses a port range such as "20000-20099" or a single port
+func parsePortRange(value string) (int, int, error) {
+	lowStr, highStr, found := strings.Cut(strings.TrimSpace(value), "-")
+	if !found {
+		highStr = lowStr
+	}
+
+	low, err1 := strconv.Atoi(strings.TrimSpace(lowStr))
+	high, err2 := strconv.Atoi(strings.TrimSpace(highStr))
+	if err1 != nil || err2 != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return low, high, nil
+}
+
+// serviceKey identifies a service by what it exposes: a domain for HTTP,
+// a port for TCP and UDP
+func serviceKey(service *models.Service) string {
+	if service.Type == "http" {
+		return "http " + strings.ToLower(service.Domain)
+	}
+	return service.Type + " " + listenPort(service.ListenAddr)
+}
+
+// listenPort returns the port of a listen address
+func listenPort(addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return port
+	}
+	return addr
+}
+
+// serviceName describes a service's domain or listen address for logs
+func serviceName(service *models.Service) string {
+	if service.Type == "http" {
+		return service.Domain
+	}
+	return service.ListenAddr
+}
+
+// declarationName describes a declaration's domain or port for logs
+func declarationName(decl models.ServiceDeclaration) string {
+	if decl.Domain != "" {
+		return decl.Domain
+	}
+	return ":" + strconv.Itoa(decl.ListenPort)
+}
+
+// rejectDeclaration builds the result for a declaration that was refused
+func rejectDeclaration(decl models.ServiceDeclaration, reason string) models.ServiceResult {
+	return models.ServiceResult{
+		Declaration: decl,
+		Status:      "rejected",
+		Reason:      reason,
+	}
+}
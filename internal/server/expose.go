@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+// ExposeConfig configures ephemeral tunnels, which clients create with
+// "picotunnel-client http 3000" to expose a local port until they exit
+type ExposeConfig struct {
+	APIToken   string        // credential clients authenticate with; empty disables ephemeral tunnels
+	Domain     string        // HTTP services get a random subdomain of this domain
+	PortRange  string        // TCP and UDP services get a free port from this range, e.g. "30000-30099"
+	PublicHost string        // host name TCP and UDP URLs point at (default: the API request's host)
+	Grace      time.Duration // reported to clients; the tunnel manager deletes tunnels gone this long
+}
+
+// SetExpose enables the endpoints that create ephemeral tunnels
+func (api *APIHandler) SetExpose(config ExposeConfig) {
+	api.expose = config
+}
+
+// requireAPIToken wraps a handler so it only runs for requests carrying
+// the API token as a bearer token
+func (api *APIHandler) requireAPIToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.expose.APIToken == "" {
+			api.sendError(w, http.StatusForbidden, "Ephemeral tunnels are disabled on this server (start it with --api-token)", nil)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.expose.APIToken)) != 1 {
+			api.sendError(w, http.StatusUnauthorized, "Invalid API token", nil)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// createExposure handles POST /api/expose
+func (api *APIHandler) createExposure(w http.ResponseWriter, r *http.Request) {
+	var req models.ExposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.sendError(w, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+
+	switch req.Type {
+	case "http":
+		if api.expose.Domain == "" {
+			api.sendError(w, http.StatusBadRequest, "This server has no domain for ephemeral HTTP tunnels (--expose-domain)", nil)
+			return
+		}
+	case "tcp", "udp":
+		if api.expose.PortRange == "" {
+			api.sendError(w, http.StatusBadRequest, "This server has no ports for ephemeral TCP and UDP tunnels (--expose-ports)", nil)
+			return
+		}
+	default:
+		api.sendError(w, http.StatusBadRequest, "Type must be 'http', 'tcp' or 'udp'", nil)
+		return
+	}
+
+	if err := validateTargetAddr(req.Type, req.TargetAddr); err != nil {
+		api.sendError(w, http.StatusBadRequest, "Invalid target address", err)
+		return
+	}
+
+	id, err := generateRandomID()
+	if err != nil {
+		api.sendError(w, http.StatusInternalServerError, "Failed to generate ID", err)
+		return
+	}
+
+	token, err := generateRandomToken()
+	if err != nil {
+		api.sendError(w, http.StatusInternalServerError, "Failed to generate token", err)
+		return
+	}
+
+	tunnel := &models.Tunnel{
+		ID:             id,
+		Name:           "ephemeral-" + id,
+		Token:          token,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		DomainSuffixes: []string{},
+		Ephemeral:      true,
+	}
+
+	if err := api.store.CreateTunnel(tunnel); err != nil {
+		api.sendError(w, http.StatusInternalServerError, "Failed to create tunnel", err)
+		return
+	}
+
+	service, err := api.proxyManager.createExposedService(tunnel, req, api.expose)
+	if err != nil {
+		api.store.DeleteTunnel(tunnel.ID)
+		api.sendError(w, http.StatusServiceUnavailable, "Failed to create service", err)
+		return
+	}
+
+	log.Printf("Created ephemeral tunnel %s exposing %s %s", tunnel.ID, service.Type, serviceName(service))
+
+	response := &models.Exposure{
+		TunnelID:     tunnel.ID,
+		Token:        tunnel.Token,
+		Service:      service,
+		URL:          api.exposureURL(r, service),
+		GraceSeconds: int(api.expose.Grace.Seconds()),
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	api.sendJSON(w, response)
+}
+
+// deleteExposure handles DELETE /api/expose/{id}. Only ephemeral tunnels
+// can be deleted here.
+func (api *APIHandler) deleteExposure(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	tunnel, err := api.store.GetTunnel(id)
+	if err != nil || !tunnel.Ephemeral {
+		api.sendError(w, http.StatusNotFound, "Ephemeral tunnel not found", err)
+		return
+	}
+
+	if err := api.proxyManager.RemoveTunnel(id); err != nil {
+		api.sendError(w, http.StatusInternalServerError, "Failed to delete tunnel", err)
+		return
+	}
+
+	log.Printf("Deleted ephemeral tunnel %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exposureURL returns the public URL of an ephemeral tunnel's service
+func (api *APIHandler) exposureURL(r *http.Request, service *models.Service) string {
+	if service.Type == "http" {
+		host := service.Domain
+		if addr := api.proxyManager.HTTPAddr(); addr != nil {
+			if _, port, err := net.SplitHostPort(addr.String()); err == nil && port != "80" {
+				host = net.JoinHostPort(host, port)
+			}
+		}
+		return "http://" + host
+	}
+
+	host := api.expose.PublicHost
+	if host == "" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+	return service.Type + "://" + net.JoinHostPort(host, listenPort(service.ListenAddr))
+}
+
+// createExposedService creates the single service of an ephemeral tunnel:
+// an HTTP service on a random subdomain, or a TCP or UDP service on the
+// first free port in the configured range
+func (pm *ProxyManager) createExposedService(tunnelObj *models.Tunnel, req models.ExposeRequest, config ExposeConfig) (*models.Service, error) {
+	pm.syncMu.Lock()
+	defer pm.syncMu.Unlock()
+
+	others, err := pm.store.ListAllServices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	id, err := generateRandomID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ID: %w", err)
+	}
+
+	service := &models.Service{
+		ID:         id,
+		TunnelID:   tunnelObj.ID,
+		Type:       req.Type,
+		PathPrefix: "/",
+		TLSMode:    "terminate",
+		TargetAddr: req.TargetAddr,
+		Enabled:    true,
+		Source:     "api",
+		CreatedAt:  time.Now(),
+	}
+
+	if service.Type == "http" {
+		for attempt := 0; service.Domain == ""; attempt++ {
+			if attempt == 10 {
+				return nil, fmt.Errorf("no free subdomain found")
+			}
+			label, err := randomLabel()
+			if err != nil {
+				return nil, err
+			}
+			service.Domain = label + "." + strings.TrimPrefix(strings.ToLower(config.Domain), ".")
+			if checkServiceConflict(others, service) != nil {
+				service.Domain = ""
+			}
+		}
+
+		if err := pm.store.CreateService(service); err != nil {
+			return nil, fmt.Errorf("failed to create service: %w", err)
+		}
+		return service, nil
+	}
+
+	low, high, err := parsePortRange(config.PortRange)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ports can be taken by other programs too, so the first one whose
+	// listener starts wins
+	for port := low; port <= high; port++ {
+		service.ListenAddr = ":" + strconv.Itoa(port)
+		if checkServiceConflict(others, service) != nil {
+			continue
+		}
+
+		if err := pm.store.CreateService(service); err != nil {
+			return nil, fmt.Errorf("failed to create service: %w", err)
+		}
+		if err := pm.AddService(service); err != nil {
+			pm.store.DeleteService(service.ID)
+			continue
+		}
+		return service, nil
+	}
+
+	return nil, fmt.Errorf("no free port in %s", config.PortRange)
+}
+
+// randomLabel generates a random DNS label for an ephemeral subdomain
+func randomLabel() (string, error) {
+	bytes := make([]byte, 4)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
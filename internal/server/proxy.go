@@ -1,12 +1,16 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jclement/picotunnel/internal/models"
 	"github.com/jclement/picotunnel/internal/tunnel"
@@ -18,15 +22,26 @@ type ProxyManager struct {
 	tunnelManager *TunnelManager
 	httpServer    *http.Server
 	httpsServer   *http.Server
+	httpListener  net.Listener
 	tcpListeners  map[string]net.Listener // listenAddr -> listener
+	udpListeners  map[string]*udpListener // listenAddr -> listener
+	listenersMu   sync.Mutex              // guards tcpListeners and udpListeners
+	idleTimeout   time.Duration           // closes idle TCP connections, 0 disables
+	syncMu        sync.Mutex              // serializes client-declared service syncs
+
+	failures   map[string]int64 // serviceID -> target failures reported by clients
+	failuresMu sync.Mutex
 }
 
 // NewProxyManager creates a new proxy manager
-func NewProxyManager(store *Store, tunnelManager *TunnelManager) *ProxyManager {
+func NewProxyManager(store *Store, tunnelManager *TunnelManager, idleTimeout time.Duration) *ProxyManager {
 	return &ProxyManager{
 		store:         store,
 		tunnelManager: tunnelManager,
+		idleTimeout:   idleTimeout,
 		tcpListeners:  make(map[string]net.Listener),
+		udpListeners:  make(map[string]*udpListener),
+		failures:      make(map[string]int64),
 	}
 }
 
@@ -41,9 +56,15 @@ func (pm *ProxyManager) Start(httpAddr, httpsAddr string) error {
 			Handler: http.HandlerFunc(pm.handleHTTP),
 		}
 
+		listener, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", httpAddr, err)
+		}
+		pm.httpListener = listener
+
 		go func() {
-			log.Printf("HTTP proxy listening on %s", httpAddr)
-			if err := pm.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("HTTP proxy listening on %s", listener.Addr())
+			if err := pm.httpServer.Serve(listener); err != http.ErrServerClosed {
 				log.Printf("HTTP proxy error: %v", err)
 			}
 		}()
@@ -61,21 +82,24 @@ func (pm *ProxyManager) Start(httpAddr, httpsAddr string) error {
 		log.Printf("HTTPS proxy disabled pending TLS implementation")
 	}
 
-	// Start TCP listeners for all TCP services
-	if err := pm.startTCPListeners(); err != nil {
-		return fmt.Errorf("failed to start TCP listeners: %w", err)
+	// Start listeners for all TCP and UDP services
+	if err := pm.startServiceListeners(); err != nil {
+		return fmt.Errorf("failed to start service listeners: %w", err)
 	}
 
 	return nil
 }
 
-// Stop stops the proxy servers
-func (pm *ProxyManager) Stop() error {
+// Stop stops the proxy servers. Listeners close immediately; in-flight HTTP
+// requests are given until the context expires to complete.
+func (pm *ProxyManager) Stop(ctx context.Context) error {
 	log.Printf("Stopping proxy manager")
 
 	// Stop HTTP server
 	if pm.httpServer != nil {
-		pm.httpServer.Close()
+		if err := pm.httpServer.Shutdown(ctx); err != nil {
+			pm.httpServer.Close()
+		}
 	}
 
 	// Stop HTTPS server
@@ -83,15 +107,32 @@ func (pm *ProxyManager) Stop() error {
 		pm.httpsServer.Close()
 	}
 
+	pm.listenersMu.Lock()
+	defer pm.listenersMu.Unlock()
+
 	// Stop TCP listeners
 	for addr, listener := range pm.tcpListeners {
 		log.Printf("Stopping TCP listener on %s", addr)
 		listener.Close()
 	}
 
+	// Stop UDP listeners
+	for addr, listener := range pm.udpListeners {
+		log.Printf("Stopping UDP listener on %s", addr)
+		listener.Close()
+	}
+
 	return nil
 }
 
+// HTTPAddr returns the HTTP proxy's bound address, or nil if it is disabled
+func (pm *ProxyManager) HTTPAddr() net.Addr {
+	if pm.httpListener == nil {
+		return nil
+	}
+	return pm.httpListener.Addr()
+}
+
 // handleHTTP handles HTTP requests
 func (pm *ProxyManager) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	host := r.Host
@@ -123,60 +164,119 @@ func (pm *ProxyManager) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check path prefix
-	if service.PathPrefix != "/" && !strings.HasPrefix(r.URL.Path, service.PathPrefix) {
+	if !matchesPathPrefix(r.URL, service.PathPrefix) {
 		log.Printf("Path %s does not match prefix %s for domain %s", r.URL.Path, service.PathPrefix, host)
 		http.Error(w, "Path not found", http.StatusNotFound)
 		return
 	}
 
-	// Get tunnel connection
-	conn, exists := pm.tunnelManager.GetConnection(service.TunnelID)
-	if !exists {
-		log.Printf("Tunnel %s for domain %s is not connected", service.TunnelID, host)
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-		return
+	// Reuse the caller's request ID or mint one to correlate logs
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID, _ = generateRandomID()
+		r.Header.Set("X-Request-ID", requestID)
 	}
 
-	// Open stream to client
-	stream, err := conn.Open()
-	if err != nil {
-		log.Printf("Failed to open stream for domain %s: %v", host, err)
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-		return
+	// Open stream to client. Directories the client serves itself get
+	// their own stream type.
+	streamType := "http"
+	if strings.HasPrefix(service.TargetAddr, "static://") {
+		streamType = "static"
 	}
-	defer stream.Close()
-
-	// Send stream header
 	header := tunnel.StreamHeader{
-		Type:   "http",
-		Target: service.TargetAddr,
+		Type:       streamType,
+		Target:     service.TargetAddr,
+		RemoteAddr: r.RemoteAddr,
+		ServiceID:  service.ID,
+		Host:       r.Host,
+		RequestID:  requestID,
 	}
 
-	streamWithHeader, err := pm.wrapStreamWithHeader(stream, header)
+	stream, err := pm.tunnelManager.OpenStream(service.TunnelID, header)
 	if err != nil {
-		log.Printf("Failed to send stream header for domain %s: %v", host, err)
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		log.Printf("[%s] Failed to open stream for domain %s: %v", requestID, host, err)
+		pm.recordStreamError(service, err)
+		status, message := streamErrorResponse(err)
+		http.Error(w, fmt.Sprintf("%s (request %s)", message, requestID), status)
 		return
 	}
+	defer stream.Close()
 
 	// Create reverse proxy
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
 			// Preserve original request details
 			req.URL.Scheme = "http"
-			req.URL.Host = service.TargetAddr
+			req.URL.Host = targetHost(service.TargetAddr)
+			rewriteRequest(req, service)
 		},
 		Transport: &http.Transport{
 			Dial: func(network, addr string) (net.Conn, error) {
-				return streamWithHeader, nil
+				return stream, nil
 			},
 		},
 	}
 
-	log.Printf("Proxying HTTP request for %s to %s", host, service.TargetAddr)
+	log.Printf("[%s] Proxying HTTP request for %s to %s", requestID, host, service.TargetAddr)
 	proxy.ServeHTTP(w, r)
 }
 
+// targetHost returns a service target without its scheme, so a target such
+// as tls://app.internal:8443 yields a host:port for the proxied request URL.
+// Unix socket targets have no host and get "localhost". The client decides
+// how to dial the target.
+func targetHost(target string) string {
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found {
+		return target
+	}
+	if scheme == "unix" {
+		return "localhost"
+	}
+	return rest
+}
+
+// validateTargetAddr checks a service target: a host:port, tls://host:port
+// for an upstream that speaks TLS, unix:///path for a Unix socket,
+// static://NAME for a directory the client serves, or pool://NAME for a
+// pool of backends the client balances across. UDP services only take a
+// plain host:port, and only HTTP services take static:// targets.
+func validateTargetAddr(serviceType, target string) error {
+	scheme, addr, found := strings.Cut(target, "://")
+	if !found {
+		scheme, addr = "", target
+	}
+
+	switch scheme {
+	case "unix":
+		if !strings.HasPrefix(addr, "/") {
+			return fmt.Errorf("unix targets need an absolute path, as in unix:///run/app.sock")
+		}
+	case "static":
+		if serviceType != "http" {
+			return fmt.Errorf("static targets are only for HTTP services")
+		}
+		if !tunnel.ValidTargetName(addr) {
+			return fmt.Errorf("static targets name a directory the client serves, as in static://site")
+		}
+	case "pool":
+		if !tunnel.ValidTargetName(addr) {
+			return fmt.Errorf("pool targets name a pool of backends defined on the client, as in pool://web")
+		}
+	case "", "tls":
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return fmt.Errorf("%q is not a host:port", addr)
+		}
+	default:
+		return fmt.Errorf("unsupported target scheme %q", scheme)
+	}
+
+	if serviceType == "udp" && scheme != "" {
+		return fmt.Errorf("UDP targets must be a plain host:port")
+	}
+	return nil
+}
+
 // handleHTTPS handles HTTPS requests (SNI-based routing)
 func (pm *ProxyManager) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 	// For now, redirect to HTTP
@@ -184,8 +284,8 @@ func (pm *ProxyManager) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "http://"+r.Host+r.URL.Path, http.StatusTemporaryRedirect)
 }
 
-// startTCPListeners starts TCP listeners for all TCP services
-func (pm *ProxyManager) startTCPListeners() error {
+// startServiceListeners starts listeners for all TCP and UDP services
+func (pm *ProxyManager) startServiceListeners() error {
 	// Get all tunnels and their services
 	tunnels, err := pm.store.ListTunnels()
 	if err != nil {
@@ -200,10 +300,8 @@ func (pm *ProxyManager) startTCPListeners() error {
 		}
 
 		for _, service := range services {
-			if service.Type == "tcp" && service.Enabled && service.ListenAddr != "" {
-				if err := pm.startTCPListener(service); err != nil {
-					log.Printf("Failed to start TCP listener for service %s: %v", service.ID, err)
-				}
+			if err := pm.AddService(service); err != nil {
+				log.Printf("Failed to start %s listener for service %s: %v", service.Type, service.ID, err)
 			}
 		}
 	}
@@ -254,47 +352,129 @@ func (pm *ProxyManager) handleTCPConnection(clientConn net.Conn, service *models
 
 	log.Printf("TCP connection from %s to %s", clientConn.RemoteAddr(), service.ListenAddr)
 
-	// Get tunnel connection
-	conn, exists := pm.tunnelManager.GetConnection(service.TunnelID)
-	if !exists {
-		log.Printf("Tunnel %s for TCP service is not connected", service.TunnelID)
-		return
-	}
+	requestID, _ := generateRandomID()
 
 	// Open stream to client
-	stream, err := conn.Open()
+	header := tunnel.StreamHeader{
+		Type:       "tcp",
+		Target:     service.TargetAddr,
+		RemoteAddr: clientConn.RemoteAddr().String(),
+		ServiceID:  service.ID,
+		RequestID:  requestID,
+	}
+
+	stream, err := pm.tunnelManager.OpenStream(service.TunnelID, header)
 	if err != nil {
-		log.Printf("Failed to open stream for TCP service: %v", err)
+		log.Printf("[%s] Failed to open stream for TCP service: %v", requestID, err)
+		pm.recordStreamError(service, err)
 		return
 	}
 	defer stream.Close()
 
-	// Send stream header
-	header := tunnel.StreamHeader{
-		Type:   "tcp",
-		Target: service.TargetAddr,
-	}
+	log.Printf("[%s] Proxying TCP connection to %s", requestID, service.TargetAddr)
 
-	streamWithHeader, err := pm.wrapStreamWithHeader(stream, header)
+	// Copy data bidirectionally
+	result, err := tunnel.CopyBidirectional(clientConn, stream, pm.idleTimeout)
 	if err != nil {
-		log.Printf("Failed to send stream header for TCP service: %v", err)
+		log.Printf("[%s] TCP proxy error: %v", requestID, err)
+	}
+
+	log.Printf("[%s] TCP connection closed (%d bytes in, %d bytes out)", requestID, result.AToB, result.BToA)
+}
+
+// recordStreamError counts failures the client reported for a service's
+// target. Errors that never reached the client are not counted.
+func (pm *ProxyManager) recordStreamError(service *models.Service, err error) {
+	var streamErr *tunnel.StreamError
+	if !errors.As(err, &streamErr) {
 		return
 	}
 
-	log.Printf("Proxying TCP connection to %s", service.TargetAddr)
+	pm.failuresMu.Lock()
+	defer pm.failuresMu.Unlock()
+	pm.failures[service.ID]++
+}
 
-	// Copy data bidirectionally
-	if err := tunnel.CopyBidirectional(clientConn, streamWithHeader); err != nil {
-		log.Printf("TCP proxy error: %v", err)
+// TargetFailures returns the number of target failures recorded for a
+// service since the server started
+func (pm *ProxyManager) TargetFailures(serviceID string) int64 {
+	pm.failuresMu.Lock()
+	defer pm.failuresMu.Unlock()
+	return pm.failures[serviceID]
+}
+
+// streamErrorResponse maps a stream setup failure to an HTTP status and
+// a description that is safe to show to the public
+func streamErrorResponse(err error) (int, string) {
+	var streamErr *tunnel.StreamError
+	if !errors.As(err, &streamErr) {
+		return http.StatusServiceUnavailable, "Service unavailable"
+	}
+
+	switch streamErr.Status {
+	case tunnel.StreamDialTimeout:
+		return http.StatusGatewayTimeout, "Gateway timeout: the service did not respond to the tunnel client"
+	case tunnel.StreamDialRefused:
+		return http.StatusBadGateway, "Bad gateway: the service refused the connection"
+	case tunnel.StreamDenied:
+		return http.StatusBadGateway, "Bad gateway: the tunnel client's policy denied the connection"
+	case tunnel.StreamNoHandler:
+		return http.StatusBadGateway, "Bad gateway: the tunnel client does not support this service type"
+	default:
+		return http.StatusBadGateway, "Bad gateway: the tunnel client could not reach the service"
+	}
+}
+
+// AddService starts the listener for a TCP or UDP service. HTTP services
+// are routed by domain and need no listener.
+func (pm *ProxyManager) AddService(service *models.Service) error {
+	pm.listenersMu.Lock()
+	defer pm.listenersMu.Unlock()
+
+	switch service.Type {
+	case "tcp":
+		return pm.AddTCPService(service)
+	case "udp":
+		return pm.AddUDPService(service)
 	}
+	return nil
+}
 
-	log.Printf("TCP connection closed")
+// RemoveService stops the listener for a TCP or UDP service
+func (pm *ProxyManager) RemoveService(service *models.Service) error {
+	pm.listenersMu.Lock()
+	defer pm.listenersMu.Unlock()
+
+	switch service.Type {
+	case "tcp":
+		return pm.RemoveTCPService(service)
+	case "udp":
+		return pm.RemoveUDPService(service)
+	}
+	return nil
 }
 
-// wrapStreamWithHeader wraps a stream with header sending
-func (pm *ProxyManager) wrapStreamWithHeader(stream net.Conn, header tunnel.StreamHeader) (net.Conn, error) {
-	sm := tunnel.NewStreamManager(&tunnel.Connection{}) // Dummy connection for header sending
-	return sm.OpenStream(header)
+// RemoveTunnel stops the listeners of a tunnel's services, deletes the
+// tunnel along with them and disconnects its clients
+func (pm *ProxyManager) RemoveTunnel(tunnelID string) error {
+	services, err := pm.store.ListServices(tunnelID)
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+
+	for _, service := range services {
+		if err := pm.RemoveService(service); err != nil {
+			// Log error but continue
+			log.Printf("Failed to remove %s service %s: %v", service.Type, service.ID, err)
+		}
+	}
+
+	if err := pm.store.DeleteTunnel(tunnelID); err != nil {
+		return err
+	}
+
+	pm.tunnelManager.CloseConnections(tunnelID)
+	return nil
 }
 
 // AddTCPService adds a new TCP service and starts its listener
@@ -313,4 +493,22 @@ func (pm *ProxyManager) RemoveTCPService(service *models.Service) error {
 		log.Printf("Stopped TCP listener on %s", service.ListenAddr)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// AddUDPService adds a new UDP service and starts its listener
+func (pm *ProxyManager) AddUDPService(service *models.Service) error {
+	if service.Type == "udp" && service.Enabled && service.ListenAddr != "" {
+		return pm.startUDPListener(service)
+	}
+	return nil
+}
+
+// RemoveUDPService removes a UDP service and stops its listener
+func (pm *ProxyManager) RemoveUDPService(service *models.Service) error {
+	if listener, exists := pm.udpListeners[service.ListenAddr]; exists {
+		listener.Close()
+		delete(pm.udpListeners, service.ListenAddr)
+		log.Printf("Stopped UDP listener on %s", service.ListenAddr)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import "testing"
+
+func TestValidateTargetAddr(t *testing.T) {
+	tests := []struct {
+		serviceType, target string
+		valid               bool
+	}{
+		{"tcp", "localhost:22", true},
+		{"tcp", "localhost", false},
+		{"http", "tls://app.internal:8443", true},
+		{"http", "unix:///run/app.sock", true},
+		{"http", "unix://run/app.sock", false},
+		{"udp", "tls://app.internal:53", false},
+		{"http", "ftp://app.internal:21", false},
+
+		{"http", "pool://web", true},
+		{"tcp", "pool://db-primary_2.internal", true},
+		{"http", "pool://", false},
+		{"http", "pool://web/api", false},
+		{"http", "pool://web pool", false},
+		{"http", "pool://web?x=1", false},
+		{"http", "pool://wéb", false},
+
+		{"http", "static://site", true},
+		{"tcp", "static://site", false},
+		{"http", "static://docs/v2", false},
+		{"http", "static://my site", false},
+	}
+
+	for _, test := range tests {
+		err := validateTargetAddr(test.serviceType, test.target)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("validateTargetAddr(%q, %q) = %v, want valid %v", test.serviceType, test.target, err, test.valid)
+		}
+	}
+}
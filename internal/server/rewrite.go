@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/jclement/picotunnel/internal/models"
+	"golang.org/x/net/http/httpguts"
+)
+
+// rewriteRequest applies an HTTP service's rewrite options to a request
+// on its way to the target: the Host header, added and removed headers,
+// and the path prefix
+func rewriteRequest(req *http.Request, service *models.Service) {
+	if service.HostHeader != "" {
+		// Apps that build absolute URLs still see the public name
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+		req.Host = service.HostHeader
+	}
+
+	for _, name := range service.RemoveHeaders {
+		req.Header.Del(name)
+	}
+	for name, value := range service.SetHeaders {
+		req.Header.Set(name, value)
+	}
+
+	if service.RewritePrefix != "" && matchesPathPrefix(req.URL, service.PathPrefix) {
+		req.URL.Path = replacePrefix(req.URL.Path, service.PathPrefix, service.RewritePrefix)
+		if req.URL.RawPath != "" {
+			// Keep escaped characters such as %2F as the client sent them
+			req.URL.RawPath = replacePrefix(req.URL.RawPath, service.PathPrefix, service.RewritePrefix)
+		}
+	}
+}
+
+// replacePrefix swaps a path's prefix for another, joining the rest with a
+// single slash. Paths outside the prefix are returned unchanged.
+func replacePrefix(path, prefix, replacement string) string {
+	if !hasPathPrefix(path, prefix) {
+		return path
+	}
+	rest := strings.TrimPrefix(path, prefix)
+	if rest == "" {
+		return replacement
+	}
+	return strings.TrimSuffix(replacement, "/") + "/" + strings.TrimPrefix(rest, "/")
+}
+
+// hasPathPrefix reports whether a path falls under a prefix at a segment
+// boundary: "/api" covers "/api" and "/api/x" but not "/apix"
+func hasPathPrefix(path, prefix string) bool {
+	rest, found := strings.CutPrefix(path, prefix)
+	return found && (rest == "" || rest[0] == '/' || strings.HasSuffix(prefix, "/"))
+}
+
+// matchesPathPrefix reports whether a request URL falls under a service's
+// path prefix. The escaped path must match too, so an encoded slash (%2F)
+// is not taken for a segment boundary.
+func matchesPathPrefix(u *url.URL, prefix string) bool {
+	return hasPathPrefix(u.Path, prefix) && (u.RawPath == "" || hasPathPrefix(u.RawPath, prefix))
+}
+
+// validateRewrites checks a service's rewrite options. They only apply to
+// HTTP services.
+func validateRewrites(service *models.Service) error {
+	hasRewrites := service.HostHeader != "" || len(service.SetHeaders) > 0 ||
+		len(service.RemoveHeaders) > 0 || service.RewritePrefix != ""
+	if service.Type != "http" {
+		if hasRewrites {
+			return fmt.Errorf("rewrites only apply to HTTP services")
+		}
+		return nil
+	}
+
+	if service.HostHeader != "" && !httpguts.ValidHostHeader(service.HostHeader) {
+		return fmt.Errorf("invalid host header %q", service.HostHeader)
+	}
+	for name, value := range service.SetHeaders {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid header %q", name)
+		}
+		if strings.EqualFold(name, "Host") {
+			return fmt.Errorf("use host_header to change the Host header")
+		}
+	}
+	for _, name := range service.RemoveHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	if service.RewritePrefix != "" && !strings.HasPrefix(service.RewritePrefix, "/") {
+		return fmt.Errorf("rewrite prefix must start with /")
+	}
+	return nil
+}
+
+// sameRewrites reports whether two services rewrite requests the same way
+func sameRewrites(a, b *models.Service) bool {
+	return a.HostHeader == b.HostHeader && a.RewritePrefix == b.RewritePrefix &&
+		maps.Equal(a.SetHeaders, b.SetHeaders) && slices.Equal(a.RemoveHeaders, b.RemoveHeaders)
+}
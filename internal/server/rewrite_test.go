@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+func TestPathPrefixRewrite(t *testing.T) {
+	tests := []struct {
+		prefix, rewrite string
+		target          string // request target as sent by the client
+		matches         bool
+		wantPath        string // escaped path sent to the client's target
+	}{
+		{"/api", "/v1", "/api", true, "/v1"},
+		{"/api", "/v1", "/api/", true, "/v1/"},
+		{"/api", "/v1", "/api/x", true, "/v1/x"},
+		{"/api", "/v1", "/apix", false, ""},
+		{"/api", "/v1", "/ap", false, ""},
+		{"/api/", "/v1/", "/api/x", true, "/v1/x"},
+		{"/api/", "/v1/", "/api/", true, "/v1/"},
+		{"/api/", "/v1/", "/api", false, ""},
+		{"/api/", "/v1/", "/apix", false, ""},
+		{"/", "/app", "/x", true, "/app/x"},
+		{"/api", "/", "/api/x", true, "/x"},
+
+		// Escaped characters reach the target as sent
+		{"/api", "/v1", "/api/a%2Fb", true, "/v1/a%2Fb"},
+		{"/api", "/v1", "/api/my%20file", true, "/v1/my%20file"},
+		// An encoded slash is not a segment boundary
+		{"/api", "/v1", "/api%2Fx", false, ""},
+		{"/api/", "/v1/", "/api%2Fx", false, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.target, nil)
+		service := &models.Service{Type: "http", PathPrefix: test.prefix, RewritePrefix: test.rewrite}
+
+		if got := matchesPathPrefix(req.URL, test.prefix); got != test.matches {
+			t.Errorf("prefix %q, path %q: matches = %v, want %v", test.prefix, test.target, got, test.matches)
+			continue
+		}
+		if !test.matches {
+			continue
+		}
+
+		rewriteRequest(req, service)
+		if got := req.URL.EscapedPath(); got != test.wantPath {
+			t.Errorf("prefix %q -> %q, path %q: rewritten to %q, want %q", test.prefix, test.rewrite, test.target, got, test.wantPath)
+		}
+	}
+}
+
+func TestReplacePrefixLeavesOtherPaths(t *testing.T) {
+	for _, path := range []string{"/apix", "/other", "/"} {
+		if got := replacePrefix(path, "/api", "/v1"); got != path {
+			t.Errorf("replacePrefix(%q, /api, /v1) = %q, want it unchanged", path, got)
+		}
+	}
+}
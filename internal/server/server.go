@@ -4,22 +4,26 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/jclement/picotunnel/internal/server/web"
+	"github.com/jclement/picotunnel/internal/tunnel"
 )
 
 // Config holds server configuration
 type Config struct {
-	ListenAddr   string
-	TunnelAddr   string
-	HTTPAddr     string
-	HTTPSAddr    string
-	DataDir      string
-	Domain       string
+	ListenAddr    string
+	TunnelAddr    string
+	TunnelTLSAddr string // raw TLS transport listener, disabled when empty
+	HTTPAddr      string
+	HTTPSAddr     string
+	DataDir       string
+	Domain        string
 	
 	// OIDC config
 	OIDCIssuer       string
@@ -30,6 +34,31 @@ type Config struct {
 	// TLS/ACME config
 	ACMEEnabled bool
 	ACMEEmail   string
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Version is reported to clients during the tunnel handshake
+	Version string
+
+	// DrainTimeout bounds how long Stop waits for in-flight streams
+	DrainTimeout time.Duration
+
+	// IdleTimeout closes TCP service connections with no traffic in
+	// either direction for this long (0 disables)
+	IdleTimeout time.Duration
+
+	// AllowQueryToken accepts tunnel tokens in the WebSocket URL query, as
+	// sent by older clients (deprecated)
+	AllowQueryToken bool
+
+	// APIToken lets clients create ephemeral tunnels exposing a local port
+	// (disabled when empty). Their HTTP services get a random subdomain of
+	// ExposeDomain and TCP/UDP services a port from ExposePortRange; they
+	// are deleted once their client has been gone for ExposeGrace.
+	APIToken        string
+	ExposeDomain    string
+	ExposePortRange string
+	ExposeGrace     time.Duration
 }
 
 // Server represents the main server
@@ -42,8 +71,11 @@ type Server struct {
 	tlsManager    *TLSManager
 	apiHandler    *APIHandler
 	
-	httpServer   *http.Server
-	tunnelServer *http.Server
+	httpServer     *http.Server
+	tunnelServer   *http.Server
+	httpListener   net.Listener
+	tunnelListener net.Listener
+	tlsListener    net.Listener
 }
 
 // NewServer creates a new server
@@ -61,10 +93,13 @@ func NewServer(config Config) (*Server, error) {
 	}
 
 	// Initialize tunnel manager
-	tunnelManager := NewTunnelManager(store)
+	tunnelManager := NewTunnelManager(store, config.Version)
 
 	// Initialize proxy manager
-	proxyManager := NewProxyManager(store, tunnelManager)
+	proxyManager := NewProxyManager(store, tunnelManager, config.IdleTimeout)
+	tunnelManager.SetServiceSync(proxyManager.SyncDeclaredServices)
+	tunnelManager.SetAllowQueryToken(config.AllowQueryToken)
+	tunnelManager.SetEphemeralReaper(config.ExposeGrace, proxyManager.RemoveTunnel)
 
 	// Initialize auth handler
 	authConfig := AuthConfig{
@@ -84,11 +119,23 @@ func NewServer(config Config) (*Server, error) {
 		Email:    config.ACMEEmail,
 		Domain:   config.Domain,
 		CacheDir: config.DataDir,
+		CertFile: config.TLSCertFile,
+		KeyFile:  config.TLSKeyFile,
+	}
+	tlsManager, err := NewTLSManager(tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize TLS manager: %w", err)
 	}
-	tlsManager := NewTLSManager(tlsConfig)
 
 	// Initialize API handler
 	apiHandler := NewAPIHandler(store, tunnelManager, proxyManager)
+	apiHandler.SetExpose(ExposeConfig{
+		APIToken:   config.APIToken,
+		Domain:     config.ExposeDomain,
+		PortRange:  config.ExposePortRange,
+		PublicHost: config.Domain,
+		Grace:      config.ExposeGrace,
+	})
 
 	return &Server{
 		config:        config,
@@ -140,10 +187,17 @@ func (s *Server) Start() error {
 		Handler: mux,
 	}
 
+	// Bind before returning so callers know the listener is ready
+	httpListener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.ListenAddr, err)
+	}
+	s.httpListener = httpListener
+
 	// Start management server
 	go func() {
-		log.Printf("Management server listening on %s", s.config.ListenAddr)
-		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("Management server listening on %s", httpListener.Addr())
+		if err := s.httpServer.Serve(httpListener); err != http.ErrServerClosed {
 			log.Printf("Management server error: %v", err)
 		}
 	}()
@@ -153,24 +207,51 @@ func (s *Server) Start() error {
 	tunnelMux.HandleFunc("GET /tunnel", s.tunnelManager.HandleWebSocket)
 	
 	s.tunnelServer = &http.Server{
-		Addr:    s.config.TunnelAddr,
-		Handler: tunnelMux,
+		Addr:      s.config.TunnelAddr,
+		Handler:   tunnelMux,
+		TLSConfig: s.tlsManager.GetTLSConfig(),
 	}
 
+	tunnelListener, err := net.Listen("tcp", s.config.TunnelAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.TunnelAddr, err)
+	}
+	s.tunnelListener = tunnelListener
+
 	// Start tunnel server
 	go func() {
-		log.Printf("Tunnel server listening on %s", s.config.TunnelAddr)
-		if s.tlsManager.IsEnabled() {
-			if err := s.tunnelServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		log.Printf("Tunnel server listening on %s", tunnelListener.Addr())
+		if s.tlsManager.HasCertificate() {
+			if err := s.tunnelServer.ServeTLS(tunnelListener, "", ""); err != http.ErrServerClosed {
 				log.Printf("Tunnel server TLS error: %v", err)
 			}
 		} else {
-			if err := s.tunnelServer.ListenAndServe(); err != http.ErrServerClosed {
+			if err := s.tunnelServer.Serve(tunnelListener); err != http.ErrServerClosed {
 				log.Printf("Tunnel server error: %v", err)
 			}
 		}
 	}()
 
+	// Start raw TLS transport listener
+	if s.config.TunnelTLSAddr != "" {
+		if !s.tlsManager.HasCertificate() {
+			return fmt.Errorf("TLS tunnel listener requires ACME or a TLS certificate")
+		}
+
+		listener, err := tunnel.TLSTransport{}.Listen(s.config.TunnelTLSAddr, s.tlsManager.GetTLSConfig())
+		if err != nil {
+			return fmt.Errorf("failed to start TLS tunnel listener: %w", err)
+		}
+		s.tlsListener = listener
+
+		go func() {
+			log.Printf("TLS tunnel listener on %s", listener.Addr())
+			if err := s.tunnelManager.Serve(listener); err != nil {
+				log.Printf("TLS tunnel listener error: %v", err)
+			}
+		}()
+	}
+
 	log.Printf("PicoTunnel server started successfully")
 	return nil
 }
@@ -189,11 +270,29 @@ func (s *Server) Stop() error {
 	if s.tunnelServer != nil {
 		s.tunnelServer.Shutdown(ctx)
 	}
+	if s.tlsListener != nil {
+		s.tlsListener.Close()
+	}
 
-	// Stop components
+	// Stop taking proxy traffic and let in-flight streams finish while
+	// clients move to another server
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), s.config.DrainTimeout)
+	defer drainCancel()
+
+	var wg sync.WaitGroup
 	if s.proxyManager != nil {
-		s.proxyManager.Stop()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.proxyManager.Stop(drainCtx)
+		}()
+	}
+	if s.tunnelManager != nil {
+		s.tunnelManager.Drain(drainCtx)
 	}
+	wg.Wait()
+
+	// Stop components
 	if s.tunnelManager != nil {
 		s.tunnelManager.Stop()
 	}
@@ -207,6 +306,37 @@ func (s *Server) Stop() error {
 	return nil
 }
 
+// Addr returns the management server's bound address, or nil before Start
+func (s *Server) Addr() net.Addr {
+	if s.httpListener == nil {
+		return nil
+	}
+	return s.httpListener.Addr()
+}
+
+// TunnelAddr returns the WebSocket tunnel listener's bound address, or nil
+// before Start
+func (s *Server) TunnelAddr() net.Addr {
+	if s.tunnelListener == nil {
+		return nil
+	}
+	return s.tunnelListener.Addr()
+}
+
+// TunnelTLSAddr returns the raw TLS tunnel listener's bound address, or nil
+// if it is disabled
+func (s *Server) TunnelTLSAddr() net.Addr {
+	if s.tlsListener == nil {
+		return nil
+	}
+	return s.tlsListener.Addr()
+}
+
+// HTTPAddr returns the HTTP proxy's bound address, or nil if it is disabled
+func (s *Server) HTTPAddr() net.Addr {
+	return s.proxyManager.HTTPAddr()
+}
+
 // handleHealth handles health check requests
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	status := struct {
@@ -217,7 +347,7 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	}{
 		Status:    "ok",
 		Timestamp: time.Now(),
-		Version:   "1.0.0",
+		Version:   s.config.Version,
 		Tunnels:   len(s.tunnelManager.ListConnectedTunnels()),
 	}
 
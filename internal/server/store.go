@@ -2,7 +2,9 @@ package server
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -71,8 +73,93 @@ func (s *Store) migrate() error {
 	CREATE INDEX IF NOT EXISTS idx_checks_tunnel_time ON checks(tunnel_id, created_at DESC);
 	`
 
-	_, err := s.db.Exec(schema)
-	return err
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+
+	return s.applyMigrations()
+}
+
+// schemaMigrations are applied in order on top of the base schema. The
+// number applied so far is tracked in SQLite's user_version, so entries
+// must never be edited or reordered once released; append new ones.
+var schemaMigrations = []string{
+	// 1: allow UDP services. SQLite cannot alter a CHECK constraint, so
+	// the services table is rebuilt.
+	`
+	CREATE TABLE services_new (
+		id TEXT PRIMARY KEY,
+		tunnel_id TEXT NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+		type TEXT NOT NULL CHECK(type IN ('http', 'tcp', 'udp')),
+		domain TEXT,
+		path_prefix TEXT DEFAULT '/',
+		tls_mode TEXT DEFAULT 'terminate' CHECK(tls_mode IN ('terminate', 'passthrough')),
+		listen_addr TEXT,
+		target_addr TEXT NOT NULL,
+		enabled INTEGER DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT INTO services_new (id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, created_at)
+	SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, created_at FROM services;
+
+	DROP TABLE services;
+	ALTER TABLE services_new RENAME TO services;
+	`,
+
+	// 2: limits on client-declared services, and who owns each service
+	`
+	ALTER TABLE tunnels ADD COLUMN client_services INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tunnels ADD COLUMN max_services INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tunnels ADD COLUMN domain_suffixes TEXT NOT NULL DEFAULT '';
+	ALTER TABLE tunnels ADD COLUMN port_range TEXT NOT NULL DEFAULT '';
+	ALTER TABLE services ADD COLUMN source TEXT NOT NULL DEFAULT 'api' CHECK(source IN ('api', 'client'));
+	`,
+
+	// 3: ephemeral tunnels created by clients exposing a port ad hoc
+	`
+	ALTER TABLE tunnels ADD COLUMN ephemeral INTEGER NOT NULL DEFAULT 0;
+	`,
+
+	// 4: rewrites applied to HTTP requests before they reach the target
+	`
+	ALTER TABLE services ADD COLUMN host_header TEXT NOT NULL DEFAULT '';
+	ALTER TABLE services ADD COLUMN set_headers TEXT NOT NULL DEFAULT '';
+	ALTER TABLE services ADD COLUMN remove_headers TEXT NOT NULL DEFAULT '';
+	ALTER TABLE services ADD COLUMN rewrite_prefix TEXT NOT NULL DEFAULT '';
+	`,
+}
+
+// applyMigrations runs any schema migrations the database has not seen yet
+func (s *Store) applyMigrations() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(schemaMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(schemaMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record schema version %d: %w", i+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+	}
+
+	return nil
 }
 
 // Tunnel operations
@@ -80,48 +167,54 @@ func (s *Store) migrate() error {
 // CreateTunnel creates a new tunnel
 func (s *Store) CreateTunnel(tunnel *models.Tunnel) error {
 	query := `
-		INSERT INTO tunnels (id, name, token, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO tunnels (id, name, token, created_at, updated_at, ephemeral)
+		VALUES (?, ?, ?, ?, ?, ?)
 	`
-	_, err := s.db.Exec(query, tunnel.ID, tunnel.Name, tunnel.Token, tunnel.CreatedAt, tunnel.UpdatedAt)
+	_, err := s.db.Exec(query, tunnel.ID, tunnel.Name, tunnel.Token, tunnel.CreatedAt, tunnel.UpdatedAt, tunnel.Ephemeral)
 	return err
 }
 
 // GetTunnel gets a tunnel by ID
 func (s *Store) GetTunnel(id string) (*models.Tunnel, error) {
-	query := `SELECT id, name, token, created_at, updated_at FROM tunnels WHERE id = ?`
+	query := `SELECT id, name, token, created_at, updated_at, client_services, max_services, domain_suffixes, port_range, ephemeral FROM tunnels WHERE id = ?`
 	
 	var tunnel models.Tunnel
+	var domainSuffixes string
 	err := s.db.QueryRow(query, id).Scan(
 		&tunnel.ID, &tunnel.Name, &tunnel.Token, 
 		&tunnel.CreatedAt, &tunnel.UpdatedAt,
+		&tunnel.ClientServices, &tunnel.MaxServices, &domainSuffixes, &tunnel.PortRange, &tunnel.Ephemeral,
 	)
 	if err != nil {
 		return nil, err
 	}
+	tunnel.DomainSuffixes = splitList(domainSuffixes)
 	
 	return &tunnel, nil
 }
 
 // GetTunnelByToken gets a tunnel by token
 func (s *Store) GetTunnelByToken(token string) (*models.Tunnel, error) {
-	query := `SELECT id, name, token, created_at, updated_at FROM tunnels WHERE token = ?`
+	query := `SELECT id, name, token, created_at, updated_at, client_services, max_services, domain_suffixes, port_range, ephemeral FROM tunnels WHERE token = ?`
 	
 	var tunnel models.Tunnel
+	var domainSuffixes string
 	err := s.db.QueryRow(query, token).Scan(
 		&tunnel.ID, &tunnel.Name, &tunnel.Token, 
 		&tunnel.CreatedAt, &tunnel.UpdatedAt,
+		&tunnel.ClientServices, &tunnel.MaxServices, &domainSuffixes, &tunnel.PortRange, &tunnel.Ephemeral,
 	)
 	if err != nil {
 		return nil, err
 	}
+	tunnel.DomainSuffixes = splitList(domainSuffixes)
 	
 	return &tunnel, nil
 }
 
 // ListTunnels lists all tunnels
 func (s *Store) ListTunnels() ([]*models.Tunnel, error) {
-	query := `SELECT id, name, token, created_at, updated_at FROM tunnels ORDER BY name`
+	query := `SELECT id, name, token, created_at, updated_at, client_services, max_services, domain_suffixes, port_range, ephemeral FROM tunnels ORDER BY name`
 	
 	rows, err := s.db.Query(query)
 	if err != nil {
@@ -132,13 +225,16 @@ func (s *Store) ListTunnels() ([]*models.Tunnel, error) {
 	var tunnels []*models.Tunnel
 	for rows.Next() {
 		var tunnel models.Tunnel
+		var domainSuffixes string
 		err := rows.Scan(
 			&tunnel.ID, &tunnel.Name, &tunnel.Token,
 			&tunnel.CreatedAt, &tunnel.UpdatedAt,
+			&tunnel.ClientServices, &tunnel.MaxServices, &domainSuffixes, &tunnel.PortRange, &tunnel.Ephemeral,
 		)
 		if err != nil {
 			return nil, err
 		}
+		tunnel.DomainSuffixes = splitList(domainSuffixes)
 		tunnels = append(tunnels, &tunnel)
 	}
 
@@ -149,10 +245,14 @@ func (s *Store) ListTunnels() ([]*models.Tunnel, error) {
 func (s *Store) UpdateTunnel(tunnel *models.Tunnel) error {
 	query := `
 		UPDATE tunnels 
-		SET name = ?, updated_at = ?
+		SET name = ?, client_services = ?, max_services = ?, domain_suffixes = ?, port_range = ?, updated_at = ?
 		WHERE id = ?
 	`
-	_, err := s.db.Exec(query, tunnel.Name, time.Now(), tunnel.ID)
+	_, err := s.db.Exec(query,
+		tunnel.Name, tunnel.ClientServices, tunnel.MaxServices,
+		strings.Join(tunnel.DomainSuffixes, ","), tunnel.PortRange,
+		time.Now(), tunnel.ID,
+	)
 	return err
 }
 
@@ -175,12 +275,14 @@ func (s *Store) DeleteTunnel(id string) error {
 // CreateService creates a new service
 func (s *Store) CreateService(service *models.Service) error {
 	query := `
-		INSERT INTO services (id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO services (id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, source, created_at,
+			host_header, set_headers, remove_headers, rewrite_prefix)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	_, err := s.db.Exec(query,
 		service.ID, service.TunnelID, service.Type, service.Domain, service.PathPrefix,
-		service.TLSMode, service.ListenAddr, service.TargetAddr, service.Enabled, service.CreatedAt,
+		service.TLSMode, service.ListenAddr, service.TargetAddr, service.Enabled, service.Source, service.CreatedAt,
+		service.HostHeader, encodeHeaders(service.SetHeaders), strings.Join(service.RemoveHeaders, ","), service.RewritePrefix,
 	)
 	return err
 }
@@ -188,18 +290,23 @@ func (s *Store) CreateService(service *models.Service) error {
 // GetService gets a service by ID
 func (s *Store) GetService(id string) (*models.Service, error) {
 	query := `
-		SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, created_at
+		SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, source, created_at,
+			host_header, set_headers, remove_headers, rewrite_prefix
 		FROM services WHERE id = ?
 	`
 	
 	var service models.Service
+	var setHeaders, removeHeaders string
 	err := s.db.QueryRow(query, id).Scan(
 		&service.ID, &service.TunnelID, &service.Type, &service.Domain, &service.PathPrefix,
-		&service.TLSMode, &service.ListenAddr, &service.TargetAddr, &service.Enabled, &service.CreatedAt,
+		&service.TLSMode, &service.ListenAddr, &service.TargetAddr, &service.Enabled, &service.Source, &service.CreatedAt,
+		&service.HostHeader, &setHeaders, &removeHeaders, &service.RewritePrefix,
 	)
 	if err != nil {
 		return nil, err
 	}
+	service.SetHeaders = decodeHeaders(setHeaders)
+	service.RemoveHeaders = splitList(removeHeaders)
 	
 	return &service, nil
 }
@@ -207,18 +314,23 @@ func (s *Store) GetService(id string) (*models.Service, error) {
 // GetServiceByDomain gets an HTTP service by domain
 func (s *Store) GetServiceByDomain(domain string) (*models.Service, error) {
 	query := `
-		SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, created_at
+		SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, source, created_at,
+			host_header, set_headers, remove_headers, rewrite_prefix
 		FROM services WHERE type = 'http' AND domain = ? AND enabled = 1
 	`
 	
 	var service models.Service
+	var setHeaders, removeHeaders string
 	err := s.db.QueryRow(query, domain).Scan(
 		&service.ID, &service.TunnelID, &service.Type, &service.Domain, &service.PathPrefix,
-		&service.TLSMode, &service.ListenAddr, &service.TargetAddr, &service.Enabled, &service.CreatedAt,
+		&service.TLSMode, &service.ListenAddr, &service.TargetAddr, &service.Enabled, &service.Source, &service.CreatedAt,
+		&service.HostHeader, &setHeaders, &removeHeaders, &service.RewritePrefix,
 	)
 	if err != nil {
 		return nil, err
 	}
+	service.SetHeaders = decodeHeaders(setHeaders)
+	service.RemoveHeaders = splitList(removeHeaders)
 	
 	return &service, nil
 }
@@ -226,7 +338,8 @@ func (s *Store) GetServiceByDomain(domain string) (*models.Service, error) {
 // ListServices lists services for a tunnel
 func (s *Store) ListServices(tunnelID string) ([]*models.Service, error) {
 	query := `
-		SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, created_at
+		SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, source, created_at,
+			host_header, set_headers, remove_headers, rewrite_prefix
 		FROM services WHERE tunnel_id = ? ORDER BY created_at
 	`
 	
@@ -239,13 +352,51 @@ func (s *Store) ListServices(tunnelID string) ([]*models.Service, error) {
 	var services []*models.Service
 	for rows.Next() {
 		var service models.Service
+		var setHeaders, removeHeaders string
 		err := rows.Scan(
 			&service.ID, &service.TunnelID, &service.Type, &service.Domain, &service.PathPrefix,
-			&service.TLSMode, &service.ListenAddr, &service.TargetAddr, &service.Enabled, &service.CreatedAt,
+			&service.TLSMode, &service.ListenAddr, &service.TargetAddr, &service.Enabled, &service.Source, &service.CreatedAt,
+			&service.HostHeader, &setHeaders, &removeHeaders, &service.RewritePrefix,
 		)
 		if err != nil {
 			return nil, err
 		}
+		service.SetHeaders = decodeHeaders(setHeaders)
+		service.RemoveHeaders = splitList(removeHeaders)
+		services = append(services, &service)
+	}
+
+	return services, rows.Err()
+}
+
+// ListAllServices lists the services of every tunnel
+func (s *Store) ListAllServices() ([]*models.Service, error) {
+	query := `
+		SELECT id, tunnel_id, type, domain, path_prefix, tls_mode, listen_addr, target_addr, enabled, source, created_at,
+			host_header, set_headers, remove_headers, rewrite_prefix
+		FROM services ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []*models.Service
+	for rows.Next() {
+		var service models.Service
+		var setHeaders, removeHeaders string
+		err := rows.Scan(
+			&service.ID, &service.TunnelID, &service.Type, &service.Domain, &service.PathPrefix,
+			&service.TLSMode, &service.ListenAddr, &service.TargetAddr, &service.Enabled, &service.Source, &service.CreatedAt,
+			&service.HostHeader, &setHeaders, &removeHeaders, &service.RewritePrefix,
+		)
+		if err != nil {
+			return nil, err
+		}
+		service.SetHeaders = decodeHeaders(setHeaders)
+		service.RemoveHeaders = splitList(removeHeaders)
 		services = append(services, &service)
 	}
 
@@ -256,12 +407,14 @@ func (s *Store) ListServices(tunnelID string) ([]*models.Service, error) {
 func (s *Store) UpdateService(service *models.Service) error {
 	query := `
 		UPDATE services 
-		SET domain = ?, path_prefix = ?, tls_mode = ?, listen_addr = ?, target_addr = ?, enabled = ?
+		SET domain = ?, path_prefix = ?, tls_mode = ?, listen_addr = ?, target_addr = ?, enabled = ?,
+			host_header = ?, set_headers = ?, remove_headers = ?, rewrite_prefix = ?
 		WHERE id = ?
 	`
 	_, err := s.db.Exec(query,
 		service.Domain, service.PathPrefix, service.TLSMode,
 		service.ListenAddr, service.TargetAddr, service.Enabled,
+		service.HostHeader, encodeHeaders(service.SetHeaders), strings.Join(service.RemoveHeaders, ","), service.RewritePrefix,
 		service.ID,
 	)
 	return err
@@ -274,6 +427,35 @@ func (s *Store) DeleteService(id string) error {
 	return err
 }
 
+// splitList splits a comma-separated column into its non-empty values
+func splitList(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// encodeHeaders stores a header map in a text column
+func encodeHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(headers)
+	return string(encoded)
+}
+
+// decodeHeaders reads a header map stored by encodeHeaders
+func decodeHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	if value != "" {
+		json.Unmarshal([]byte(value), &headers)
+	}
+	return headers
+}
+
 // Check operations
 
 // CreateCheck creates a new uptime check
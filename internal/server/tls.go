@@ -2,6 +2,7 @@ package server
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net/http"
 	"path/filepath"
 
@@ -14,6 +15,10 @@ type TLSConfig struct {
 	Email     string
 	Domain    string
 	CacheDir  string
+
+	// Static certificate used when ACME is disabled
+	CertFile string
+	KeyFile  string
 }
 
 // TLSManager manages TLS certificates
@@ -24,9 +29,23 @@ type TLSManager struct {
 }
 
 // NewTLSManager creates a new TLS manager
-func NewTLSManager(config TLSConfig) *TLSManager {
+func NewTLSManager(config TLSConfig) (*TLSManager, error) {
 	if !config.Enabled {
-		return &TLSManager{config: config}
+		if config.CertFile == "" && config.KeyFile == "" {
+			return &TLSManager{config: config}, nil
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+
+		return &TLSManager{
+			config: config,
+			tlsConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}, nil
 	}
 
 	certMgr := &autocert.Manager{
@@ -45,14 +64,20 @@ func NewTLSManager(config TLSConfig) *TLSManager {
 		config:    config,
 		certMgr:   certMgr,
 		tlsConfig: tlsConfig,
-	}
+	}, nil
 }
 
-// IsEnabled returns whether TLS is enabled
+// IsEnabled returns whether ACME is enabled
 func (tm *TLSManager) IsEnabled() bool {
 	return tm.config.Enabled
 }
 
+// HasCertificate returns whether a certificate source (ACME or a static
+// certificate) is configured
+func (tm *TLSManager) HasCertificate() bool {
+	return tm.tlsConfig != nil
+}
+
 // GetTLSConfig returns the TLS configuration
 func (tm *TLSManager) GetTLSConfig() *tls.Config {
 	return tm.tlsConfig
@@ -2,9 +2,14 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,27 +20,66 @@ import (
 // TunnelManager manages tunnel connections
 type TunnelManager struct {
 	store       *Store
-	connections map[string]*tunnel.Connection // tunnelID -> connection
+	version     string
+	connections map[string][]*tunnel.Connection // tunnelID -> live connections
+	next        map[string]int                  // tunnelID -> round-robin offset
 	mu          sync.RWMutex
 	ctx         context.Context
 	cancel      context.CancelFunc
 	wg          sync.WaitGroup
+
+	// syncServices applies the services a client declares in its hello
+	syncServices func(*models.Tunnel, []models.ServiceDeclaration) []models.ServiceResult
+
+	// allowQueryToken accepts tokens in the WebSocket URL from older clients
+	allowQueryToken bool
+
+	// Ephemeral tunnels are removed with removeTunnel once their clients
+	// have been gone for reapGrace. lastSeen holds when each tunnel's last
+	// connection closed; tunnels not seen since startedAt count from then.
+	reapGrace    time.Duration
+	removeTunnel func(tunnelID string) error
+	lastSeen     map[string]time.Time
+	startedAt    time.Time
 }
 
 // NewTunnelManager creates a new tunnel manager
-func NewTunnelManager(store *Store) *TunnelManager {
+func NewTunnelManager(store *Store, version string) *TunnelManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &TunnelManager{
 		store:       store,
-		connections: make(map[string]*tunnel.Connection),
+		version:     version,
+		connections: make(map[string][]*tunnel.Connection),
+		next:        make(map[string]int),
+		lastSeen:    make(map[string]time.Time),
 		ctx:         ctx,
 		cancel:      cancel,
 	}
 }
 
+// SetServiceSync sets the function that applies client-declared services
+func (tm *TunnelManager) SetServiceSync(sync func(*models.Tunnel, []models.ServiceDeclaration) []models.ServiceResult) {
+	tm.syncServices = sync
+}
+
+// SetAllowQueryToken sets whether WebSocket clients may still pass their
+// token as a ?token= query parameter. Tokens in URLs leak into access logs,
+// so this is off unless older clients need it.
+func (tm *TunnelManager) SetAllowQueryToken(allow bool) {
+	tm.allowQueryToken = allow
+}
+
+// SetEphemeralReaper sets how long an ephemeral tunnel may go without a
+// connected client before it is deleted with remove (0 keeps them)
+func (tm *TunnelManager) SetEphemeralReaper(grace time.Duration, remove func(tunnelID string) error) {
+	tm.reapGrace = grace
+	tm.removeTunnel = remove
+}
+
 // Start starts the tunnel manager
 func (tm *TunnelManager) Start() error {
 	log.Printf("Starting tunnel manager")
+	tm.startedAt = time.Now()
 
 	// Start health check routine
 	tm.wg.Add(1)
@@ -45,6 +89,12 @@ func (tm *TunnelManager) Start() error {
 	tm.wg.Add(1)
 	go tm.cleanupRoutine()
 
+	// Start ephemeral tunnel reaper
+	if tm.reapGrace > 0 && tm.removeTunnel != nil {
+		tm.wg.Add(1)
+		go tm.reapRoutine()
+	}
+
 	return nil
 }
 
@@ -56,8 +106,10 @@ func (tm *TunnelManager) Stop() error {
 
 	// Close all connections
 	tm.mu.Lock()
-	for _, conn := range tm.connections {
-		conn.Close()
+	for _, conns := range tm.connections {
+		for _, conn := range conns {
+			conn.Close()
+		}
 	}
 	tm.mu.Unlock()
 
@@ -65,23 +117,82 @@ func (tm *TunnelManager) Stop() error {
 	return nil
 }
 
-// HandleWebSocket handles a new WebSocket connection
-func (tm *TunnelManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Extract token from query parameters
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusBadRequest)
+// Drain asks every connected client to move its traffic to a new
+// connection and waits until their in-flight streams finish or the context
+// expires. New streams are no longer routed to drained connections.
+func (tm *TunnelManager) Drain(ctx context.Context) {
+	tm.mu.RLock()
+	var conns []*tunnel.Connection
+	for _, tunnelConns := range tm.connections {
+		conns = append(conns, tunnelConns...)
+	}
+	tm.mu.RUnlock()
+
+	if len(conns) == 0 {
 		return
 	}
 
-	// Validate token
-	tunnelObj, err := tm.store.GetTunnelByToken(token)
-	if err != nil {
-		log.Printf("Invalid token %s: %v", token, err)
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	log.Printf("Draining %d tunnel connections", len(conns))
+	for _, conn := range conns {
+		if err := conn.Drain("server shutting down"); err != nil {
+			log.Printf("Failed to drain connection %s: %v", conn.ID(), err)
+		}
+	}
+
+	for _, conn := range conns {
+		if !conn.WaitIdle(ctx) {
+			log.Printf("Drain timed out with streams still active")
+			return
+		}
+	}
+	log.Printf("All tunnel connections drained")
+}
+
+// CloseConnections closes every connection serving a tunnel, for when the
+// credentials they authenticated with are no longer valid. Clients holding
+// a current token reconnect; streams in flight are cut off.
+func (tm *TunnelManager) CloseConnections(tunnelID string) {
+	tm.mu.RLock()
+	conns := slices.Clone(tm.connections[tunnelID])
+	tm.mu.RUnlock()
+
+	if len(conns) == 0 {
 		return
 	}
 
+	log.Printf("Closing %d connections for tunnel %s", len(conns), tunnelID)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// HandleWebSocket handles a new WebSocket connection. Clients send their
+// token as a bearer token in the Authorization header, or leave it to
+// their hello message. Tokens are never logged.
+func (tm *TunnelManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	token, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hasBearer && r.URL.Query().Has("token") {
+		if !tm.allowQueryToken {
+			log.Printf("Rejected tunnel connection from %s: token in URL query (deprecated)", r.RemoteAddr)
+			http.Error(w, "Passing the token in the URL is no longer supported; upgrade the client", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Tunnel connection from %s passed its token in the URL query; this is deprecated, upgrade the client", r.RemoteAddr)
+		token = r.URL.Query().Get("token")
+	}
+
+	// Without a token up front, the client authenticates in its hello
+	var tunnelObj *models.Tunnel
+	if token != "" {
+		found, err := tm.store.GetTunnelByToken(token)
+		if err != nil {
+			log.Printf("Rejected tunnel connection from %s: invalid token", r.RemoteAddr)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		tunnelObj = found
+	}
+
 	// Upgrade to WebSocket
 	ws, err := tunnel.Upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -89,19 +200,69 @@ func (tm *TunnelManager) HandleWebSocket(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("New tunnel connection for tunnel %s (%s)", tunnelObj.Name, tunnelObj.ID)
+	tm.serveConn(tunnel.NewWebSocketConn(ws), tunnelObj)
+}
 
+// Serve accepts tunnel connections from a raw transport listener (such as
+// the TLS transport) until the listener is closed. These clients
+// authenticate with the token in their hello message.
+func (tm *TunnelManager) Serve(listener net.Listener) error {
+	for {
+		nc, err := listener.Accept()
+		if err != nil {
+			if tm.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go tm.serveConn(nc, nil)
+	}
+}
+
+// serveConn runs a tunnel session over an established transport
+// connection. tunnelObj is nil when the transport did not authenticate the
+// client up front, in which case the hello token is used instead.
+func (tm *TunnelManager) serveConn(nc net.Conn, tunnelObj *models.Tunnel) {
 	// Create tunnel connection
-	conn, err := tunnel.NewConnection(ws, token, true)
+	conn, err := tunnel.NewConnection(nc, "", true)
+	if err != nil {
+		log.Printf("Failed to create tunnel connection from %s: %v", nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+
+	// Exchange hello/welcome before the connection is usable
+	hello, err := conn.ServerHandshake(tm.version, func(hello *models.Hello, welcome *models.Welcome) error {
+		if tunnelObj == nil {
+			found, err := tm.store.GetTunnelByToken(hello.Token)
+			if err != nil {
+				return fmt.Errorf("invalid token")
+			}
+			tunnelObj = found
+		}
+
+		// Clients managing their own services advertise the feature, even
+		// with nothing declared
+		if tm.syncServices != nil && slices.Contains(welcome.Features, tunnel.FeatureServices) {
+			welcome.Services = tm.syncServices(tunnelObj, hello.Services)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("Failed to create tunnel connection: %v", err)
-		ws.Close()
+		log.Printf("Handshake failed for connection from %s: %v", nc.RemoteAddr(), err)
+		conn.Close()
 		return
 	}
 
+	log.Printf("New tunnel connection %s for tunnel %s (%s) from %s", conn.ID(), tunnelObj.Name, tunnelObj.ID, nc.RemoteAddr())
+	log.Printf("Tunnel %s client: %s v%s (%s/%s, protocol v%d, streams %v)",
+		tunnelObj.Name, hello.Hostname, hello.ClientVersion, hello.OS, hello.Arch,
+		hello.ProtocolVersion, hello.StreamTypes)
+
 	// Register connection
 	tm.registerConnection(tunnelObj.ID, conn)
-	defer tm.unregisterConnection(tunnelObj.ID)
+	defer tm.unregisterConnection(tunnelObj.ID, conn)
 
 	// Record connection
 	check := &models.Check{
@@ -117,28 +278,41 @@ func (tm *TunnelManager) HandleWebSocket(w http.ResponseWriter, r *http.Request)
 	tm.handleConnection(tunnelObj.ID, conn)
 }
 
-// registerConnection registers a new tunnel connection
+// registerConnection adds a connection to the set serving a tunnel.
+// Clients may connect several times with the same token (for example, one
+// per replica), and new streams are spread across all of them.
 func (tm *TunnelManager) registerConnection(tunnelID string, conn *tunnel.Connection) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	// Close existing connection if any
-	if existing := tm.connections[tunnelID]; existing != nil {
-		log.Printf("Closing existing connection for tunnel %s", tunnelID)
-		existing.Close()
-	}
-
-	tm.connections[tunnelID] = conn
-	log.Printf("Registered connection for tunnel %s", tunnelID)
+	tm.connections[tunnelID] = append(tm.connections[tunnelID], conn)
+	log.Printf("Registered connection %s for tunnel %s (%d active)", conn.ID(), tunnelID, len(tm.connections[tunnelID]))
 }
 
-// unregisterConnection unregisters a tunnel connection
-func (tm *TunnelManager) unregisterConnection(tunnelID string) {
+// unregisterConnection removes a connection from a tunnel. The tunnel is
+// recorded as down once its last connection is gone.
+func (tm *TunnelManager) unregisterConnection(tunnelID string, conn *tunnel.Connection) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
+	conns := tm.connections[tunnelID]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+
+	if len(conns) > 0 {
+		tm.connections[tunnelID] = conns
+		log.Printf("Unregistered connection %s for tunnel %s (%d active)", conn.ID(), tunnelID, len(conns))
+		return
+	}
+
 	delete(tm.connections, tunnelID)
-	log.Printf("Unregistered connection for tunnel %s", tunnelID)
+	delete(tm.next, tunnelID)
+	tm.lastSeen[tunnelID] = time.Now()
+	log.Printf("Unregistered connection %s for tunnel %s", conn.ID(), tunnelID)
 
 	// Record disconnection
 	check := &models.Check{
@@ -196,6 +370,8 @@ func (tm *TunnelManager) handleControlMessages(tunnelID string, conn *tunnel.Con
 			if tm.ctx.Err() == nil {
 				log.Printf("Error reading control message for tunnel %s: %v", tunnelID, err)
 			}
+			// A broken control stream means the session is unusable
+			conn.Close()
 			return
 		}
 
@@ -221,25 +397,73 @@ func (tm *TunnelManager) handleControlMessages(tunnelID string, conn *tunnel.Con
 
 		case "pong":
 			conn.UpdateLastPing()
+		case "drain":
+			log.Printf("Connection %s for tunnel %s is draining: %s", conn.ID(), tunnelID, msg.Reason)
+			conn.SetDraining()
+		case "health":
+			conn.SetPoolHealth(msg.Health)
 		default:
 			log.Printf("Unknown control message type from tunnel %s: %s", tunnelID, msg.Type)
 		}
 	}
 }
 
-// GetConnection returns a connection for a tunnel ID
-func (tm *TunnelManager) GetConnection(tunnelID string) (*tunnel.Connection, bool) {
+// ErrTunnelNotConnected is returned when a tunnel has no live connections
+var ErrTunnelNotConnected = errors.New("tunnel is not connected")
+
+// liveConnections returns the open connections for a tunnel
+func (tm *TunnelManager) liveConnections(tunnelID string) []*tunnel.Connection {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
 
-	conn, exists := tm.connections[tunnelID]
-	return conn, exists && !conn.IsClosed()
+	var live []*tunnel.Connection
+	for _, conn := range tm.connections[tunnelID] {
+		if !conn.IsClosed() {
+			live = append(live, conn)
+		}
+	}
+	return live
+}
+
+// pickConnections returns the open connections for a tunnel in the order
+// new streams should try them: fewest active streams first, rotating
+// between connections that are equally loaded. Draining connections are
+// skipped.
+func (tm *TunnelManager) pickConnections(tunnelID string) []*tunnel.Connection {
+	var live []*tunnel.Connection
+	for _, conn := range tm.liveConnections(tunnelID) {
+		if !conn.IsDraining() {
+			live = append(live, conn)
+		}
+	}
+	if len(live) < 2 {
+		return live
+	}
+
+	tm.mu.Lock()
+	offset := tm.next[tunnelID] % len(live)
+	tm.next[tunnelID] = offset + 1
+	tm.mu.Unlock()
+
+	ordered := append(live[offset:len(live):len(live)], live[:offset]...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].NumStreams() < ordered[j].NumStreams()
+	})
+	return ordered
+}
+
+// GetConnection returns the connection a new stream for a tunnel would use
+func (tm *TunnelManager) GetConnection(tunnelID string) (*tunnel.Connection, bool) {
+	conns := tm.pickConnections(tunnelID)
+	if len(conns) == 0 {
+		return nil, false
+	}
+	return conns[0], true
 }
 
 // IsConnected returns whether a tunnel is connected
 func (tm *TunnelManager) IsConnected(tunnelID string) bool {
-	_, connected := tm.GetConnection(tunnelID)
-	return connected
+	return len(tm.liveConnections(tunnelID)) > 0
 }
 
 // ListConnectedTunnels returns a list of connected tunnel IDs
@@ -248,23 +472,69 @@ func (tm *TunnelManager) ListConnectedTunnels() []string {
 	defer tm.mu.RUnlock()
 
 	var connected []string
-	for tunnelID, conn := range tm.connections {
-		if !conn.IsClosed() {
-			connected = append(connected, tunnelID)
+	for tunnelID, conns := range tm.connections {
+		for _, conn := range conns {
+			if !conn.IsClosed() {
+				connected = append(connected, tunnelID)
+				break
+			}
 		}
 	}
 
 	return connected
 }
 
-// OpenStream opens a stream to a tunnel
-func (tm *TunnelManager) OpenStream(tunnelID, target string, streamType string) (*tunnel.Connection, error) {
-	conn, exists := tm.GetConnection(tunnelID)
-	if !exists {
-		return nil, fmt.Errorf("tunnel %s is not connected", tunnelID)
+// Connections describes each live connection serving a tunnel
+func (tm *TunnelManager) Connections(tunnelID string) []models.ConnectionInfo {
+	infos := []models.ConnectionInfo{}
+	for _, conn := range tm.liveConnections(tunnelID) {
+		info := models.ConnectionInfo{
+			ID:            conn.ID(),
+			RemoteAddr:    conn.RemoteAddr().String(),
+			ConnectedAt:   conn.ConnectedAt(),
+			LastPing:      conn.LastPing(),
+			ActiveStreams: conn.NumStreams(),
+			Draining:      conn.IsDraining(),
+			Pools:         conn.PoolHealth(),
+		}
+		if hello := conn.Hello(); hello != nil {
+			info.Hostname = hello.Hostname
+			info.ClientVersion = hello.ClientVersion
+			info.OS = hello.OS
+			info.Arch = hello.Arch
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// OpenStream opens a stream to a tunnel on the least loaded connection. If
+// a connection fails before the client has seen the stream, the next one is
+// tried, so a dropped replica does not fail requests while others remain.
+// Errors reported by the client itself are returned as-is.
+func (tm *TunnelManager) OpenStream(tunnelID string, header tunnel.StreamHeader) (net.Conn, error) {
+	conns := tm.pickConnections(tunnelID)
+	if len(conns) == 0 {
+		return nil, ErrTunnelNotConnected
+	}
+
+	var lastErr error
+	for _, conn := range conns {
+		stream, err := conn.OpenStream(header)
+		if err == nil {
+			return stream, nil
+		}
+
+		var streamErr *tunnel.StreamError
+		if errors.As(err, &streamErr) {
+			return nil, err
+		}
+
+		log.Printf("Failed to open stream on connection %s for tunnel %s: %v", conn.ID(), tunnelID, err)
+		lastErr = err
 	}
 
-	return conn, nil
+	return nil, fmt.Errorf("all connections for tunnel %s failed: %w", tunnelID, lastErr)
 }
 
 // healthCheckRoutine performs periodic health checks
@@ -287,22 +557,32 @@ func (tm *TunnelManager) healthCheckRoutine() {
 // performHealthChecks checks the health of all connections
 func (tm *TunnelManager) performHealthChecks() {
 	tm.mu.RLock()
-	connections := make(map[string]*tunnel.Connection)
-	for id, conn := range tm.connections {
-		connections[id] = conn
+	connections := make(map[string][]*tunnel.Connection)
+	for id, conns := range tm.connections {
+		connections[id] = append([]*tunnel.Connection(nil), conns...)
 	}
 	tm.mu.RUnlock()
 
-	for tunnelID, conn := range connections {
-		if conn.IsClosed() {
-			continue
+	for tunnelID, conns := range connections {
+		for _, conn := range conns {
+			tm.checkConnection(tunnelID, conn)
 		}
+	}
+}
 
-		// Check if connection is stale
-		if time.Since(conn.LastPing()) > tunnel.PingInterval*3 {
-			log.Printf("Connection for tunnel %s is stale, closing", tunnelID)
-			conn.Close()
-			
+// checkConnection pings a single connection, closing it if it is stale.
+// Failures only count as downtime when no other connection remains.
+func (tm *TunnelManager) checkConnection(tunnelID string, conn *tunnel.Connection) {
+	if conn.IsClosed() {
+		return
+	}
+
+	// Check if connection is stale
+	if time.Since(conn.LastPing()) > tunnel.PingInterval*3 {
+		log.Printf("Connection %s for tunnel %s is stale, closing", conn.ID(), tunnelID)
+		conn.Close()
+
+		if len(tm.liveConnections(tunnelID)) == 0 {
 			// Record as down
 			check := &models.Check{
 				TunnelID:  tunnelID,
@@ -313,14 +593,16 @@ func (tm *TunnelManager) performHealthChecks() {
 			if err := tm.store.CreateCheck(check); err != nil {
 				log.Printf("Failed to record timeout check: %v", err)
 			}
-			continue
 		}
+		return
+	}
 
-		// Send ping
-		if err := conn.Ping(); err != nil {
-			log.Printf("Failed to ping tunnel %s: %v", tunnelID, err)
-			conn.Close()
-			
+	// Send ping
+	if err := conn.Ping(); err != nil {
+		log.Printf("Failed to ping connection %s for tunnel %s: %v", conn.ID(), tunnelID, err)
+		conn.Close()
+
+		if len(tm.liveConnections(tunnelID)) == 0 {
 			// Record as down
 			check := &models.Check{
 				TunnelID:  tunnelID,
@@ -357,6 +639,65 @@ func (tm *TunnelManager) cleanupRoutine() {
 	}
 }
 
+// reapRoutine periodically deletes ephemeral tunnels whose clients are gone
+func (tm *TunnelManager) reapRoutine() {
+	defer tm.wg.Done()
+
+	interval := min(max(tm.reapGrace/2, time.Second), time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tm.ctx.Done():
+			return
+		case <-ticker.C:
+			tm.reapEphemeralTunnels()
+		}
+	}
+}
+
+// reapEphemeralTunnels deletes the ephemeral tunnels that have had no
+// connection for the grace period. A tunnel that never connected counts
+// from its creation, and none count from before the server started, so a
+// restart gives every client time to reconnect.
+func (tm *TunnelManager) reapEphemeralTunnels() {
+	tunnels, err := tm.store.ListTunnels()
+	if err != nil {
+		log.Printf("Failed to list tunnels to reap: %v", err)
+		return
+	}
+
+	for _, tunnelObj := range tunnels {
+		if !tunnelObj.Ephemeral || tm.IsConnected(tunnelObj.ID) {
+			continue
+		}
+
+		tm.mu.RLock()
+		goneSince, seen := tm.lastSeen[tunnelObj.ID]
+		tm.mu.RUnlock()
+		if !seen {
+			goneSince = tunnelObj.CreatedAt
+		}
+		if goneSince.Before(tm.startedAt) {
+			goneSince = tm.startedAt
+		}
+		if time.Since(goneSince) < tm.reapGrace {
+			continue
+		}
+
+		log.Printf("Removing ephemeral tunnel %s (%s): no client for %s", tunnelObj.Name, tunnelObj.ID, tm.reapGrace)
+		if err := tm.removeTunnel(tunnelObj.ID); err != nil {
+			log.Printf("Failed to remove ephemeral tunnel %s: %v", tunnelObj.ID, err)
+			continue
+		}
+
+		tm.mu.Lock()
+		delete(tm.lastSeen, tunnelObj.ID)
+		tm.mu.Unlock()
+	}
+}
+
 // stringPtr returns a pointer to a string
 func stringPtr(s string) *string {
 	return &s
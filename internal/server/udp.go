@@ -0,0 +1,215 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/models"
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+// udpQueueSize is how many datagrams from a peer are buffered while its
+// stream is being opened; further datagrams are dropped
+const udpQueueSize = 64
+
+// udpListener relays datagrams between a public UDP socket and the tunnel.
+// Each remote peer gets its own stream so replies can be routed back.
+type udpListener struct {
+	pm       *ProxyManager
+	service  *models.Service
+	conn     *net.UDPConn
+	sessions map[string]*udpSession // peer address -> session
+	mu       sync.Mutex
+}
+
+// udpSession is the stream carrying one remote peer's datagrams
+type udpSession struct {
+	peer         *net.UDPAddr
+	queue        chan []byte
+	lastActivity atomic.Int64 // unix nanoseconds
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// startUDPListener binds a UDP socket for a service
+func (pm *ProxyManager) startUDPListener(service *models.Service) error {
+	if _, exists := pm.udpListeners[service.ListenAddr]; exists {
+		return fmt.Errorf("UDP listener already exists for %s", service.ListenAddr)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", service.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid UDP listen address %s: %w", service.ListenAddr, err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", service.ListenAddr, err)
+	}
+
+	listener := &udpListener{
+		pm:       pm,
+		service:  service,
+		conn:     conn,
+		sessions: make(map[string]*udpSession),
+	}
+	pm.udpListeners[service.ListenAddr] = listener
+
+	log.Printf("UDP listener started on %s for service %s", service.ListenAddr, service.ID)
+
+	go listener.serve()
+
+	return nil
+}
+
+// serve reads datagrams and hands them to the peer's session
+func (l *udpListener) serve() {
+	defer l.closeSessions()
+
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		n, peer, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("UDP read error for %s: %v", l.service.ListenAddr, err)
+			return
+		}
+
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+
+		session := l.session(peer)
+		select {
+		case session.queue <- datagram:
+		default:
+			// Like any UDP hop, drop rather than block other peers
+		}
+	}
+}
+
+// session returns the session for a peer, starting one if needed
+func (l *udpListener) session(peer *net.UDPAddr) *udpSession {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := peer.String()
+	if session, exists := l.sessions[key]; exists {
+		return session
+	}
+
+	session := &udpSession{
+		peer:  peer,
+		queue: make(chan []byte, udpQueueSize),
+		done:  make(chan struct{}),
+	}
+	session.touch()
+	l.sessions[key] = session
+
+	go l.runSession(session)
+	return session
+}
+
+// runSession opens the stream for a session and relays datagrams until the
+// session goes idle or either side closes
+func (l *udpListener) runSession(session *udpSession) {
+	defer l.removeSession(session)
+
+	requestID, _ := generateRandomID()
+	header := tunnel.StreamHeader{
+		Type:       "udp",
+		Target:     l.service.TargetAddr,
+		RemoteAddr: session.peer.String(),
+		ServiceID:  l.service.ID,
+		RequestID:  requestID,
+	}
+
+	stream, err := l.pm.tunnelManager.OpenStream(l.service.TunnelID, header)
+	if err != nil {
+		log.Printf("[%s] Failed to open stream for UDP service: %v", requestID, err)
+		l.pm.recordStreamError(l.service, err)
+		return
+	}
+	defer stream.Close()
+
+	log.Printf("[%s] Relaying UDP from %s to %s", requestID, session.peer, l.service.TargetAddr)
+
+	// Replies from the target go back to the peer
+	go func() {
+		defer session.close()
+
+		buf := make([]byte, tunnel.MaxDatagramSize)
+		for {
+			n, err := tunnel.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			session.touch()
+			if _, err := l.conn.WriteToUDP(buf[:n], session.peer); err != nil {
+				log.Printf("[%s] UDP write to %s failed: %v", requestID, session.peer, err)
+				return
+			}
+		}
+	}()
+
+	idle := time.NewTicker(tunnel.UDPIdleTimeout / 4)
+	defer idle.Stop()
+
+	for {
+		select {
+		case datagram := <-session.queue:
+			session.touch()
+			if err := tunnel.WriteDatagram(stream, datagram); err != nil {
+				log.Printf("[%s] UDP stream write failed: %v", requestID, err)
+				return
+			}
+		case <-idle.C:
+			if session.idleFor() > tunnel.UDPIdleTimeout {
+				log.Printf("[%s] UDP session for %s idle, closing", requestID, session.peer)
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// removeSession forgets a finished session so the peer's next datagram
+// starts a new one
+func (l *udpListener) removeSession(session *udpSession) {
+	session.close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions[session.peer.String()] == session {
+		delete(l.sessions, session.peer.String())
+	}
+}
+
+// closeSessions ends every session once the listener stops
+func (l *udpListener) closeSessions() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, session := range l.sessions {
+		session.close()
+	}
+}
+
+// Close stops the listener and its sessions
+func (l *udpListener) Close() error {
+	return l.conn.Close()
+}
+
+func (s *udpSession) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastActivity.Load()))
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
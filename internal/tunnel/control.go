@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+// MaxControlMessageSize is the largest control frame accepted from a peer
+const MaxControlMessageSize = 1 << 20
+
+// ControlStream carries control messages over a dedicated yamux stream.
+// Each message is framed as a 4-byte big-endian length followed by JSON.
+type ControlStream struct {
+	stream  net.Conn
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+// NewControlStream creates a control stream on top of a yamux stream
+func NewControlStream(stream net.Conn) *ControlStream {
+	return &ControlStream{stream: stream}
+}
+
+// openControlStream establishes the reserved control stream. The client
+// opens it as the first stream of the session and the server accepts it
+// before any data streams are exchanged.
+func openControlStream(session *yamux.Session, isServer bool) (*ControlStream, error) {
+	if !isServer {
+		stream, err := session.OpenStream()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open control stream: %w", err)
+		}
+		return NewControlStream(stream), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+
+	stream, err := session.AcceptStreamWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept control stream: %w", err)
+	}
+	return NewControlStream(stream), nil
+}
+
+// WriteMessage writes a single control message
+func (cs *ControlStream) WriteMessage(msg models.TunnelMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal control message: %w", err)
+	}
+
+	if len(data) > MaxControlMessageSize {
+		return fmt.Errorf("control message too large: %d bytes", len(data))
+	}
+
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+
+	cs.stream.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	_, err = cs.stream.Write(buf)
+	return err
+}
+
+// ReadMessage reads a single control message
+func (cs *ControlStream) ReadMessage() (*models.TunnelMessage, error) {
+	return cs.readMessage(ReadTimeout)
+}
+
+// readMessage reads a single control message with the given deadline
+func (cs *ControlStream) readMessage(timeout time.Duration) (*models.TunnelMessage, error) {
+	cs.readMu.Lock()
+	defer cs.readMu.Unlock()
+
+	cs.stream.SetReadDeadline(time.Now().Add(timeout))
+
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(cs.stream, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	msgLen := binary.BigEndian.Uint32(lenBuf[:])
+	if msgLen == 0 || msgLen > MaxControlMessageSize {
+		return nil, fmt.Errorf("invalid control message length: %d", msgLen)
+	}
+
+	data := make([]byte, msgLen)
+	if _, err := io.ReadFull(cs.stream, data); err != nil {
+		return nil, err
+	}
+
+	var msg models.TunnelMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal control message: %w", err)
+	}
+	return &msg, nil
+}
+
+// Close closes the control stream
+func (cs *ControlStream) Close() error {
+	return cs.stream.Close()
+}
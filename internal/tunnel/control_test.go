@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+func TestControlStreamRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go NewControlStream(a).WriteMessage(models.TunnelMessage{Type: "reject", Reason: "bad token"})
+
+	msg, err := NewControlStream(b).ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if msg.Type != "reject" || msg.Reason != "bad token" {
+		t.Fatalf("got %+v, want the rejection that was sent", msg)
+	}
+}
+
+func TestControlStreamRejectsInvalidLengths(t *testing.T) {
+	tests := []struct {
+		name   string
+		length uint32
+	}{
+		{"empty", 0},
+		{"one past the limit", MaxControlMessageSize + 1},
+		{"maximum", 0xFFFFFFFF},
+	}
+
+	for _, test := range tests {
+		a, b := net.Pipe()
+
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], test.length)
+		go a.Write(prefix[:])
+
+		_, err := NewControlStream(b).ReadMessage()
+		if err == nil || !strings.Contains(err.Error(), "invalid control message length") {
+			t.Errorf("%s frame: got error %v, want an invalid length", test.name, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestControlStreamRefusesOversizedWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	msg := models.TunnelMessage{Type: "reject", Reason: strings.Repeat("x", MaxControlMessageSize)}
+	if err := NewControlStream(a).WriteMessage(msg); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("got error %v, want the message refused as too large", err)
+	}
+}
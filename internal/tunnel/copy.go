@@ -0,0 +1,179 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// ErrIdleTimeout is returned by CopyBidirectional when no data moved in
+// either direction for the idle timeout
+var ErrIdleTimeout = errors.New("connection idle timeout")
+
+// copyBufferSize matches io.Copy's default buffer
+const copyBufferSize = 32 * 1024
+
+// CopyResult reports the bytes copied in each direction
+type CopyResult struct {
+	AToB int64 // bytes read from a and written to b
+	BToA int64 // bytes read from b and written to a
+}
+
+// CopyBidirectional copies data between a and b until both directions have
+// finished. When one side stops sending, only the write half of the other
+// side is closed, so protocols that shut down their sending side and then
+// wait for a reply keep working across the tunnel. Both connections are
+// closed on return. A non-zero idleTimeout closes both connections once no
+// data has moved in either direction for that long.
+func CopyBidirectional(a, b net.Conn, idleTimeout time.Duration) (CopyResult, error) {
+	var result CopyResult
+	var activity atomic.Int64
+	activity.Store(time.Now().UnixNano())
+
+	var (
+		closeOnce sync.Once
+		closing   atomic.Bool
+		errMu     sync.Mutex
+		firstErr  error
+	)
+
+	// abort tears down both connections so the other direction unblocks
+	abort := func(err error) {
+		errMu.Lock()
+		if firstErr == nil && !closing.Load() {
+			firstErr = err
+		}
+		errMu.Unlock()
+
+		closeOnce.Do(func() {
+			closing.Store(true)
+			a.Close()
+			b.Close()
+
+			// Closing a yamux stream only ends its write side, so expire
+			// deadlines to unblock any pending reads
+			a.SetDeadline(time.Now())
+			b.SetDeadline(time.Now())
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		n, err := copyHalf(b, a, &activity)
+		atomic.AddInt64(&result.AToB, n)
+		if err != nil {
+			abort(err)
+			return
+		}
+		if !closeWrite(b) {
+			abort(nil)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		n, err := copyHalf(a, b, &activity)
+		atomic.AddInt64(&result.BToA, n)
+		if err != nil {
+			abort(err)
+			return
+		}
+		if !closeWrite(a) {
+			abort(nil)
+		}
+	}()
+
+	done := make(chan struct{})
+	if idleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(idleCheckInterval(idleTimeout))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					idle := time.Since(time.Unix(0, activity.Load()))
+					if idle >= idleTimeout {
+						abort(ErrIdleTimeout)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+
+	closeOnce.Do(func() {
+		a.Close()
+		b.Close()
+	})
+
+	errMu.Lock()
+	defer errMu.Unlock()
+	return result, firstErr
+}
+
+// copyHalf copies src to dst until src reaches EOF, recording activity
+func copyHalf(dst, src net.Conn, activity *atomic.Int64) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var written int64
+
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			activity.Store(time.Now().UnixNano())
+			w, writeErr := dst.Write(buf[:n])
+			written += int64(w)
+			if writeErr != nil {
+				return written, writeErr
+			}
+		}
+
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// closeWrite signals end of data to the peer while leaving the read side
+// open. It returns false if the connection cannot be half-closed, in which
+// case the copy has to be torn down completely.
+func closeWrite(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		// TCP, Unix and TLS connections
+		return c.CloseWrite() == nil
+	case *yamux.Stream:
+		// Closing a yamux stream sends FIN but keeps receiving until the
+		// peer closes its side too
+		return c.Close() == nil
+	}
+	return false
+}
+
+// idleCheckInterval picks how often the idle watchdog wakes up
+func idleCheckInterval(idleTimeout time.Duration) time.Duration {
+	interval := idleTimeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	return interval
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxDatagramSize is the largest UDP payload carried in a single frame
+const MaxDatagramSize = 0xFFFF
+
+// UDPIdleTimeout is how long a UDP stream may go without traffic in either
+// direction before it is closed. It is a variable so tests can shorten it.
+var UDPIdleTimeout = 60 * time.Second
+
+// WriteDatagram writes one datagram to a stream, framed as a 2-byte
+// big-endian length followed by the payload. Streams carry a byte stream,
+// so the framing preserves datagram boundaries end to end.
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(p))
+	}
+
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads one framed datagram into buf, which must be at least
+// MaxDatagramSize bytes, and returns the payload length
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(lenBuf[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("datagram of %d bytes exceeds buffer", n)
+	}
+
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
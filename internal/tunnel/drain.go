@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"context"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+// FeatureDrain indicates the peer understands drain control messages
+const FeatureDrain = "drain"
+
+// drainPollInterval is how often WaitIdle checks for remaining streams
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain starts a graceful shutdown of the connection. No new streams are
+// opened or accepted, the peer is told to route new streams elsewhere, and
+// streams already in flight keep running until they finish or the
+// connection is closed.
+func (c *Connection) Drain(reason string) error {
+	c.SetDraining()
+
+	var err error
+	if c.HasFeature(FeatureDrain) {
+		err = c.SendMessage(models.TunnelMessage{Type: "drain", Reason: reason})
+	}
+
+	// GoAway rejects new streams from the peer even if it predates the
+	// drain message
+	if goAwayErr := c.session.GoAway(); err == nil {
+		err = goAwayErr
+	}
+	return err
+}
+
+// SetDraining marks the connection as draining, either because this side is
+// shutting down or because the peer announced it is
+func (c *Connection) SetDraining() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+// IsDraining returns whether the connection is draining
+func (c *Connection) IsDraining() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.draining
+}
+
+// WaitIdle blocks until no data streams remain, the connection closes or
+// the context is done. It returns true if the connection went idle.
+func (c *Connection) WaitIdle(ctx context.Context) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if c.IsClosed() || c.NumStreams() == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"fmt"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+// Protocol versions understood by this build. The version is bumped for
+// incompatible wire changes; additive changes are negotiated as features.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
+
+// SupportedFeatures lists the optional protocol features this build
+// implements. Only features advertised by both peers are enabled.
+var SupportedFeatures = []string{
+	FeatureStreamHeaderV2,
+	FeatureStreamResponse,
+	FeatureDrain,
+	FeatureServices,
+	FeatureHealth,
+}
+
+// FeatureServices lets a client declare the services it wants exposed in
+// its hello. A client advertises it only when it manages its own services,
+// so an empty declaration list removes services it declared earlier.
+const FeatureServices = "services"
+
+// HandshakeError is returned when the server rejects a client's hello
+type HandshakeError struct {
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake rejected: %s", e.Reason)
+}
+
+// ClientHandshake sends the client's hello and waits for the server's reply
+func (c *Connection) ClientHandshake(hello models.Hello) (*models.Welcome, error) {
+	if err := c.SendMessage(models.TunnelMessage{Type: "hello", Hello: &hello}); err != nil {
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	msg, err := c.control.readMessage(HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake reply: %w", err)
+	}
+
+	switch msg.Type {
+	case "welcome":
+		if msg.Welcome == nil {
+			return nil, fmt.Errorf("welcome message missing payload")
+		}
+		c.setHandshake(&hello, msg.Welcome.Features)
+		return msg.Welcome, nil
+	case "reject":
+		return nil, &HandshakeError{Reason: msg.Reason}
+	default:
+		return nil, fmt.Errorf("unexpected handshake reply: %s", msg.Type)
+	}
+}
+
+// ServerHandshake reads the client's hello and replies with either a
+// welcome or a rejection. The accept callback may refuse the client by
+// returning an error, whose message is sent back as the reason, or add to
+// the welcome before it is sent.
+func (c *Connection) ServerHandshake(serverVersion string, accept func(hello *models.Hello, welcome *models.Welcome) error) (*models.Hello, error) {
+	msg, err := c.control.readMessage(HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello: %w", err)
+	}
+
+	if msg.Type != "hello" || msg.Hello == nil {
+		return nil, c.reject(fmt.Sprintf("expected hello, got %q", msg.Type))
+	}
+	hello := msg.Hello
+
+	if hello.ProtocolVersion < MinProtocolVersion || hello.ProtocolVersion > ProtocolVersion {
+		return hello, c.reject(fmt.Sprintf("unsupported protocol version %d (server supports %d-%d)",
+			hello.ProtocolVersion, MinProtocolVersion, ProtocolVersion))
+	}
+
+	features := negotiateFeatures(hello.Features)
+	welcome := &models.Welcome{
+		ProtocolVersion: ProtocolVersion,
+		ServerVersion:   serverVersion,
+		Features:        features,
+	}
+
+	if accept != nil {
+		if err := accept(hello, welcome); err != nil {
+			return hello, c.reject(err.Error())
+		}
+	}
+
+	if err := c.SendMessage(models.TunnelMessage{Type: "welcome", Welcome: welcome}); err != nil {
+		return hello, fmt.Errorf("failed to send welcome: %w", err)
+	}
+
+	c.setHandshake(hello, features)
+	return hello, nil
+}
+
+// reject sends a rejection to the client and returns it as an error
+func (c *Connection) reject(reason string) error {
+	if err := c.SendMessage(models.TunnelMessage{Type: "reject", Reason: reason}); err != nil {
+		return fmt.Errorf("failed to send rejection (%s): %w", reason, err)
+	}
+	return &HandshakeError{Reason: reason}
+}
+
+// negotiateFeatures returns the features supported by both peers
+func negotiateFeatures(requested []string) []string {
+	enabled := []string{}
+	for _, feature := range requested {
+		for _, supported := range SupportedFeatures {
+			if feature == supported {
+				enabled = append(enabled, feature)
+				break
+			}
+		}
+	}
+	return enabled
+}
+
+// setHandshake records the outcome of a successful handshake
+func (c *Connection) setHandshake(hello *models.Hello, features []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hello = hello
+	c.features = make(map[string]bool, len(features))
+	for _, feature := range features {
+		c.features[feature] = true
+	}
+}
+
+// Hello returns the client's hello, once the handshake has completed
+func (c *Connection) Hello() *models.Hello {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hello
+}
+
+// HasFeature returns whether a feature was negotiated for this connection
+func (c *Connection) HasFeature(feature string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.features[feature]
+}
@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+// handshake runs a client hello against a server over an in-memory pipe,
+// returning the client's outcome and both ends of the connection
+func handshake(t *testing.T, hello models.Hello, accept func(*models.Hello, *models.Welcome) error) (*models.Welcome, *Connection, *Connection, error) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	type result struct {
+		conn *Connection
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := NewConnection(b, "", true)
+		if err == nil {
+			_, err = conn.ServerHandshake("test", accept)
+		}
+		done <- result{conn, err}
+	}()
+
+	conn, err := NewConnection(a, "", false)
+	if err != nil {
+		t.Fatalf("NewConnection: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	welcome, err := conn.ClientHandshake(hello)
+	server := <-done
+	if server.conn != nil {
+		t.Cleanup(func() { server.conn.Close() })
+	}
+	if (err == nil) != (server.err == nil) {
+		t.Fatalf("client handshake returned %v, but the server returned %v", err, server.err)
+	}
+	return welcome, conn, server.conn, err
+}
+
+func TestHandshakeRejectsUnsupportedVersions(t *testing.T) {
+	for _, version := range []int{0, MinProtocolVersion - 1, ProtocolVersion + 1} {
+		_, _, _, err := handshake(t, models.Hello{ProtocolVersion: version}, nil)
+
+		var rejected *HandshakeError
+		if !errors.As(err, &rejected) {
+			t.Errorf("hello with version %d: got %v, want a rejection", version, err)
+		}
+	}
+}
+
+func TestHandshakeNegotiatesFeatures(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		want      []string
+	}{
+		{"none", nil, []string{}},
+		{"supported", []string{FeatureStreamHeaderV2, FeatureDrain}, []string{FeatureStreamHeaderV2, FeatureDrain}},
+		{"unknown ignored", []string{"compression", FeatureStreamResponse, "future"}, []string{FeatureStreamResponse}},
+	}
+
+	for _, test := range tests {
+		welcome, _, server, err := handshake(t, models.Hello{ProtocolVersion: ProtocolVersion, Features: test.requested}, nil)
+		if err != nil {
+			t.Fatalf("%s: handshake: %v", test.name, err)
+		}
+		if !slices.Equal(welcome.Features, test.want) {
+			t.Errorf("%s: welcome enabled %v, want %v", test.name, welcome.Features, test.want)
+		}
+		for _, feature := range SupportedFeatures {
+			if server.HasFeature(feature) != slices.Contains(test.want, feature) {
+				t.Errorf("%s: server HasFeature(%q) = %v", test.name, feature, server.HasFeature(feature))
+			}
+		}
+		if server.HasFeature("future") {
+			t.Errorf("%s: server enabled a feature it does not support", test.name)
+		}
+	}
+}
+
+func TestHandshakeAcceptCallbackRejects(t *testing.T) {
+	_, _, _, err := handshake(t, models.Hello{ProtocolVersion: ProtocolVersion}, func(*models.Hello, *models.Welcome) error {
+		return errors.New("invalid token")
+	})
+
+	var rejected *HandshakeError
+	if !errors.As(err, &rejected) || rejected.Reason != "invalid token" {
+		t.Fatalf("got %v, want the callback's rejection", err)
+	}
+}
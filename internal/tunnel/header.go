@@ -0,0 +1,255 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Stream header versions. Version 1 is a length-prefixed JSON document;
+// version 2 is a compact binary encoding. A v2 header starts with a zero
+// length, which v1 readers reject, followed by the version byte.
+const (
+	StreamHeaderV1 = 1
+	StreamHeaderV2 = 2
+
+	// MaxStreamHeaderSize bounds the encoded size of a stream header
+	MaxStreamHeaderSize = 0xFFFF
+)
+
+// Flags carried in the last byte of a v2 header body
+const headerFlagExpectResponse = 1 << 0
+
+// FeatureStreamHeaderV2 is negotiated when both peers understand v2 headers
+const FeatureStreamHeaderV2 = "stream-header-v2"
+
+// StreamHeader contains metadata for a stream
+type StreamHeader struct {
+	Type       string            `json:"type"`                  // "http" or "tcp"
+	Target     string            `json:"target"`                // target address to forward to
+	RemoteAddr string            `json:"remote_addr,omitempty"` // address of the original client
+	ServiceID  string            `json:"service_id,omitempty"`  // service that matched the request
+	Host       string            `json:"host,omitempty"`        // HTTP Host or TLS SNI
+	RequestID  string            `json:"request_id,omitempty"`  // correlates client and server logs
+	Metadata   map[string]string `json:"metadata,omitempty"`
+
+	// ExpectResponse asks the client to report the stream's outcome with
+	// a response frame before any payload (see StreamHeader.Respond)
+	ExpectResponse bool `json:"expect_response,omitempty"`
+
+	// Version is the wire version the header was received with
+	Version int `json:"-"`
+}
+
+// ValidTargetName reports whether name can be the NAME of a pool://NAME or
+// static://NAME target: letters, digits, '-', '_' and '.' only. The server
+// and clients check names alike, so a service never targets a name no
+// client could define.
+func ValidTargetName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteStreamHeader writes a header using the given wire version
+func WriteStreamHeader(w io.Writer, header StreamHeader, version int) error {
+	var buf []byte
+	var err error
+
+	switch version {
+	case StreamHeaderV1:
+		buf, err = encodeStreamHeaderV1(header)
+	case StreamHeaderV2:
+		buf, err = encodeStreamHeaderV2(header)
+	default:
+		return fmt.Errorf("unsupported stream header version: %d", version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+// ReadStreamHeader reads a header of any supported wire version
+func ReadStreamHeader(r io.Reader) (StreamHeader, error) {
+	// Read header length (2 bytes)
+	headerLenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, headerLenBuf); err != nil {
+		return StreamHeader{}, fmt.Errorf("failed to read header length: %w", err)
+	}
+
+	headerLen := int(binary.BigEndian.Uint16(headerLenBuf))
+	if headerLen == 0 {
+		return readStreamHeaderV2(r)
+	}
+	return readStreamHeaderV1(r, headerLen)
+}
+
+// encodeStreamHeaderV1 encodes length (2 bytes) + JSON + newline
+func encodeStreamHeaderV1(header StreamHeader) ([]byte, error) {
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal header: %w", err)
+	}
+
+	headerLen := len(headerData)
+	if headerLen > MaxStreamHeaderSize {
+		return nil, fmt.Errorf("header too large: %d bytes", headerLen)
+	}
+
+	buf := make([]byte, 2+headerLen+1)
+	binary.BigEndian.PutUint16(buf, uint16(headerLen))
+	copy(buf[2:], headerData)
+	buf[2+headerLen] = '\n'
+	return buf, nil
+}
+
+// readStreamHeaderV1 reads the JSON body of a v1 header
+func readStreamHeaderV1(r io.Reader, headerLen int) (StreamHeader, error) {
+	// Read header + newline
+	headerBuf := make([]byte, headerLen+1)
+	if _, err := io.ReadFull(r, headerBuf); err != nil {
+		return StreamHeader{}, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if headerBuf[headerLen] != '\n' {
+		return StreamHeader{}, fmt.Errorf("header not terminated with newline")
+	}
+
+	var header StreamHeader
+	if err := json.Unmarshal(headerBuf[:headerLen], &header); err != nil {
+		return StreamHeader{}, fmt.Errorf("failed to unmarshal header: %w", err)
+	}
+	header.Version = StreamHeaderV1
+	return header, nil
+}
+
+// encodeStreamHeaderV2 encodes the binary header:
+//
+//	0x0000 | version (1) | body length (2) | body
+//
+// The body is a sequence of uvarint length-prefixed strings (type, target,
+// remote address, service ID, host, request ID) followed by a uvarint
+// metadata count and that many key/value string pairs, then a flags byte.
+// Readers ignore any bytes after the fields they know, so fields can be
+// appended later; fields missing from older writers keep their zero value.
+func encodeStreamHeaderV2(header StreamHeader) ([]byte, error) {
+	body := make([]byte, 0, 128)
+	for _, field := range []string{
+		header.Type, header.Target, header.RemoteAddr,
+		header.ServiceID, header.Host, header.RequestID,
+	} {
+		body = appendString(body, field)
+	}
+
+	body = binary.AppendUvarint(body, uint64(len(header.Metadata)))
+	for key, value := range header.Metadata {
+		body = appendString(body, key)
+		body = appendString(body, value)
+	}
+
+	var flags byte
+	if header.ExpectResponse {
+		flags |= headerFlagExpectResponse
+	}
+	body = append(body, flags)
+
+	if len(body) > MaxStreamHeaderSize {
+		return nil, fmt.Errorf("header too large: %d bytes", len(body))
+	}
+
+	buf := make([]byte, 5, 5+len(body))
+	buf[2] = StreamHeaderV2
+	binary.BigEndian.PutUint16(buf[3:], uint16(len(body)))
+	return append(buf, body...), nil
+}
+
+// readStreamHeaderV2 reads a binary header after its zero length marker
+func readStreamHeaderV2(r io.Reader) (StreamHeader, error) {
+	prefix := make([]byte, 3)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return StreamHeader{}, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if prefix[0] != StreamHeaderV2 {
+		return StreamHeader{}, fmt.Errorf("unsupported stream header version: %d", prefix[0])
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(prefix[1:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return StreamHeader{}, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	br := bytes.NewReader(body)
+	header := StreamHeader{Version: StreamHeaderV2}
+	for _, field := range []*string{
+		&header.Type, &header.Target, &header.RemoteAddr,
+		&header.ServiceID, &header.Host, &header.RequestID,
+	} {
+		value, err := readString(br)
+		if err != nil {
+			return StreamHeader{}, fmt.Errorf("malformed header: %w", err)
+		}
+		*field = value
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return StreamHeader{}, fmt.Errorf("malformed header metadata: %w", err)
+	}
+	if count > 0 {
+		header.Metadata = make(map[string]string)
+	}
+	for i := uint64(0); i < count; i++ {
+		key, err := readString(br)
+		if err != nil {
+			return StreamHeader{}, fmt.Errorf("malformed header metadata: %w", err)
+		}
+		value, err := readString(br)
+		if err != nil {
+			return StreamHeader{}, fmt.Errorf("malformed header metadata: %w", err)
+		}
+		header.Metadata[key] = value
+	}
+
+	if flags, err := br.ReadByte(); err == nil {
+		header.ExpectResponse = flags&headerFlagExpectResponse != 0
+	}
+
+	return header, nil
+}
+
+// appendString appends a uvarint length-prefixed string
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// readString reads a uvarint length-prefixed string
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
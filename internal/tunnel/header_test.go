@@ -0,0 +1,206 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/models"
+)
+
+func TestStreamHeaderRoundTrip(t *testing.T) {
+	headers := []StreamHeader{
+		{},
+		{Type: "tcp", Target: "localhost:22"},
+		{
+			Type:           "http",
+			Target:         "localhost:3000",
+			RemoteAddr:     "203.0.113.7:51234",
+			ServiceID:      "svc-1",
+			Host:           "app.example.com",
+			RequestID:      "req-1",
+			Metadata:       map[string]string{"proto": "h2", "empty": ""},
+			ExpectResponse: true,
+		},
+		{Type: "tcp", Target: "ünïcode.example:443", Host: strings.Repeat("h", 300)},
+	}
+
+	for _, version := range []int{StreamHeaderV1, StreamHeaderV2} {
+		for _, header := range headers {
+			var buf bytes.Buffer
+			if err := WriteStreamHeader(&buf, header, version); err != nil {
+				t.Fatalf("v%d WriteStreamHeader(%+v): %v", version, header, err)
+			}
+			buf.WriteString("payload")
+
+			got, err := ReadStreamHeader(&buf)
+			if err != nil {
+				t.Fatalf("v%d ReadStreamHeader(%+v): %v", version, header, err)
+			}
+			want := header
+			want.Version = version
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("v%d round trip = %+v, want %+v", version, got, want)
+			}
+			if rest := buf.String(); rest != "payload" {
+				t.Errorf("v%d header consumed payload, left %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestStreamHeaderRejectsOversized(t *testing.T) {
+	header := StreamHeader{Type: "tcp", Target: strings.Repeat("x", MaxStreamHeaderSize)}
+
+	for _, version := range []int{StreamHeaderV1, StreamHeaderV2} {
+		var buf bytes.Buffer
+		err := WriteStreamHeader(&buf, header, version)
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("v%d: got error %v, want the header refused as too large", version, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("v%d: wrote %d bytes of an oversized header", version, buf.Len())
+		}
+	}
+}
+
+func TestStreamHeaderRejectsTruncated(t *testing.T) {
+	header := StreamHeader{Type: "http", Target: "localhost:3000", Metadata: map[string]string{"k": "v"}}
+
+	for _, version := range []int{StreamHeaderV1, StreamHeaderV2} {
+		var buf bytes.Buffer
+		if err := WriteStreamHeader(&buf, header, version); err != nil {
+			t.Fatalf("v%d WriteStreamHeader: %v", version, err)
+		}
+		encoded := buf.Bytes()
+
+		for n := range len(encoded) {
+			if _, err := ReadStreamHeader(bytes.NewReader(encoded[:n])); err == nil {
+				t.Errorf("v%d header truncated to %d of %d bytes was accepted", version, n, len(encoded))
+			}
+		}
+	}
+}
+
+func TestStreamHeaderV2Body(t *testing.T) {
+	// v2 frames a hand-built body: marker, version, body length, body
+	frame := func(version byte, body []byte) []byte {
+		buf := []byte{0, 0, version, 0, 0}
+		binary.BigEndian.PutUint16(buf[3:], uint16(len(body)))
+		return append(buf, body...)
+	}
+	fields := func(values ...string) []byte {
+		var body []byte
+		for _, value := range values {
+			body = appendString(body, value)
+		}
+		return body
+	}
+	base := fields("tcp", "localhost:22", "", "", "", "")
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    StreamHeader
+		wantErr bool
+	}{
+		{
+			name:  "no flags byte from an older writer",
+			input: frame(StreamHeaderV2, append(base, 0)),
+			want:  StreamHeader{Type: "tcp", Target: "localhost:22"},
+		},
+		{
+			name:  "unknown flags are ignored",
+			input: frame(StreamHeaderV2, append(base, 0, 0xFE|headerFlagExpectResponse)),
+			want:  StreamHeader{Type: "tcp", Target: "localhost:22", ExpectResponse: true},
+		},
+		{
+			name:  "trailing fields from a newer writer are ignored",
+			input: frame(StreamHeaderV2, append(base, 0, 0, 'n', 'e', 'w')),
+			want:  StreamHeader{Type: "tcp", Target: "localhost:22"},
+		},
+		{
+			name:    "unknown version",
+			input:   frame(3, append(base, 0, 0)),
+			wantErr: true,
+		},
+		{
+			name:    "string longer than the body",
+			input:   frame(StreamHeaderV2, append(fields("tcp"), 0x7F, 'x')),
+			wantErr: true,
+		},
+		{
+			name:    "missing fields",
+			input:   frame(StreamHeaderV2, fields("tcp", "localhost:22")),
+			wantErr: true,
+		},
+		{
+			name:    "metadata count beyond the body",
+			input:   frame(StreamHeaderV2, append(base, 5, 1, 'k', 1, 'v')),
+			wantErr: true,
+		},
+		{
+			name:    "malformed uvarint",
+			input:   frame(StreamHeaderV2, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ReadStreamHeader(bytes.NewReader(test.input))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		test.want.Version = StreamHeaderV2
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOpenStreamFallsBackToV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []string
+		want     int
+	}{
+		{"not negotiated", nil, StreamHeaderV1},
+		{"negotiated", []string{FeatureStreamHeaderV2}, StreamHeaderV2},
+	}
+
+	for _, test := range tests {
+		_, client, server, err := handshake(t, models.Hello{ProtocolVersion: ProtocolVersion, Features: test.features}, nil)
+		if err != nil {
+			t.Fatalf("%s: handshake: %v", test.name, err)
+		}
+
+		stream, err := server.OpenStream(StreamHeader{Type: "tcp", Target: "localhost:22"})
+		if err != nil {
+			t.Fatalf("%s: OpenStream: %v", test.name, err)
+		}
+		defer stream.Close()
+
+		accepted, err := client.Accept()
+		if err != nil {
+			t.Fatalf("%s: Accept: %v", test.name, err)
+		}
+		defer accepted.Close()
+
+		header, err := ReadStreamHeader(accepted)
+		if err != nil {
+			t.Fatalf("%s: ReadStreamHeader: %v", test.name, err)
+		}
+		if header.Version != test.want || header.Target != "localhost:22" {
+			t.Errorf("%s: got v%d header %+v, want v%d", test.name, header.Version, header, test.want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package tunnel
+
+import "github.com/jclement/picotunnel/internal/models"
+
+// FeatureHealth indicates the peer understands health control messages,
+// which carry the state of the client's backend pools
+const FeatureHealth = "health"
+
+// SendHealth reports the client's pool health to the server. Nothing is
+// sent to a server that predates health messages.
+func (c *Connection) SendHealth(pools []models.PoolHealth) error {
+	if !c.HasFeature(FeatureHealth) {
+		return nil
+	}
+	return c.SendMessage(models.TunnelMessage{Type: "health", Health: pools})
+}
+
+// SetPoolHealth records the pool health last reported by the client
+func (c *Connection) SetPoolHealth(pools []models.PoolHealth) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.poolHealth = pools
+}
+
+// PoolHealth returns the pool health last reported by the client
+func (c *Connection) PoolHealth() []models.PoolHealth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.poolHealth
+}
@@ -2,20 +2,13 @@ package tunnel
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
-// StreamHeader contains metadata for a stream
-type StreamHeader struct {
-	Type   string `json:"type"`   // "http" or "tcp"
-	Target string `json:"target"` // target address to forward to
-}
-
 // StreamManager manages multiple streams over a tunnel connection
 type StreamManager struct {
 	conn     *Connection
@@ -49,6 +42,19 @@ func (sm *StreamManager) RegisterHandler(streamType string, handler StreamHandle
 	sm.handlers[streamType] = handler
 }
 
+// HandlerTypes returns the registered stream types in sorted order
+func (sm *StreamManager) HandlerTypes() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	types := make([]string, 0, len(sm.handlers))
+	for streamType := range sm.handlers {
+		types = append(types, streamType)
+	}
+	sort.Strings(types)
+	return types
+}
+
 // Start starts handling streams
 func (sm *StreamManager) Start() error {
 	sm.wg.Add(1)
@@ -61,47 +67,18 @@ func (sm *StreamManager) Start() error {
 	return nil
 }
 
-// Stop stops the stream manager
+// Stop stops the stream manager. The connection is closed first so that
+// the accept loop and any remaining stream handlers unblock.
 func (sm *StreamManager) Stop() error {
 	sm.cancel()
+	err := sm.conn.Close()
 	sm.wg.Wait()
-	return sm.conn.Close()
+	return err
 }
 
 // OpenStream opens a new stream with header
 func (sm *StreamManager) OpenStream(header StreamHeader) (net.Conn, error) {
-	stream, err := sm.conn.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
-	}
-
-	// Send header
-	headerData, err := json.Marshal(header)
-	if err != nil {
-		stream.Close()
-		return nil, fmt.Errorf("failed to marshal header: %w", err)
-	}
-
-	headerLen := len(headerData)
-	if headerLen > 0xFFFF {
-		stream.Close()
-		return nil, fmt.Errorf("header too large: %d bytes", headerLen)
-	}
-
-	// Write header length (2 bytes) + header + newline
-	buf := make([]byte, 2+headerLen+1)
-	buf[0] = byte(headerLen >> 8)
-	buf[1] = byte(headerLen & 0xFF)
-	copy(buf[2:], headerData)
-	buf[2+headerLen] = '\n'
-
-	_, err = stream.Write(buf)
-	if err != nil {
-		stream.Close()
-		return nil, fmt.Errorf("failed to write header: %w", err)
-	}
-
-	return stream, nil
+	return sm.conn.OpenStream(header)
 }
 
 // handleStreams handles incoming streams
@@ -137,34 +114,9 @@ func (sm *StreamManager) handleStreams() {
 
 // handleStream processes a single stream
 func (sm *StreamManager) handleStream(stream net.Conn) error {
-	// Read header length (2 bytes)
-	headerLenBuf := make([]byte, 2)
-	_, err := io.ReadFull(stream, headerLenBuf)
-	if err != nil {
-		return fmt.Errorf("failed to read header length: %w", err)
-	}
-
-	headerLen := int(headerLenBuf[0])<<8 | int(headerLenBuf[1])
-	if headerLen == 0 || headerLen > 0xFFFF {
-		return fmt.Errorf("invalid header length: %d", headerLen)
-	}
-
-	// Read header + newline
-	headerBuf := make([]byte, headerLen+1)
-	_, err = io.ReadFull(stream, headerBuf)
-	if err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
-	}
-
-	if headerBuf[headerLen] != '\n' {
-		return fmt.Errorf("header not terminated with newline")
-	}
-
-	// Parse header
-	var header StreamHeader
-	err = json.Unmarshal(headerBuf[:headerLen], &header)
+	header, err := ReadStreamHeader(stream)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal header: %w", err)
+		return err
 	}
 
 	// Find handler
@@ -173,6 +125,7 @@ func (sm *StreamManager) handleStream(stream net.Conn) error {
 	sm.mu.RUnlock()
 
 	if !exists {
+		header.Respond(stream, StreamNoHandler, fmt.Sprintf("client has no handler for %q streams", header.Type))
 		return fmt.Errorf("no handler for stream type: %s", header.Type)
 	}
 
@@ -198,32 +151,3 @@ func (sm *StreamManager) pingRoutine() {
 		}
 	}
 }
-
-// CopyBidirectional copies data bidirectionally between two connections
-func CopyBidirectional(conn1, conn2 net.Conn) error {
-	var wg sync.WaitGroup
-	var err1, err2 error
-
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		defer conn1.Close()
-		defer conn2.Close()
-		_, err1 = io.Copy(conn1, conn2)
-	}()
-
-	go func() {
-		defer wg.Done()
-		defer conn1.Close()
-		defer conn2.Close()
-		_, err2 = io.Copy(conn2, conn1)
-	}()
-
-	wg.Wait()
-
-	if err1 != nil {
-		return err1
-	}
-	return err2
-}
\ No newline at end of file
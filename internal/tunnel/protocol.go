@@ -1,15 +1,13 @@
 package tunnel
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
 	"github.com/jclement/picotunnel/internal/models"
 )
@@ -20,27 +18,52 @@ const (
 	WriteTimeout    = 10 * time.Second
 	ReadTimeout     = 60 * time.Second
 	HandshakeTimeout = 10 * time.Second
+
+	// DialTimeout bounds how long the client spends connecting to a target
+	DialTimeout = 10 * time.Second
+	// StreamResponseTimeout bounds how long the server waits for the
+	// client to report a stream's outcome
+	StreamResponseTimeout = DialTimeout + 5*time.Second
 )
 
-// Connection wraps a WebSocket connection with yamux multiplexing
+// Connection wraps a transport connection with yamux multiplexing. Control
+// messages travel on a dedicated stream so they never share frames with
+// the yamux session itself.
 type Connection struct {
-	ws       *websocket.Conn
-	session  *yamux.Session
-	token    string
-	mu       sync.RWMutex
-	closed   bool
-	lastPing time.Time
+	id          string
+	conn        net.Conn
+	session     *yamux.Session
+	control     *ControlStream
+	token       string
+	hello       *models.Hello
+	features    map[string]bool
+	poolHealth  []models.PoolHealth
+	mu          sync.RWMutex
+	closed      bool
+	draining    bool
+	lastPing    time.Time
+	connectedAt time.Time
+	pingSentAt  time.Time
+	rtt         time.Duration
 }
 
-// NewConnection creates a new tunnel connection
-func NewConnection(ws *websocket.Conn, token string, isServer bool) (*Connection, error) {
-	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
-	ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+// NewConnection creates a new tunnel connection over a transport
+// connection returned by a Transport (or accepted by the server)
+func NewConnection(nc net.Conn, token string, isServer bool) (*Connection, error) {
+	nc.SetReadDeadline(time.Now().Add(ReadTimeout))
+	nc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate connection ID: %w", err)
+	}
 
 	conn := &Connection{
-		ws:       ws,
-		token:    token,
-		lastPing: time.Now(),
+		id:          hex.EncodeToString(idBytes),
+		conn:        nc,
+		token:       token,
+		lastPing:    time.Now(),
+		connectedAt: time.Now(),
 	}
 
 	// Set up yamux session
@@ -48,25 +71,34 @@ func NewConnection(ws *websocket.Conn, token string, isServer bool) (*Connection
 	var err error
 
 	if isServer {
-		session, err = yamux.Server(NewWebSocketConn(ws), nil)
+		session, err = yamux.Server(nc, nil)
 	} else {
-		session, err = yamux.Client(NewWebSocketConn(ws), nil)
+		session, err = yamux.Client(nc, nil)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create yamux session: %w", err)
 	}
 
+	control, err := openControlStream(session, isServer)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	// The handshake deadlines no longer apply; liveness is tracked by the
+	// yamux keepalive and the control stream's own read deadline.
+	nc.SetReadDeadline(time.Time{})
+	nc.SetWriteDeadline(time.Time{})
+
 	conn.session = session
+	conn.control = control
 	return conn, nil
 }
 
 // Accept accepts a new stream (server side)
 func (c *Connection) Accept() (net.Conn, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	if c.closed {
+	if c.IsClosed() {
 		return nil, fmt.Errorf("connection closed")
 	}
 
@@ -75,56 +107,74 @@ func (c *Connection) Accept() (net.Conn, error) {
 
 // Open opens a new stream (client side)
 func (c *Connection) Open() (net.Conn, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	if c.closed {
+	if c.IsClosed() {
 		return nil, fmt.Errorf("connection closed")
 	}
+	if c.IsDraining() {
+		return nil, fmt.Errorf("connection is draining")
+	}
 
 	return c.session.Open()
 }
 
-// SendMessage sends a control message
-func (c *Connection) SendMessage(msg models.TunnelMessage) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// OpenStream opens a new stream and writes its header, using the binary
+// header format when the peer negotiated it. If the peer supports stream
+// responses, OpenStream waits for the outcome and returns a *StreamError
+// when the client could not set the stream up.
+func (c *Connection) OpenStream(header StreamHeader) (net.Conn, error) {
+	stream, err := c.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
 
-	if c.closed {
-		return fmt.Errorf("connection closed")
+	version := StreamHeaderV1
+	if c.HasFeature(FeatureStreamHeaderV2) {
+		version = StreamHeaderV2
 	}
+	header.ExpectResponse = c.HasFeature(FeatureStreamResponse)
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
+	if err := WriteStreamHeader(stream, header, version); err != nil {
+		stream.Close()
+		return nil, err
 	}
 
-	c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
-	return c.ws.WriteMessage(websocket.TextMessage, data)
-}
+	if header.ExpectResponse {
+		stream.SetReadDeadline(time.Now().Add(StreamResponseTimeout))
+		err := ReadStreamResponse(stream)
+		stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
 
-// ReadMessage reads a control message
-func (c *Connection) ReadMessage() (*models.TunnelMessage, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	return stream, nil
+}
 
-	if c.closed {
-		return nil, fmt.Errorf("connection closed")
+// SendMessage sends a message on the control stream
+func (c *Connection) SendMessage(msg models.TunnelMessage) error {
+	if c.IsClosed() {
+		return fmt.Errorf("connection closed")
 	}
 
-	c.ws.SetReadDeadline(time.Now().Add(ReadTimeout))
-	_, data, err := c.ws.ReadMessage()
-	if err != nil {
-		return nil, err
+	return c.control.WriteMessage(msg)
+}
+
+// ReadMessage reads a message from the control stream
+func (c *Connection) ReadMessage() (*models.TunnelMessage, error) {
+	if c.IsClosed() {
+		return nil, fmt.Errorf("connection closed")
 	}
 
-	var msg models.TunnelMessage
-	err = json.Unmarshal(data, &msg)
-	return &msg, err
+	return c.control.ReadMessage()
 }
 
 // Ping sends a ping message
 func (c *Connection) Ping() error {
+	c.mu.Lock()
+	c.pingSentAt = time.Now()
+	c.mu.Unlock()
+
 	return c.SendMessage(models.TunnelMessage{Type: "ping"})
 }
 
@@ -140,6 +190,27 @@ func (c *Connection) UpdateLastPing() {
 	c.lastPing = time.Now()
 }
 
+// PongReceived records a pong answering our last ping, updating the last
+// ping time and the round-trip time
+func (c *Connection) PongReceived() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastPing = time.Now()
+	if !c.pingSentAt.IsZero() {
+		c.rtt = c.lastPing.Sub(c.pingSentAt)
+		c.pingSentAt = time.Time{}
+	}
+}
+
+// RTT returns the round-trip time of the last answered ping, or 0 if no
+// ping has been answered yet
+func (c *Connection) RTT() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rtt
+}
+
 // LastPing returns the last ping time
 func (c *Connection) LastPing() time.Time {
 	c.mu.RLock()
@@ -152,6 +223,30 @@ func (c *Connection) Token() string {
 	return c.token
 }
 
+// ID returns a random identifier for this connection
+func (c *Connection) ID() string {
+	return c.id
+}
+
+// RemoteAddr returns the peer's transport address
+func (c *Connection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ConnectedAt returns when the connection was established
+func (c *Connection) ConnectedAt() time.Time {
+	return c.connectedAt
+}
+
+// NumStreams returns the number of active data streams
+func (c *Connection) NumStreams() int {
+	// The control stream is always open and is not counted
+	if n := c.session.NumStreams() - 1; n > 0 {
+		return n
+	}
+	return 0
+}
+
 // Close closes the connection
 func (c *Connection) Close() error {
 	c.mu.Lock()
@@ -163,105 +258,20 @@ func (c *Connection) Close() error {
 
 	c.closed = true
 
+	if c.control != nil {
+		c.control.Close()
+	}
 	if c.session != nil {
 		c.session.Close()
 	}
 
-	return c.ws.Close()
+	return c.conn.Close()
 }
 
-// IsClosed returns whether the connection is closed
+// IsClosed returns whether the connection is closed, either locally or
+// because the underlying yamux session has shut down
 func (c *Connection) IsClosed() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.closed
-}
-
-// WebSocketConn wraps a WebSocket connection to implement net.Conn interface
-type WebSocketConn struct {
-	ws       *websocket.Conn
-	reader   io.Reader
-	readBuf  []byte
-	readMu   sync.Mutex
-	writeMu  sync.Mutex
+	return c.closed || (c.session != nil && c.session.IsClosed())
 }
-
-// NewWebSocketConn creates a new WebSocket connection wrapper
-func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
-	return &WebSocketConn{ws: ws}
-}
-
-// Read implements io.Reader
-func (w *WebSocketConn) Read(b []byte) (int, error) {
-	w.readMu.Lock()
-	defer w.readMu.Unlock()
-
-	if w.reader == nil {
-		_, r, err := w.ws.NextReader()
-		if err != nil {
-			return 0, err
-		}
-		w.reader = r
-	}
-
-	n, err := w.reader.Read(b)
-	if err == io.EOF {
-		w.reader = nil
-	}
-	return n, err
-}
-
-// Write implements io.Writer
-func (w *WebSocketConn) Write(b []byte) (int, error) {
-	w.writeMu.Lock()
-	defer w.writeMu.Unlock()
-
-	writer, err := w.ws.NextWriter(websocket.BinaryMessage)
-	if err != nil {
-		return 0, err
-	}
-	defer writer.Close()
-
-	return writer.Write(b)
-}
-
-// Close implements io.Closer
-func (w *WebSocketConn) Close() error {
-	return w.ws.Close()
-}
-
-// LocalAddr implements net.Conn
-func (w *WebSocketConn) LocalAddr() net.Addr {
-	return w.ws.LocalAddr()
-}
-
-// RemoteAddr implements net.Conn
-func (w *WebSocketConn) RemoteAddr() net.Addr {
-	return w.ws.RemoteAddr()
-}
-
-// SetDeadline implements net.Conn
-func (w *WebSocketConn) SetDeadline(t time.Time) error {
-	if err := w.SetReadDeadline(t); err != nil {
-		return err
-	}
-	return w.SetWriteDeadline(t)
-}
-
-// SetReadDeadline implements net.Conn
-func (w *WebSocketConn) SetReadDeadline(t time.Time) error {
-	return w.ws.SetReadDeadline(t)
-}
-
-// SetWriteDeadline implements net.Conn
-func (w *WebSocketConn) SetWriteDeadline(t time.Time) error {
-	return w.ws.SetWriteDeadline(t)
-}
-
-// Upgrader for WebSocket connections
-var Upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow connections from any origin
-	},
-	Subprotocols: []string{"tunnel"},
-}
\ No newline at end of file
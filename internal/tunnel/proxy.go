@@ -0,0 +1,210 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyFunc returns the proxy to reach a server URL through, or nil to
+// connect directly
+type ProxyFunc func(target *url.URL) (*url.URL, error)
+
+// ProxyFromEnvironment picks a proxy from HTTPS_PROXY (HTTP_PROXY for ws://
+// servers) and NO_PROXY, the same way Go's HTTP client does. Servers on
+// localhost are always reached directly.
+func ProxyFromEnvironment(target *url.URL) (*url.URL, error) {
+	return httpproxy.FromEnvironment().ProxyFunc()(proxyRequestURL(target))
+}
+
+// ProxyURL sends every connection through proxyURL, except servers matched
+// by NO_PROXY or on localhost
+func ProxyURL(proxyURL *url.URL) ProxyFunc {
+	return func(target *url.URL) (*url.URL, error) {
+		config := &httpproxy.Config{
+			HTTPProxy:  proxyURL.String(),
+			HTTPSProxy: proxyURL.String(),
+			NoProxy:    httpproxy.FromEnvironment().NoProxy,
+		}
+		return config.ProxyFunc()(proxyRequestURL(target))
+	}
+}
+
+// ParseProxyURL parses a proxy given as http://, https://, socks5:// or
+// socks5h:// URL, with optional user:password credentials. A bare
+// host:port is taken as an HTTP proxy.
+func ParseProxyURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+	}
+
+	return proxyURL, nil
+}
+
+// proxyRequestURL maps a server URL onto the HTTP URL proxy selection is
+// based on: ws:// uses the HTTP proxy, wss:// and tls:// the HTTPS proxy
+func proxyRequestURL(target *url.URL) *url.URL {
+	u := *target
+	if u.Scheme == "ws" {
+		u.Scheme = "http"
+	} else {
+		u.Scheme = "https"
+	}
+	return &u
+}
+
+// dialServer opens a TCP connection to addr, the host:port of target,
+// through the proxy chosen by opts.Proxy
+func dialServer(ctx context.Context, target *url.URL, addr string, opts DialOptions) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: HandshakeTimeout}
+
+	if opts.Proxy == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	proxyURL, err := opts.Proxy(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to choose proxy: %w", err)
+	}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return dialHTTPProxy(ctx, dialer, proxyURL, addr)
+	case "socks5", "socks5h":
+		return dialSOCKS5Proxy(ctx, dialer, proxyURL, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+}
+
+// dialHTTPProxy opens a tunnel to addr with an HTTP CONNECT request,
+// authenticating with the proxy URL's credentials if it has any
+func dialHTTPProxy(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyHostPort(proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyURL.Host, err)
+	}
+
+	// The CONNECT exchange is bounded by the dial context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", proxyURL.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %w", proxyURL.Host, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %w", proxyURL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyURL.Host, addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5Proxy connects to addr through a SOCKS5 proxy. The proxy
+// resolves the server's hostname.
+func dialSOCKS5Proxy(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	socks, err := proxy.SOCKS5("tcp", proxyHostPort(proxyURL), auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %s failed to connect to %s: %w", proxyURL.Host, addr, err)
+	}
+	return conn, nil
+}
+
+// proxyHostPort returns the proxy's host:port, filling in the default port
+// for its scheme
+func proxyHostPort(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	port := "1080"
+	switch proxyURL.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// bufferedConn returns bytes the proxy sent right after its CONNECT
+// response before reading from the connection again
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
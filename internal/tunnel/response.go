@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// FeatureStreamResponse is negotiated when the client reports the outcome
+// of each stream before any payload flows
+const FeatureStreamResponse = "stream-response"
+
+// StreamStatus is the outcome of setting up a stream on the client
+type StreamStatus uint8
+
+// Stream statuses reported in response frames
+const (
+	StreamOK StreamStatus = iota
+	StreamDialRefused
+	StreamDialTimeout
+	StreamDenied
+	StreamNoHandler
+	StreamFailed
+)
+
+// String returns a short description of the status
+func (s StreamStatus) String() string {
+	switch s {
+	case StreamOK:
+		return "ok"
+	case StreamDialRefused:
+		return "dial-refused"
+	case StreamDialTimeout:
+		return "timeout"
+	case StreamDenied:
+		return "denied-by-policy"
+	case StreamNoHandler:
+		return "no-handler"
+	case StreamFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// StreamError is returned when the client reports that a stream failed
+type StreamError struct {
+	Status  StreamStatus
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("stream failed: %s", e.Status)
+	}
+	return fmt.Sprintf("stream failed: %s: %s", e.Status, e.Message)
+}
+
+// Respond writes the stream's response frame if the peer asked for one:
+//
+//	status (1) | message length (2) | message
+func (h StreamHeader) Respond(w io.Writer, status StreamStatus, message string) error {
+	if !h.ExpectResponse {
+		return nil
+	}
+
+	if len(message) > 0xFFFF {
+		message = message[:0xFFFF]
+	}
+
+	buf := make([]byte, 3+len(message))
+	buf[0] = byte(status)
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(message)))
+	copy(buf[3:], message)
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write stream response: %w", err)
+	}
+	return nil
+}
+
+// ReadStreamResponse reads a response frame, returning a *StreamError if
+// the client reported anything other than StreamOK
+func ReadStreamResponse(r io.Reader) error {
+	prefix := make([]byte, 3)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return fmt.Errorf("failed to read stream response: %w", err)
+	}
+
+	message := make([]byte, binary.BigEndian.Uint16(prefix[1:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return fmt.Errorf("failed to read stream response: %w", err)
+	}
+
+	status := StreamStatus(prefix[0])
+	if status == StreamOK {
+		return nil
+	}
+	return &StreamError{Status: status, Message: string(message)}
+}
+
+// DialStatus classifies a dial error into a stream status
+func DialStatus(err error) StreamStatus {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return StreamDialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ENOENT):
+		// A missing Unix socket means nothing is listening, like a refused port
+		return StreamDialRefused
+	default:
+		return StreamFailed
+	}
+}
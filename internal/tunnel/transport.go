@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// Transport establishes the byte stream a tunnel session is multiplexed
+// over. The returned connection is handed to NewConnection.
+type Transport interface {
+	Dial(ctx context.Context, target *url.URL, opts DialOptions) (net.Conn, error)
+}
+
+// DialOptions configures how a transport connects to the server
+type DialOptions struct {
+	Token     string
+	UserAgent string
+	TLSConfig *tls.Config // nil for plaintext connections
+	Proxy     ProxyFunc   // nil connects directly
+}
+
+// TransportForScheme returns the transport for a server URL scheme
+func TransportForScheme(scheme string) (Transport, error) {
+	switch scheme {
+	case "ws", "wss":
+		return WebSocketTransport{}, nil
+	case "tls":
+		return TLSTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport scheme: %q", scheme)
+	}
+}
+
+// TLSTransport carries tunnel sessions directly over TLS, avoiding the
+// WebSocket framing overhead when no HTTP infrastructure sits in between
+type TLSTransport struct{}
+
+// Dial implements Transport
+func (TLSTransport) Dial(ctx context.Context, target *url.URL, opts DialOptions) (net.Conn, error) {
+	if opts.TLSConfig == nil {
+		return nil, fmt.Errorf("TLS transport requires a TLS configuration")
+	}
+
+	nc, err := dialServer(ctx, target, target.Host, opts)
+	if err != nil {
+		return nil, fmt.Errorf("TLS dial failed: %w", err)
+	}
+
+	conn := tls.Client(nc, opts.TLSConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("TLS dial failed: %w", err)
+	}
+
+	return conn, nil
+}
+
+// Listen accepts TLS transport connections on addr
+func (TLSTransport) Listen(addr string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return nil, fmt.Errorf("TLS transport requires a TLS configuration")
+	}
+
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketTransport carries tunnel sessions over a WebSocket connection,
+// which traverses HTTP proxies and load balancers
+type WebSocketTransport struct{}
+
+// Dial implements Transport
+func (WebSocketTransport) Dial(ctx context.Context, target *url.URL, opts DialOptions) (net.Conn, error) {
+	u := *target
+	if u.Path == "" {
+		u.Path = "/tunnel"
+	}
+
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialServer(ctx, target, addr, opts)
+		},
+		HandshakeTimeout: HandshakeTimeout,
+		TLSClientConfig:  opts.TLSConfig,
+	}
+
+	// The token goes in a header rather than the URL, which ends up in
+	// access logs along the way
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+opts.Token)
+	if opts.UserAgent != "" {
+		header.Set("User-Agent", opts.UserAgent)
+	}
+
+	ws, _, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket dial failed: %w", err)
+	}
+
+	return NewWebSocketConn(ws), nil
+}
+
+// WebSocketConn wraps a WebSocket connection to implement net.Conn interface
+type WebSocketConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader
+	readBuf []byte
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+// NewWebSocketConn creates a new WebSocket connection wrapper
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{ws: ws}
+}
+
+// Read implements io.Reader
+func (w *WebSocketConn) Read(b []byte) (int, error) {
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+
+	for {
+		if w.reader == nil {
+			_, r, err := w.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			w.reader = r
+		}
+
+		// The end of one WebSocket message is not the end of the stream;
+		// move on to the next message instead of surfacing io.EOF.
+		n, err := w.reader.Read(b)
+		if err == io.EOF {
+			w.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write implements io.Writer
+func (w *WebSocketConn) Write(b []byte) (int, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	writer, err := w.ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return 0, err
+	}
+	defer writer.Close()
+
+	return writer.Write(b)
+}
+
+// Close implements io.Closer
+func (w *WebSocketConn) Close() error {
+	return w.ws.Close()
+}
+
+// LocalAddr implements net.Conn
+func (w *WebSocketConn) LocalAddr() net.Addr {
+	return w.ws.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn
+func (w *WebSocketConn) RemoteAddr() net.Addr {
+	return w.ws.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn
+func (w *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := w.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (w *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return w.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn
+func (w *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return w.ws.SetWriteDeadline(t)
+}
+
+// Upgrader for WebSocket connections
+var Upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow connections from any origin
+	},
+	Subprotocols: []string{"tunnel"},
+}
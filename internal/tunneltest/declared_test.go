@@ -0,0 +1,143 @@
+package tunneltest_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/models"
+	"github.com/jclement/picotunnel/internal/server"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+// allowDeclaredServices lets a tunnel's client declare up to max services
+// under apps.test and on port
+func allowDeclaredServices(s *tunneltest.Server, tunnelID string, max, port int) {
+	enabled := true
+	suffixes := []string{"apps.test"}
+	portRange := strconv.Itoa(port)
+	s.UpdateTunnel(tunnelID, server.UpdateTunnelRequest{
+		ClientServices: &enabled,
+		MaxServices:    &max,
+		DomainSuffixes: &suffixes,
+		PortRange:      &portRange,
+	})
+}
+
+// declaredServices returns the names of a tunnel's services by source:
+// domains for HTTP services and listen ports for TCP and UDP
+func declaredServices(s *tunneltest.Server, tunnelID string) map[string][]string {
+	names := make(map[string][]string)
+	for _, service := range s.ListServices(tunnelID) {
+		name := service.Domain
+		if service.Type != "http" {
+			_, name, _ = net.SplitHostPort(service.ListenAddr)
+		}
+		names[service.Source] = append(names[service.Source], name)
+	}
+	for _, list := range names {
+		slices.Sort(list)
+	}
+	return names
+}
+
+// freePortNumber returns a currently unused TCP port
+func freePortNumber(t *testing.T) int {
+	t.Helper()
+
+	_, port, _ := net.SplitHostPort(tunneltest.FreePort(t, "tcp"))
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestDeclaredServicesRespectTunnelLimits(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("declared")
+	port := freePortNumber(t)
+	allowDeclaredServices(s, tunnel.ID, 3, port)
+
+	target := tunneltest.NewHTTPTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	echo := tunneltest.NewEchoTarget(t)
+	s.AddHTTPService(tunnel.ID, "taken.apps.test", target)
+
+	s.NewClientWithConfig(client.Config{
+		Token: tunnel.Token,
+		Services: []models.ServiceDeclaration{
+			{Type: "http", Domain: "one.apps.test", TargetAddr: target},
+			{Type: "http", Domain: "elsewhere.test", TargetAddr: target},  // outside the domain suffixes
+			{Type: "http", Domain: "taken.apps.test", TargetAddr: target}, // created through the API
+			{Type: "tcp", ListenPort: port, TargetAddr: echo},
+			{Type: "tcp", ListenPort: port + 1, TargetAddr: echo}, // outside the port range
+			{Type: "http", Domain: "two.apps.test", TargetAddr: target},
+			{Type: "http", Domain: "three.apps.test", TargetAddr: target}, // over max_services
+		},
+	})
+	s.WaitConnections(tunnel.ID, 1)
+
+	got := declaredServices(s, tunnel.ID)
+	if want := []string{strconv.Itoa(port), "one.apps.test", "two.apps.test"}; !slices.Equal(got["client"], want) {
+		t.Fatalf("client-declared services = %v, want %v", got["client"], want)
+	}
+	if want := []string{"taken.apps.test"}; !slices.Equal(got["api"], want) {
+		t.Fatalf("API services = %v, want %v", got["api"], want)
+	}
+
+	if body := proxyGet(t, s, "one.apps.test", "/"); body != "one.apps.test" {
+		t.Fatalf("got body %q from the declared service", body)
+	}
+	expectEcho(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+}
+
+func TestUndeclaredServicesAreRemoved(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("declared")
+	port := freePortNumber(t)
+	allowDeclaredServices(s, tunnel.ID, 0, port)
+
+	target := tunneltest.NewHTTPTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.AddHTTPService(tunnel.ID, "api.apps.test", target)
+
+	first := s.NewClientWithConfig(client.Config{
+		Token: tunnel.Token,
+		Services: []models.ServiceDeclaration{
+			{Type: "http", Domain: "kept.apps.test", TargetAddr: target},
+			{Type: "http", Domain: "dropped.apps.test", TargetAddr: target},
+			{Type: "tcp", ListenPort: port, TargetAddr: tunneltest.NewEchoTarget(t)},
+		},
+	})
+	s.WaitConnections(tunnel.ID, 1)
+	if got := declaredServices(s, tunnel.ID)["client"]; len(got) != 3 {
+		t.Fatalf("client-declared services = %v, want 3", got)
+	}
+	first.Stop()
+	s.WaitConnections(tunnel.ID, 0)
+
+	// The most recent hello wins, and services created through the API stay
+	s.NewClientWithConfig(client.Config{
+		Token: tunnel.Token,
+		Services: []models.ServiceDeclaration{
+			{Type: "http", Domain: "kept.apps.test", TargetAddr: target},
+		},
+	})
+	s.WaitConnections(tunnel.ID, 1)
+
+	got := declaredServices(s, tunnel.ID)
+	if want := []string{"kept.apps.test"}; !slices.Equal(got["client"], want) {
+		t.Fatalf("client-declared services = %v, want %v", got["client"], want)
+	}
+	if want := []string{"api.apps.test"}; !slices.Equal(got["api"], want) {
+		t.Fatalf("API services = %v, want %v", got["api"], want)
+	}
+
+	// The removed TCP service's listener is gone
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		conn.Close()
+		t.Fatalf("removed TCP service still listens on %d", port)
+	}
+}
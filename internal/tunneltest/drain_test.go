@@ -0,0 +1,151 @@
+package tunneltest_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+// slowTarget serves /slow once release is closed and anything else at
+// once. Each /slow request is announced on the returned channel.
+func slowTarget(t *testing.T, release chan struct{}) (string, chan struct{}) {
+	entered := make(chan struct{}, 1)
+	target := tunneltest.NewHTTPTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	return target, entered
+}
+
+// getAsync fetches a path through the proxy in the background, delivering
+// the body or an error once the request completes
+func getAsync(s *tunneltest.Server, host, path string) chan error {
+	done := make(chan error, 1)
+	go func() {
+		resp, err := s.ProxyGet(host, path)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		switch {
+		case err != nil:
+			done <- err
+		case resp.StatusCode != http.StatusOK || string(body) != path:
+			done <- fmt.Errorf("status %d: %s", resp.StatusCode, body)
+		default:
+			done <- nil
+		}
+	}()
+	return done
+}
+
+func TestClientShutdownDrainsToOtherConnection(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("drain")
+
+	release := make(chan struct{})
+	target, entered := slowTarget(t, release)
+	s.AddHTTPService(tunnel.ID, "app.test", target)
+
+	config := client.Config{Token: tunnel.Token, DrainTimeout: tunneltest.DefaultTimeout}
+	clients := []*client.Client{s.NewClientWithConfig(config), s.NewClientWithConfig(config)}
+	s.WaitConnections(tunnel.ID, 2)
+
+	slow := getAsync(s, "app.test", "/slow")
+	<-entered
+
+	busy, other := clients[0], clients[1]
+	if busy.Status().ActiveStreams == 0 {
+		busy, other = other, busy
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		busy.Stop()
+		close(stopped)
+	}()
+
+	tunneltest.Eventually(t, func() error {
+		for _, conn := range s.GetTunnel(tunnel.ID).Connections {
+			if conn.Draining {
+				return nil
+			}
+		}
+		return fmt.Errorf("no connection is draining")
+	})
+
+	// New streams go to the other client straight away, while the drained
+	// one still holds its request open
+	for range 5 {
+		if err := <-getAsync(s, "app.test", "/fast"); err != nil {
+			t.Fatalf("request during drain: %v", err)
+		}
+	}
+	select {
+	case <-stopped:
+		t.Fatalf("client stopped with a stream still in flight")
+	default:
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(tunneltest.DefaultTimeout):
+		t.Fatalf("client did not stop after its last stream finished")
+	}
+	s.WaitConnections(tunnel.ID, 1)
+	if got := other.Status().State; got != client.StateConnected {
+		t.Fatalf("remaining client is %s, want connected", got)
+	}
+}
+
+func TestServerShutdownFinishesInFlightStreams(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("drain")
+
+	release := make(chan struct{})
+	target, entered := slowTarget(t, release)
+	s.AddHTTPService(tunnel.ID, "app.test", target)
+
+	s.NewClient(tunnel.Token)
+	s.NewClient(tunnel.Token)
+	s.WaitConnections(tunnel.ID, 2)
+
+	slow := getAsync(s, "app.test", "/slow")
+	<-entered
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	// Stopping waits for the stream, up to the server's drain timeout
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatalf("server stopped with a stream still in flight")
+	default:
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+	<-stopped
+}
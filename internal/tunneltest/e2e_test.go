@@ -0,0 +1,182 @@
+package tunneltest_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+func TestHTTPProxying(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("http")
+
+	target := tunneltest.NewHTTPTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s%s", r.Host, r.URL.Path)
+	}))
+	s.AddHTTPService(tunnel.ID, "app.test", target)
+
+	s.NewClient(tunnel.Token)
+	s.WaitConnections(tunnel.ID, 1)
+
+	body := proxyGet(t, s, "app.test", "/path")
+	if want := "hello from app.test/path"; body != want {
+		t.Fatalf("got body %q, want %q", body, want)
+	}
+}
+
+func TestTCPProxying(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("tcp")
+	service := s.AddTCPService(tunnel.ID, tunneltest.NewEchoTarget(t))
+
+	s.NewClient(tunnel.Token)
+	s.WaitConnections(tunnel.ID, 1)
+
+	expectEcho(t, service.ListenAddr)
+}
+
+func TestTCPProxyingThroughPool(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("pool")
+	service := s.AddTCPService(tunnel.ID, "pool://echo")
+
+	s.NewClientWithConfig(client.Config{
+		Token: tunnel.Token,
+		Pools: map[string]client.PoolConfig{
+			"echo": {Backends: []string{tunneltest.NewEchoTarget(t), tunneltest.NewEchoTarget(t)}},
+		},
+	})
+	s.WaitConnections(tunnel.ID, 1)
+
+	// Each connection goes to the next backend, and half-closes through it
+	for range 2 {
+		expectEcho(t, service.ListenAddr)
+	}
+}
+
+func TestClientReconnectsAfterServerRestart(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("restart")
+
+	target := tunneltest.NewHTTPTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	s.AddHTTPService(tunnel.ID, "app.test", target)
+
+	s.NewClient(tunnel.Token)
+	s.WaitConnections(tunnel.ID, 1)
+
+	s.Restart()
+	s.WaitConnections(tunnel.ID, 1)
+
+	if body := proxyGet(t, s, "app.test", "/"); body != "ok" {
+		t.Fatalf("got body %q after restart, want %q", body, "ok")
+	}
+}
+
+func TestRegeneratedTokenRejectsOldToken(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("regenerate")
+
+	target := tunneltest.NewHTTPTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	s.AddHTTPService(tunnel.ID, "app.test", target)
+
+	s.NewClient(tunnel.Token)
+	s.WaitConnections(tunnel.ID, 1)
+	proxyGet(t, s, "app.test", "/")
+
+	newToken := s.RegenerateToken(tunnel.ID)
+	if newToken == tunnel.Token {
+		t.Fatalf("regenerated token matches the old one")
+	}
+
+	// The connected client is cut off and cannot get back in
+	s.WaitConnections(tunnel.ID, 0)
+	resp, err := s.ProxyGet("app.test", "/")
+	if err != nil {
+		t.Fatalf("proxy request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("request reached the client holding the old token")
+	}
+
+	old := client.NewClient(client.Config{
+		ServerAddr: s.TunnelAddr().String(),
+		Plaintext:  true,
+		Token:      tunnel.Token,
+		Version:    "test",
+	})
+	if err := old.Start(); err == nil {
+		old.Stop()
+		t.Fatalf("client with the old token connected")
+	}
+	old.Stop()
+
+	s.NewClient(newToken)
+	s.WaitConnections(tunnel.ID, 1)
+	if body := proxyGet(t, s, "app.test", "/"); body != "ok" {
+		t.Fatalf("got body %q with the new token, want %q", body, "ok")
+	}
+}
+
+// expectEcho sends a message through a TCP service to an echo target and
+// half-closes, expecting the message back before the target closes
+func expectEcho(t *testing.T, addr string) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, tunneltest.DefaultTimeout)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(tunneltest.DefaultTimeout))
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// Half-closing lets the echo finish and close, ending the read
+	conn.(*net.TCPConn).CloseWrite()
+
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("got %q, want %q", got, "ping")
+	}
+}
+
+// proxyGet fetches a path through the server's HTTP proxy, retrying until
+// the tunnel answers with 200
+func proxyGet(t *testing.T, s *tunneltest.Server, host, path string) string {
+	t.Helper()
+
+	var body string
+	tunneltest.Eventually(t, func() error {
+		resp, err := s.ProxyGet(host, path)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d: %s", resp.StatusCode, data)
+		}
+		body = string(data)
+		return nil
+	})
+	return body
+}
@@ -0,0 +1,17 @@
+package tunneltest_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/tunnel"
+)
+
+func TestMain(m *testing.M) {
+	// UDP sessions would otherwise take a minute to go idle. It is set once
+	// here, as sessions from one test may outlive it.
+	tunnel.UDPIdleTimeout = 2 * time.Second
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,254 @@
+package tunneltest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Proxy is a forward proxy standing in for a corporate egress proxy. It
+// records the address each client asked for and connects every request to
+// its upstream, so clients can use hostnames that do not resolve and still
+// reach the harness server.
+type Proxy struct {
+	URL *url.URL // proxy URL including credentials, for client.Config.Proxy
+
+	upstream string
+	username string
+	password string
+	requests []string
+	mu       sync.Mutex
+}
+
+// NewHTTPProxy runs an HTTP CONNECT proxy that forwards to upstream. When
+// username is set, requests must carry matching basic auth credentials.
+func NewHTTPProxy(t testing.TB, upstream, username, password string) *Proxy {
+	t.Helper()
+
+	p := &Proxy{upstream: upstream, username: username, password: password}
+	p.URL = p.listen(t, "http", p.serveHTTP)
+	return p
+}
+
+// NewSOCKS5Proxy runs a SOCKS5 proxy that forwards to upstream. When
+// username is set, clients must authenticate with matching credentials.
+func NewSOCKS5Proxy(t testing.TB, upstream, username, password string) *Proxy {
+	t.Helper()
+
+	p := &Proxy{upstream: upstream, username: username, password: password}
+	p.URL = p.listen(t, "socks5", p.serveSOCKS5)
+	return p
+}
+
+// Requests returns the addresses clients asked the proxy to connect to
+func (p *Proxy) Requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+// listen accepts connections on a loopback port and hands each to serve
+func (p *Proxy) listen(t testing.TB, scheme string, serve func(net.Conn)) *url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tunneltest: failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	proxyURL := &url.URL{Scheme: scheme, Host: l.Addr().String()}
+	if p.username != "" {
+		proxyURL.User = url.UserPassword(p.username, p.password)
+	}
+	return proxyURL
+}
+
+// serveHTTP answers a single CONNECT request and relays the connection
+func (p *Proxy) serveHTTP(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	if p.username != "" {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.username+":"+p.password))
+		if req.Header.Get("Proxy-Authorization") != want {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"tunneltest\"\r\n\r\n")
+			return
+		}
+	}
+
+	upstream, err := p.connect(req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	relay(&bufferedConn{Conn: conn, reader: reader}, upstream)
+}
+
+// serveSOCKS5 handles a SOCKS5 CONNECT (RFC 1928), with username and
+// password authentication (RFC 1929) when credentials are set
+func (p *Proxy) serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	var greeting [2]byte
+	if _, err := io.ReadFull(reader, greeting[:]); err != nil || greeting[0] != 5 {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+
+	method := byte(0x00)
+	if p.username != "" {
+		method = 0x02
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, method})
+
+	if method == 0x02 {
+		username, password, ok := readSOCKS5Credentials(reader)
+		if !ok || username != p.username || password != p.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil || header[1] != 1 {
+		return
+	}
+	var host string
+	switch header[3] {
+	case 1, 4: // IPv4, IPv6
+		ip := make(net.IP, 4)
+		if header[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3: // domain name
+		length, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(reader, port[:]); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	upstream, err := p.connect(addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	relay(&bufferedConn{Conn: conn, reader: reader}, upstream)
+}
+
+// readSOCKS5Credentials reads a username/password authentication request
+func readSOCKS5Credentials(reader *bufio.Reader) (string, string, bool) {
+	version, err := reader.ReadByte()
+	if err != nil || version != 1 {
+		return "", "", false
+	}
+
+	fields := make([]string, 2)
+	for i := range fields {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", false
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", "", false
+		}
+		fields[i] = string(field)
+	}
+	return fields[0], fields[1], true
+}
+
+// connect records a requested address and dials the upstream in its place
+func (p *Proxy) connect(addr string) (net.Conn, error) {
+	p.mu.Lock()
+	p.requests = append(p.requests, addr)
+	p.mu.Unlock()
+
+	return net.Dial("tcp", p.upstream)
+}
+
+// relay copies between two connections until either side closes
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// bufferedConn reads through a reader that may hold bytes the client sent
+// along with its proxy request
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,111 @@
+package tunneltest_test
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+// proxiedServer is a server name only the proxy stand-ins can reach, so a
+// client that connects at all must have gone through the proxy
+const proxiedServer = "tunnel.example.test:8443"
+
+func TestClientThroughProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		newProxy func(t testing.TB, upstream, username, password string) *tunneltest.Proxy
+		username string
+		password string
+	}{
+		{"http", tunneltest.NewHTTPProxy, "", ""},
+		{"http with basic auth", tunneltest.NewHTTPProxy, "user", "s3cret"},
+		{"socks5", tunneltest.NewSOCKS5Proxy, "", ""},
+		{"socks5 with password", tunneltest.NewSOCKS5Proxy, "user", "s3cret"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := tunneltest.NewServer(t)
+			tunnel := s.CreateTunnel("proxied")
+			proxy := test.newProxy(t, s.TunnelAddr().String(), test.username, test.password)
+
+			s.NewClientWithConfig(client.Config{
+				ServerAddr: "ws://" + proxiedServer,
+				Token:      tunnel.Token,
+				Proxy:      proxy.URL.String(),
+			})
+			s.WaitConnections(tunnel.ID, 1)
+
+			if requests := proxy.Requests(); !slices.Contains(requests, proxiedServer) {
+				t.Fatalf("proxy saw requests for %v, want %s", requests, proxiedServer)
+			}
+		})
+	}
+}
+
+func TestClientThroughProxyWrongCredentials(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("proxied")
+	proxy := tunneltest.NewHTTPProxy(t, s.TunnelAddr().String(), "user", "s3cret")
+
+	proxyURL := *proxy.URL
+	proxyURL.User = url.UserPassword("user", "wrong")
+
+	c := client.NewClient(client.Config{
+		ServerAddr: "ws://" + proxiedServer,
+		Token:      tunnel.Token,
+		Proxy:      proxyURL.String(),
+		Version:    "test",
+	})
+	err := c.Start()
+	c.Stop()
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("got error %v, want the proxy's 407", err)
+	}
+}
+
+func TestClientBypassesProxyForNoProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "example.test")
+
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("direct")
+	proxy := tunneltest.NewHTTPProxy(t, s.TunnelAddr().String(), "", "")
+
+	// Going direct, the client cannot resolve the name the proxy would
+	// have connected for it
+	c := client.NewClient(client.Config{
+		ServerAddr: "ws://" + proxiedServer,
+		Token:      tunnel.Token,
+		Proxy:      proxy.URL.String(),
+		Version:    "test",
+	})
+	err := c.Start()
+	c.Stop()
+	if err == nil {
+		t.Fatalf("client connected to %s without the proxy", proxiedServer)
+	}
+	if requests := proxy.Requests(); len(requests) > 0 {
+		t.Fatalf("proxy saw requests for %v despite NO_PROXY", requests)
+	}
+}
+
+func TestTLSTransportThroughProxy(t *testing.T) {
+	s := tunneltest.NewTLSServer(t)
+	tunnel := s.CreateTunnel("proxied")
+	proxy := tunneltest.NewHTTPProxy(t, s.TunnelTLSAddr().String(), "", "")
+
+	s.NewClientWithConfig(client.Config{
+		ServerAddr: "tls://" + proxiedServer,
+		Token:      tunnel.Token,
+		Proxy:      proxy.URL.String(),
+	})
+	s.WaitConnections(tunnel.ID, 1)
+
+	if requests := proxy.Requests(); !slices.Contains(requests, proxiedServer) {
+		t.Fatalf("proxy saw requests for %v, want %s", requests, proxiedServer)
+	}
+}
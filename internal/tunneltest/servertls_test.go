@@ -0,0 +1,158 @@
+package tunneltest_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+// startClient starts a client with exactly the given options, unlike
+// NewClientWithConfig, which skips certificate verification
+func startClient(t *testing.T, config client.Config) error {
+	t.Helper()
+
+	config.Version = "test"
+	c := client.NewClient(config)
+	err := c.Start()
+	c.Stop()
+	return err
+}
+
+// serverPin returns the SPKI pin of the certificate a TLS listener presents
+func serverPin(t *testing.T, addr string) string {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	return client.SPKIPin(conn.ConnectionState().PeerCertificates[0])
+}
+
+func TestServerCertificateVerification(t *testing.T) {
+	s := tunneltest.NewTLSServer(t)
+	tunnel := s.CreateTunnel("verified")
+
+	addr := s.TunnelTLSAddr().String()
+	pin := serverPin(t, addr)
+	otherPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name     string
+		insecure bool
+		tls      client.ServerTLSConfig
+		wantErr  string
+	}{
+		{"system roots", false, client.ServerTLSConfig{}, "certificate"},
+		{"CA", false, client.ServerTLSConfig{CAFile: s.CertFile()}, ""},
+		{"CA and pin", false, client.ServerTLSConfig{CAFile: s.CertFile(), Pins: []string{otherPin, pin}}, ""},
+		{"CA and wrong pin", false, client.ServerTLSConfig{CAFile: s.CertFile(), Pins: []string{otherPin}}, "matches no pin"},
+		{"insecure with pin", true, client.ServerTLSConfig{Pins: []string{pin}}, ""},
+		{"insecure with wrong pin", true, client.ServerTLSConfig{Pins: []string{otherPin}}, "matches no pin"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := startClient(t, client.Config{
+				ServerAddr: "tls://" + addr,
+				Token:      tunnel.Token,
+				Insecure:   test.insecure,
+				TLS:        test.tls,
+			})
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("client failed to connect: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want one mentioning %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientCertificateForFrontingProxy(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("mtls")
+
+	// A TLS front that requires a client certificate, relaying to the
+	// server's plain WebSocket listener
+	frontCert, frontKey := tunneltest.WriteCertificate(t)
+	clientCert, clientKey := tunneltest.WriteCertificate(t)
+	front := startMutualTLSFront(t, frontCert, frontKey, clientCert, s.TunnelAddr().String())
+
+	serverTLS := client.ServerTLSConfig{CAFile: frontCert}
+	if err := startClient(t, client.Config{ServerAddr: "wss://" + front, Token: tunnel.Token, TLS: serverTLS}); err == nil {
+		t.Fatalf("client without a certificate got past the front")
+	}
+
+	serverTLS.CertFile, serverTLS.KeyFile = clientCert, clientKey
+	if err := startClient(t, client.Config{ServerAddr: "wss://" + front, Token: tunnel.Token, TLS: serverTLS}); err != nil {
+		t.Fatalf("client with a certificate failed to connect: %v", err)
+	}
+}
+
+// startMutualTLSFront terminates TLS for clients presenting a certificate
+// signed by clientCA and relays them to upstream, returning its address
+func startMutualTLSFront(t *testing.T, certFile, keyFile, clientCA, upstream string) string {
+	t.Helper()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load front certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(clientCA)
+	if err != nil {
+		t.Fatalf("read client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				backend, err := net.Dial("tcp", upstream)
+				if err != nil {
+					return
+				}
+				defer backend.Close()
+
+				go func() {
+					io.Copy(backend, conn)
+					backend.Close()
+				}()
+				io.Copy(conn, backend)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
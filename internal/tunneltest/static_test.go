@@ -0,0 +1,133 @@
+package tunneltest_test
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+// writeSite builds a directory to serve, with a secret file next to it
+// that a symlink inside points at
+func writeSite(t *testing.T) string {
+	t.Helper()
+
+	base := t.TempDir()
+	dir := filepath.Join(base, "site")
+	files := map[string]string{
+		"site/index.html":        "home",
+		"site/docs/guide.txt":    "guide",
+		"site/unlisted/note.txt": "note",
+		"secret.txt":             "secret",
+	}
+	for name, content := range files {
+		path := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	for link, target := range map[string]string{
+		"escape.txt": "../secret.txt",
+		"alias.txt":  "docs/guide.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+	}
+	return dir
+}
+
+// staticGet requests a path through the proxy, returning the status and body
+func staticGet(t *testing.T, s *tunneltest.Server, host, path string, setup func(*http.Request)) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.HTTPAddr().String()+path, nil)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	req.Host = host
+	if setup != nil {
+		setup(req)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s%s: %v", host, path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestStaticDirectories(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("static")
+	dir := writeSite(t)
+	s.AddHTTPService(tunnel.ID, "site.test", "static://site")
+	s.AddHTTPService(tunnel.ID, "listed.test", "static://listed")
+
+	s.NewClientWithConfig(client.Config{
+		Token: tunnel.Token,
+		StaticDirs: map[string]client.StaticDir{
+			"site":   {Path: dir},
+			"listed": {Path: dir, Listing: true, Username: "user", Password: "s3cret"},
+		},
+	})
+	s.WaitConnections(tunnel.ID, 1)
+
+	if body := proxyGet(t, s, "site.test", "/"); body != "home" {
+		t.Fatalf("got index %q, want %q", body, "home")
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		wantBody string
+	}{
+		{"file", "/docs/guide.txt", http.StatusOK, "guide"},
+		{"symlink inside the directory", "/alias.txt", http.StatusOK, "guide"},
+		{"symlink out of the directory", "/escape.txt", http.StatusNotFound, ""},
+		{"traversal", "/../secret.txt", http.StatusNotFound, ""},
+		{"directory without an index", "/unlisted/", http.StatusNotFound, ""},
+		{"missing file", "/missing.txt", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		status, body := staticGet(t, s, "site.test", test.path, nil)
+		if status != test.status {
+			t.Errorf("%s: GET %s = %d, want %d", test.name, test.path, status, test.status)
+		}
+		if test.wantBody != "" && body != test.wantBody {
+			t.Errorf("%s: GET %s body %q, want %q", test.name, test.path, body, test.wantBody)
+		}
+		if strings.Contains(body, "secret") {
+			t.Errorf("%s: GET %s leaked the file outside the directory", test.name, test.path)
+		}
+	}
+
+	status, body := staticGet(t, s, "site.test", "/docs/guide.txt", func(req *http.Request) {
+		req.Header.Set("Range", "bytes=1-3")
+	})
+	if status != http.StatusPartialContent || body != "uid" {
+		t.Errorf("range request = %d %q, want %d %q", status, body, http.StatusPartialContent, "uid")
+	}
+
+	// The listed directory needs credentials, then lists what has no index
+	if status, _ := staticGet(t, s, "listed.test", "/unlisted/", nil); status != http.StatusUnauthorized {
+		t.Errorf("GET without credentials = %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, body = staticGet(t, s, "listed.test", "/unlisted/", func(req *http.Request) {
+		req.SetBasicAuth("user", "s3cret")
+	})
+	if status != http.StatusOK || !strings.Contains(body, "note.txt") {
+		t.Errorf("listing = %d %q, want %d with note.txt", status, body, http.StatusOK)
+	}
+}
@@ -0,0 +1,88 @@
+package tunneltest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// NewHTTPTarget serves handler on a loopback port standing in for a local
+// app behind the client, and returns its host:port
+func NewHTTPTarget(t testing.TB, handler http.Handler) string {
+	t.Helper()
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	return strings.TrimPrefix(ts.URL, "http://")
+}
+
+// NewTLSHTTPTarget serves handler over TLS on a loopback port, for tls://
+// targets. It returns the target's host:port and a CA file that verifies
+// its certificate, which is valid for 127.0.0.1 and example.com.
+func NewTLSHTTPTarget(t testing.TB, handler http.Handler) (string, string) {
+	t.Helper()
+
+	ts := httptest.NewTLSServer(handler)
+	t.Cleanup(ts.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+	return strings.TrimPrefix(ts.URL, "https://"), caFile
+}
+
+// NewEchoTarget runs a TCP server that echoes everything it reads. When the
+// peer shuts down its sending side, the target finishes echoing and then
+// closes, so half-close handling can be observed end to end.
+func NewEchoTarget(t testing.TB) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tunneltest: failed to start echo target: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// NewUDPEchoTarget runs a UDP server that sends every datagram back to its
+// sender
+func NewUDPEchoTarget(t testing.TB) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tunneltest: failed to start UDP echo target: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,363 @@
+// Package tunneltest runs a complete picotunnel server and in-process
+// clients on loopback for end-to-end tests. Everything binds to ephemeral
+// ports and stores its state in a temporary directory, so tests run
+// offline and in parallel.
+package tunneltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/models"
+	"github.com/jclement/picotunnel/internal/server"
+)
+
+// DefaultTimeout bounds how long helpers wait for the tunnel to settle
+const DefaultTimeout = 10 * time.Second
+
+// Server is a running picotunnel server with its management API and HTTP
+// proxy on loopback
+type Server struct {
+	*server.Server
+
+	t       testing.TB
+	config  server.Config
+	stopped bool
+}
+
+// NewServer starts a server backed by a temporary SQLite database. It is
+// stopped when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	return newServer(t, defaultConfig(t))
+}
+
+// NewTLSServer starts a server with a self-signed certificate, so its
+// WebSocket listener speaks TLS and the raw TLS transport is enabled on
+// TunnelTLSAddr. Clients reach it with a wss:// or tls:// ServerAddr.
+func NewTLSServer(t testing.TB) *Server {
+	t.Helper()
+
+	config := defaultConfig(t)
+	config.TunnelTLSAddr = "127.0.0.1:0"
+	config.TLSCertFile, config.TLSKeyFile = WriteCertificate(t)
+	return newServer(t, config)
+}
+
+// defaultConfig binds everything to ephemeral loopback ports
+func defaultConfig(t testing.TB) server.Config {
+	return server.Config{
+		ListenAddr:   "127.0.0.1:0",
+		TunnelAddr:   "127.0.0.1:0",
+		HTTPAddr:     "127.0.0.1:0",
+		DataDir:      t.TempDir(),
+		Version:      "test",
+		DrainTimeout: time.Second,
+	}
+}
+
+// newServer starts a server from config, stopping it when the test
+// finishes
+func newServer(t testing.TB, config server.Config) *Server {
+	t.Helper()
+
+	s := &Server{t: t, config: config}
+	s.start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// start creates and starts the underlying server from s.config
+func (s *Server) start() {
+	s.t.Helper()
+
+	srv, err := server.NewServer(s.config)
+	if err != nil {
+		s.t.Fatalf("tunneltest: failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		s.t.Fatalf("tunneltest: failed to start server: %v", err)
+	}
+
+	s.Server = srv
+	s.stopped = false
+}
+
+// Stop stops the server. It is safe to call more than once.
+func (s *Server) Stop() {
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	s.Server.Stop()
+}
+
+// Restart stops the server and starts it again on the same addresses and
+// database, so connected clients have to reconnect
+func (s *Server) Restart() {
+	s.t.Helper()
+
+	s.config.ListenAddr = s.Addr().String()
+	s.config.TunnelAddr = s.TunnelAddr().String()
+	s.config.HTTPAddr = s.HTTPAddr().String()
+	if addr := s.TunnelTLSAddr(); addr != nil {
+		s.config.TunnelTLSAddr = addr.String()
+	}
+
+	s.Stop()
+	s.start()
+}
+
+// CertFile returns the self-signed certificate of a server started with
+// NewTLSServer, which clients can use as its CA
+func (s *Server) CertFile() string {
+	return s.config.TLSCertFile
+}
+
+// APIURL returns the base URL of the management API
+func (s *Server) APIURL() string {
+	return "http://" + s.Addr().String()
+}
+
+// CreateTunnel creates a tunnel through the API
+func (s *Server) CreateTunnel(name string) *models.Tunnel {
+	s.t.Helper()
+
+	var tunnel models.Tunnel
+	s.api(http.MethodPost, "/api/tunnels", server.CreateTunnelRequest{Name: name}, http.StatusCreated, &tunnel)
+	return &tunnel
+}
+
+// UpdateTunnel changes a tunnel's name or its limits on client-declared
+// services
+func (s *Server) UpdateTunnel(tunnelID string, req server.UpdateTunnelRequest) *server.TunnelResponse {
+	s.t.Helper()
+
+	var tunnel server.TunnelResponse
+	s.api(http.MethodPatch, "/api/tunnels/"+tunnelID, req, http.StatusOK, &tunnel)
+	return &tunnel
+}
+
+// RegenerateToken issues a new token for a tunnel and returns it
+func (s *Server) RegenerateToken(tunnelID string) string {
+	s.t.Helper()
+
+	var tunnel models.Tunnel
+	s.api(http.MethodPost, "/api/tunnels/"+tunnelID+"/regenerate", nil, http.StatusOK, &tunnel)
+	return tunnel.Token
+}
+
+// CreateService adds a service to a tunnel through the API
+func (s *Server) CreateService(tunnelID string, req server.CreateServiceRequest) *models.Service {
+	s.t.Helper()
+
+	var service models.Service
+	s.api(http.MethodPost, "/api/tunnels/"+tunnelID+"/services", req, http.StatusCreated, &service)
+	return &service
+}
+
+// AddHTTPService routes a domain on the HTTP proxy to a target on the
+// client's side
+func (s *Server) AddHTTPService(tunnelID, domain, target string) *models.Service {
+	s.t.Helper()
+
+	return s.CreateService(tunnelID, server.CreateServiceRequest{
+		Type:       "http",
+		Domain:     domain,
+		TargetAddr: target,
+		Enabled:    true,
+	})
+}
+
+// AddTCPService listens on a free loopback port and forwards connections
+// to a target on the client's side. The public address is the service's
+// ListenAddr.
+func (s *Server) AddTCPService(tunnelID, target string) *models.Service {
+	s.t.Helper()
+
+	return s.CreateService(tunnelID, server.CreateServiceRequest{
+		Type:       "tcp",
+		ListenAddr: FreePort(s.t, "tcp"),
+		TargetAddr: target,
+		Enabled:    true,
+	})
+}
+
+// AddUDPService listens on a free loopback UDP port and relays datagrams
+// to a target on the client's side
+func (s *Server) AddUDPService(tunnelID, target string) *models.Service {
+	s.t.Helper()
+
+	return s.CreateService(tunnelID, server.CreateServiceRequest{
+		Type:       "udp",
+		ListenAddr: FreePort(s.t, "udp"),
+		TargetAddr: target,
+		Enabled:    true,
+	})
+}
+
+// ListServices lists a tunnel's services, including client-declared ones
+func (s *Server) ListServices(tunnelID string) []*models.Service {
+	s.t.Helper()
+
+	var services []*models.Service
+	s.api(http.MethodGet, "/api/tunnels/"+tunnelID+"/services", nil, http.StatusOK, &services)
+	return services
+}
+
+// GetTunnel fetches a tunnel with its runtime status
+func (s *Server) GetTunnel(tunnelID string) *server.TunnelResponse {
+	s.t.Helper()
+
+	var tunnel server.TunnelResponse
+	s.api(http.MethodGet, "/api/tunnels/"+tunnelID, nil, http.StatusOK, &tunnel)
+	return &tunnel
+}
+
+// WaitConnections waits until a tunnel has exactly n live connections
+func (s *Server) WaitConnections(tunnelID string, n int) {
+	s.t.Helper()
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		got := len(s.GetTunnel(tunnelID).Connections)
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("tunneltest: tunnel %s has %d connections, want %d", tunnelID, got, n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// ProxyGet sends a GET through the HTTP proxy with the given Host header
+func (s *Server) ProxyGet(host, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.HTTPAddr().String()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	return http.DefaultClient.Do(req)
+}
+
+// api performs a management API request and decodes the response into out
+func (s *Server) api(method, path string, body any, wantStatus int, out any) {
+	s.t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatalf("tunneltest: failed to encode request: %v", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, s.APIURL()+path, reqBody)
+	if err != nil {
+		s.t.Fatalf("tunneltest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatalf("tunneltest: %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != wantStatus {
+		s.t.Fatalf("tunneltest: %s %s: status %d, want %d: %s", method, path, resp.StatusCode, wantStatus, data)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			s.t.Fatalf("tunneltest: failed to decode %s %s response: %v", method, path, err)
+		}
+	}
+}
+
+// NewClient starts an in-process client connected to the server with the
+// given token. It is stopped when the test finishes.
+func (s *Server) NewClient(token string) *client.Client {
+	s.t.Helper()
+
+	return s.NewClientWithConfig(client.Config{Token: token})
+}
+
+// NewClientWithConfig starts an in-process client. ServerAddr (unless set,
+// such as to a name only a proxy stand-in resolves), Plaintext, Insecure
+// and Version are filled in to reach the harness server.
+func (s *Server) NewClientWithConfig(config client.Config) *client.Client {
+	s.t.Helper()
+
+	if config.ServerAddr == "" {
+		config.ServerAddr = s.TunnelAddr().String()
+		config.Plaintext = true
+	}
+	config.Insecure = true
+	if config.Version == "" {
+		config.Version = "test"
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = time.Second
+	}
+
+	c := client.NewClient(config)
+	if err := c.Start(); err != nil {
+		s.t.Fatalf("tunneltest: failed to start client: %v", err)
+	}
+	s.t.Cleanup(func() { c.Stop() })
+	return c
+}
+
+// FreePort returns a loopback address with a currently unused port for
+// network "tcp" or "udp"
+func FreePort(t testing.TB, network string) string {
+	t.Helper()
+
+	switch network {
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("tunneltest: failed to find free port: %v", err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	case "udp":
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("tunneltest: failed to find free port: %v", err)
+		}
+		defer c.Close()
+		return c.LocalAddr().String()
+	}
+
+	t.Fatalf("tunneltest: unsupported network %q", network)
+	return ""
+}
+
+// Eventually retries fn until it succeeds or DefaultTimeout passes
+func Eventually(t testing.TB, fn func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunneltest: condition not met: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
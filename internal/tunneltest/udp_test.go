@@ -0,0 +1,88 @@
+package tunneltest_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+func TestUDPProxying(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tun := s.CreateTunnel("udp")
+	service := s.AddUDPService(tun.ID, tunneltest.NewUDPEchoTarget(t))
+
+	c := s.NewClient(tun.Token)
+	s.WaitConnections(tun.ID, 1)
+
+	// Each peer gets its own session, and only its own replies
+	var peers []*net.UDPConn
+	for i := range 3 {
+		peer := dialUDP(t, service.ListenAddr)
+		peers = append(peers, peer)
+		expectUDPEcho(t, peer, fmt.Sprintf("peer %d", i))
+	}
+	for i, peer := range peers {
+		expectUDPEcho(t, peer, fmt.Sprintf("peer %d again", i))
+	}
+	activeStreams := func(want int) {
+		t.Helper()
+		tunneltest.Eventually(t, func() error {
+			if got := s.GetTunnel(tun.ID).Connections[0].ActiveStreams; got != want {
+				return fmt.Errorf("server has %d active streams, want %d", got, want)
+			}
+			if got := c.Status().ActiveStreams; got != want {
+				return fmt.Errorf("client has %d active streams, want %d", got, want)
+			}
+			return nil
+		})
+	}
+	activeStreams(len(peers))
+
+	// Idle sessions are torn down on both sides (see TestMain)
+	activeStreams(0)
+
+	// and a peer coming back starts a new one
+	expectUDPEcho(t, peers[0], "after idle")
+	activeStreams(1)
+}
+
+// dialUDP connects a UDP socket to addr, closing it when the test ends
+func dialUDP(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("resolve %s: %v", addr, err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// expectUDPEcho sends msg until the same datagram comes back, since
+// datagrams may be dropped
+func expectUDPEcho(t *testing.T, conn *net.UDPConn, msg string) {
+	t.Helper()
+
+	buf := make([]byte, 1024)
+	tunneltest.Eventually(t, func() error {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if got := string(buf[:n]); got != msg {
+			return fmt.Errorf("got %q, want %q", got, msg)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package tunneltest_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+// listenUnix listens on a socket in a temporary directory, closing it when
+// the test ends
+func listenUnix(t *testing.T, name string) (net.Listener, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen on %s: %v", path, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+// serveUnixHTTP answers every request on a new socket with body
+func serveUnixHTTP(t *testing.T, name, body string) string {
+	t.Helper()
+
+	l, path := listenUnix(t, name)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	return path
+}
+
+func TestUnixSocketTargets(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("unix")
+
+	httpSocket := serveUnixHTTP(t, "http.sock", "from a socket")
+	s.AddHTTPService(tunnel.ID, "app.test", "unix://"+httpSocket)
+
+	l, echoSocket := listenUnix(t, "echo.sock")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	service := s.AddTCPService(tunnel.ID, "unix://"+echoSocket)
+
+	s.NewClient(tunnel.Token)
+	s.WaitConnections(tunnel.ID, 1)
+
+	if body := proxyGet(t, s, "app.test", "/"); body != "from a socket" {
+		t.Fatalf("got body %q, want %q", body, "from a socket")
+	}
+	expectEcho(t, service.ListenAddr)
+}
+
+func TestUnixSocketTargetsFollowPolicy(t *testing.T) {
+	s := tunneltest.NewServer(t)
+	tunnel := s.CreateTunnel("unix")
+
+	allowed := serveUnixHTTP(t, "allowed.sock", "allowed")
+	denied := serveUnixHTTP(t, "denied.sock", "denied")
+	s.AddHTTPService(tunnel.ID, "allowed.test", "unix://"+allowed)
+	s.AddHTTPService(tunnel.ID, "denied.test", "unix://"+denied)
+
+	// Path rules match sockets; host rules such as localhost never do
+	policy, err := client.NewPolicy([]string{"localhost", filepath.Dir(allowed) + "/*.sock"}, nil, false)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	s.NewClientWithConfig(client.Config{Token: tunnel.Token, Policy: policy})
+	s.WaitConnections(tunnel.ID, 1)
+
+	if body := proxyGet(t, s, "allowed.test", "/"); body != "allowed" {
+		t.Fatalf("got body %q, want %q", body, "allowed")
+	}
+
+	resp, err := s.ProxyGet("denied.test", "/")
+	if err != nil {
+		t.Fatalf("proxy request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got status %d for a socket outside the policy, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
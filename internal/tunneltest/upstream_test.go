@@ -0,0 +1,62 @@
+package tunneltest_test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/jclement/picotunnel/internal/client"
+	"github.com/jclement/picotunnel/internal/tunneltest"
+)
+
+func TestTLSTargets(t *testing.T) {
+	target, caFile := tunneltest.NewTLSHTTPTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+
+	tests := []struct {
+		name    string
+		options client.UpstreamTLSConfig
+		ok      bool
+	}{
+		{"verified with a CA", client.UpstreamTLSConfig{CAFile: caFile}, true},
+		{"verified with the server name", client.UpstreamTLSConfig{CAFile: caFile, ServerName: "example.com"}, true},
+		{"insecure", client.UpstreamTLSConfig{InsecureSkipVerify: true}, true},
+		{"unknown CA", client.UpstreamTLSConfig{}, false},
+		{"wrong server name", client.UpstreamTLSConfig{CAFile: caFile, ServerName: "other.test"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := tunneltest.NewServer(t)
+			tunnel := s.CreateTunnel("upstream")
+			s.AddHTTPService(tunnel.ID, "app.test", "tls://"+target)
+
+			// Options for the target itself win over the "*" defaults
+			s.NewClientWithConfig(client.Config{
+				Token: tunnel.Token,
+				UpstreamTLS: map[string]client.UpstreamTLSConfig{
+					"*":    {CAFile: "/nonexistent/ca.pem"},
+					target: test.options,
+				},
+			})
+			s.WaitConnections(tunnel.ID, 1)
+
+			if test.ok {
+				if body := proxyGet(t, s, "app.test", "/"); body != "secure" {
+					t.Fatalf("got body %q, want %q", body, "secure")
+				}
+				return
+			}
+
+			resp, err := s.ProxyGet("app.test", "/")
+			if err != nil {
+				t.Fatalf("proxy request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Fatalf("got status %d, want %d when the target fails verification", resp.StatusCode, http.StatusBadGateway)
+			}
+		})
+	}
+}